@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/otoolep/hraftd/etcdapi"
+	"github.com/otoolep/hraftd/store"
+	"gopkg.in/yaml.v3"
+)
+
+// The options of hraftd are taken, from the lowest precedence to the highest,
+// from their defaults, the configuration file, HRAFTD_* environment variables
+// and the command line.
+//
+// The configuration file is YAML, or TOML if its name ends in ".toml". Its
+// keys are the names of the command line options, except that the "raft-"
+// options are set in a "raft" section, without the prefix:
+//
+//	haddr: localhost:11001
+//	join: localhost:11000
+//	fsm-backend: bolt
+//	raft:
+//	  cluster-size: 31
+//	  heartbeat-timeout: 2s
+//
+// The environment variable of an option is its name in upper case, prefixed
+// with HRAFTD_ and with dashes replaced by underscores, such as HRAFTD_HADDR
+// or HRAFTD_RAFT_HEARTBEAT_TIMEOUT.
+const (
+	envPrefix  = "HRAFTD_"
+	raftPrefix = "raft-"
+	raftTable  = "raft"
+)
+
+// configure parses the command line args, and sets the options which are not
+// set on it from the configuration file and the environment.
+func configure(args []string) error {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return err
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	apply := func(name, value, source string) error {
+		if set[name] {
+			return nil
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("%s: invalid value %q for option %s: %s", source, value, name, err)
+		}
+		return nil
+	}
+
+	path := configFile
+	if path == "" {
+		path = os.Getenv(envName("config"))
+	}
+	if path != "" {
+		opts, err := readConfig(path)
+		if err != nil {
+			return err
+		}
+		for name, v := range opts {
+			if err := apply(name, v, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(envName(f.Name)); ok && err == nil {
+			err = apply(f.Name, v, envName(f.Name))
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if flag.NArg() > 0 {
+		dataDir = flag.Arg(0)
+	}
+	if nodeID == "" {
+		nodeID = raftAddr
+	}
+	return nil
+}
+
+// envName returns the environment variable of the option.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// readConfig reads the configuration file at path, and returns the options it
+// sets, by name.
+func readConfig(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if isTOML(path) {
+		err = toml.Unmarshal(b, &m)
+	} else {
+		err = yaml.Unmarshal(b, &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	opts := make(map[string]string)
+	var add func(prefix string, m map[string]interface{}) error
+	add = func(prefix string, m map[string]interface{}) error {
+		for k, v := range m {
+			name := prefix + k
+			if t, ok := v.(map[string]interface{}); ok && prefix == "" && k == raftTable {
+				if err := add(raftPrefix, t); err != nil {
+					return err
+				}
+				continue
+			}
+			if name == "config" || flag.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown option %s", path, name)
+			}
+			switch v.(type) {
+			case map[string]interface{}, []interface{}, nil:
+				return fmt.Errorf("%s: option %s must be a single value", path, name)
+			}
+			opts[name] = fmt.Sprint(v)
+		}
+		return nil
+	}
+	if err := add("", m); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// isTOML returns whether the configuration file at path is TOML.
+func isTOML(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".toml")
+}
+
+// newStore returns a store configured with the options.
+func newStore() *store.Store {
+	s := store.New(inmem)
+	s.RaftDir = dataDir
+	s.RaftBind = raftAddr
+	s.AutoCompactionMode = autoCompactionMode
+	s.AutoCompactionRetention = autoCompactionRetention
+	s.QuotaBackendBytes = quotaBackendBytes
+	s.LeaseReads = leaseReads
+	s.MaxClockDrift = maxClockDrift
+	s.BatchWrites = batchWrites
+	s.MaxBatchBytes = maxBatchBytes
+	s.BatchLinger = batchLinger
+	s.ForwardWrites = forwardWrites
+	s.FSMBackend = fsmBackend
+	s.NodeMeta = map[string]string{
+		store.MetaEtcdAddr: etcdAddr,
+		store.MetaHTTPAddr: httpAddr,
+	}
+	return s
+}
+
+// validateConfig returns an error if the options are not valid.
+func validateConfig() error {
+	if dataDir == "" {
+		return errors.New("no Raft storage directory specified")
+	}
+	switch authToken {
+	case etcdapi.TokenSimple, etcdapi.TokenJWT:
+	default:
+		return fmt.Errorf("unknown auth token type %q", authToken)
+	}
+	return newStore().Validate(&raftConfig)
+}
+
+// effectiveConfig returns the options, in the layout of the configuration
+// file, with the Raft options left to their defaults set to the defaults for
+// the size of the cluster.
+func effectiveConfig() map[string]interface{} {
+	m := make(map[string]interface{})
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || strings.HasPrefix(f.Name, raftPrefix) {
+			return
+		}
+		var v interface{} = f.Value.String()
+		if g, ok := f.Value.(flag.Getter); ok {
+			v = g.Get()
+		}
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		m[f.Name] = v
+	})
+
+	c := raftConfig.WithDefaults()
+	raft := make(map[string]interface{})
+	for _, o := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"cluster-size", c.ClusterSize},
+		{"heartbeat-timeout", c.HeartbeatTimeout.String()},
+		{"election-timeout", c.ElectionTimeout.String()},
+		{"leader-lease-timeout", c.LeaderLeaseTimeout.String()},
+		{"commit-timeout", c.CommitTimeout.String()},
+		{"max-append-entries", c.MaxAppendEntries},
+		{"snapshot-interval", c.SnapshotInterval.String()},
+		{"snapshot-threshold", c.SnapshotThreshold},
+		{"trailing-logs", c.TrailingLogs},
+		{"retain-snapshots", c.RetainSnapshots},
+		{"transport-max-pool", c.TransportMaxPool},
+		{"transport-timeout", c.TransportTimeout.String()},
+	} {
+		raft[o.name] = o.v
+	}
+	m[raftTable] = raft
+	return m
+}
+
+// printConfig writes the effective configuration to w, in TOML if the
+// configuration file is TOML, and in YAML otherwise.
+func printConfig(w io.Writer) error {
+	m := effectiveConfig()
+	if isTOML(configFile) {
+		return toml.NewEncoder(w).Encode(m)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// runConfig runs the config subcommand, which validates or prints the
+// effective configuration for the options args.
+func runConfig(args []string) error {
+	if len(args) == 0 || (args[0] != "validate" && args[0] != "print") {
+		return errors.New("usage: hraftd config validate|print [options] [<raft-data-path>]")
+	}
+	if err := configure(args[1:]); err != nil {
+		return err
+	}
+	if args[0] == "print" {
+		if err := printConfig(os.Stdout); err != nil {
+			return err
+		}
+	}
+	if err := validateConfig(); err != nil {
+		return fmt.Errorf("invalid configuration: %s", err)
+	}
+	if args[0] == "validate" {
+		fmt.Println("configuration is valid")
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func Test_Configure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "node.yaml")
+	err := os.WriteFile(path, []byte(`
+haddr: localhost:11001
+eaddr: localhost:2380
+join: localhost:11000
+raft:
+  cluster-size: 31
+  heartbeat-timeout: 3s
+  election-timeout: 3s
+`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write configuration file: %s", err)
+	}
+
+	// The environment takes precedence over the file, and the command line
+	// over both.
+	t.Setenv("HRAFTD_CONFIG", path)
+	t.Setenv("HRAFTD_EADDR", "localhost:2381")
+	t.Setenv("HRAFTD_RAFT_HEARTBEAT_TIMEOUT", "4s")
+	t.Setenv("HRAFTD_BATCH_WRITES", "true")
+	if err := configure([]string{"-raft-heartbeat-timeout", "2s", "-id", "node1", filepath.Join(dir, "data")}); err != nil {
+		t.Fatalf("failed to configure: %s", err)
+	}
+	if httpAddr != "localhost:11001" || joinAddr != "localhost:11000" {
+		t.Fatalf("options not set from the configuration file")
+	}
+	if etcdAddr != "localhost:2381" || !batchWrites {
+		t.Fatalf("options not set from the environment")
+	}
+	if raftConfig.HeartbeatTimeout != 2*time.Second || nodeID != "node1" || dataDir != filepath.Join(dir, "data") {
+		t.Fatalf("options not set from the command line")
+	}
+	if err := validateConfig(); err != nil {
+		t.Fatalf("configuration not valid: %s", err)
+	}
+
+	var b bytes.Buffer
+	if err := printConfig(&b); err != nil {
+		t.Fatalf("failed to print configuration: %s", err)
+	}
+	var printed struct {
+		Haddr string `yaml:"haddr"`
+		Raft  struct {
+			ClusterSize      int    `yaml:"cluster-size"`
+			ElectionTimeout  string `yaml:"election-timeout"`
+			MaxAppendEntries int    `yaml:"max-append-entries"`
+		} `yaml:"raft"`
+	}
+	if err := yaml.Unmarshal(b.Bytes(), &printed); err != nil {
+		t.Fatalf("failed to parse printed configuration: %s", err)
+	}
+	if printed.Haddr != "localhost:11001" || printed.Raft.ClusterSize != 31 ||
+		printed.Raft.ElectionTimeout != "3s" || printed.Raft.MaxAppendEntries != 256 {
+		t.Fatalf("wrong configuration printed:\n%s", b.String())
+	}
+}
+
+func Test_ReadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write configuration file: %s", err)
+		}
+		return path
+	}
+
+	opts, err := readConfig(write("node.toml", `
+fsm-backend = "bolt"
+quota-backend-bytes = 1048576
+lease-reads = true
+
+[raft]
+trailing-logs = 20480
+snapshot-interval = "30s"
+`))
+	if err != nil {
+		t.Fatalf("failed to read TOML configuration: %s", err)
+	}
+	for name, v := range map[string]string{
+		"fsm-backend":            "bolt",
+		"quota-backend-bytes":    "1048576",
+		"lease-reads":            "true",
+		"raft-trailing-logs":     "20480",
+		"raft-snapshot-interval": "30s",
+	} {
+		if opts[name] != v {
+			t.Fatalf("wrong value for option %s: %q", name, opts[name])
+		}
+	}
+
+	for _, content := range []string{
+		"bogus: 1",
+		"raft:\n  bogus: 1",
+		"config: other.yaml",
+		"haddr: [a, b]",
+	} {
+		if _, err := readConfig(write("bad.yaml", content)); err == nil || !strings.Contains(err.Error(), "bad.yaml") {
+			t.Fatalf("invalid configuration %q accepted: %v", content, err)
+		}
+	}
+}
@@ -1,28 +1,78 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"io"
 	"log"
+	"os"
 	"testing"
 	"time"
 
+	"github.com/otoolep/hraftd/etcdapi"
+	"github.com/otoolep/hraftd/store"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
-func TestEtcdAPI(t *testing.T) {
-	// 创建一个新的 etcd 客户端
+// testEtcdAddr 是测试用单节点集群的 etcd API 地址
+const testEtcdAddr = "127.0.0.1:23790"
+
+// testStore 是测试用单节点集群的存储
+var testStore *store.Store
+
+// TestMain 启动一个单节点集群，供本包中的 etcd API 测试使用
+func TestMain(m *testing.M) {
+	tmpDir, err := os.MkdirTemp("", "hraftd_etcd_test")
+	if err != nil {
+		log.Fatalf("创建临时目录失败: %v", err)
+	}
+
+	s := store.New(true)
+	s.RaftDir = tmpDir
+	s.RaftBind = "127.0.0.1:0"
+	s.NodeMeta = map[string]string{store.MetaEtcdAddr: testEtcdAddr}
+	if err := s.Open(true, "node0", nil); err != nil {
+		log.Fatalf("打开存储失败: %v", err)
+	}
+	testStore = s
+
+	e := etcdapi.New(testEtcdAddr, s)
+	if err := e.Start(); err != nil {
+		log.Fatalf("启动 etcd API 服务失败: %v", err)
+	}
+
+	// 等待节点成为 leader
+	time.Sleep(3 * time.Second)
+
+	code := m.Run()
+	e.Close()
+	os.RemoveAll(tmpDir)
+	os.Exit(code)
+}
+
+// newTestClient 返回连接到测试集群的 etcd 客户端
+func newTestClient(t *testing.T) *clientv3.Client {
 	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   []string{"localhost:2379"},
+		Endpoints:   []string{testEtcdAddr},
 		DialTimeout: 5 * time.Second,
 	})
 	if err != nil {
 		t.Fatalf("创建 etcd 客户端失败: %v", err)
 	}
+	return cli
+}
+
+func TestEtcdAPI(t *testing.T) {
+	// 创建一个新的 etcd 客户端
+	cli := newTestClient(t)
 	defer cli.Close()
 
 	// 测试 Put 操作
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-	_, err = cli.Put(ctx, "test_key", "test_value")
+	_, err := cli.Put(ctx, "test_key", "test_value")
 	cancel()
 	if err != nil {
 		t.Fatalf("Put 操作失败: %v", err)
@@ -67,3 +117,746 @@ func TestEtcdAPI(t *testing.T) {
 
 	log.Println("所有测试通过！")
 }
+
+// TestEtcdRange 测试前缀、区间和 from-key 查询返回按键排序的正确结果
+func TestEtcdRange(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, k := range []string{"range/c", "range/a", "range/b", "rangez"} {
+		if _, err := cli.Put(ctx, k, "v-"+k); err != nil {
+			t.Fatalf("Put 操作失败: %v", err)
+		}
+	}
+
+	keys := func(resp *clientv3.GetResponse) []string {
+		var ks []string
+		for _, kv := range resp.Kvs {
+			ks = append(ks, string(kv.Key))
+		}
+		return ks
+	}
+	check := func(name string, resp *clientv3.GetResponse, err error, exp ...string) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s 查询失败: %v", name, err)
+		}
+		got := keys(resp)
+		if len(got) != len(exp) {
+			t.Fatalf("%s 查询结果不正确: 期望 %v, 实际 %v", name, exp, got)
+		}
+		for i := range exp {
+			if got[i] != exp[i] {
+				t.Fatalf("%s 查询结果不正确: 期望 %v, 实际 %v", name, exp, got)
+			}
+		}
+	}
+
+	resp, err := cli.Get(ctx, "range/", clientv3.WithPrefix())
+	check("前缀", resp, err, "range/a", "range/b", "range/c")
+
+	resp, err = cli.Get(ctx, "range/a", clientv3.WithRange("range/c"))
+	check("区间", resp, err, "range/a", "range/b")
+
+	resp, err = cli.Get(ctx, "range/c", clientv3.WithFromKey())
+	check("from-key", resp, err, "range/c", "rangez")
+
+	resp, err = cli.Get(ctx, "range/", clientv3.WithPrefix(), clientv3.WithLimit(2))
+	check("limit", resp, err, "range/a", "range/b")
+	if resp.Count != 3 || !resp.More {
+		t.Fatalf("limit 查询的 count/more 不正确: count=%d more=%v", resp.Count, resp.More)
+	}
+
+	resp, err = cli.Get(ctx, "range/", clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend))
+	check("降序", resp, err, "range/c", "range/b", "range/a")
+}
+
+// TestEtcdRevisions 测试响应中的修订号随写入递增，且键的版本信息正确
+func TestEtcdSerializable(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	put, err := cli.Put(ctx, "serializable/a", "v1")
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	// 默认的线性一致读和串行化读都应当读到刚写入的值
+	for _, opts := range [][]clientv3.OpOption{nil, {clientv3.WithSerializable()}} {
+		get, err := cli.Get(ctx, "serializable/a", opts...)
+		if err != nil {
+			t.Fatalf("Get 操作失败: %v", err)
+		}
+		if len(get.Kvs) != 1 || get.Header.Revision < put.Header.Revision {
+			t.Fatalf("读取结果不正确: %v", get)
+		}
+	}
+}
+
+func TestEtcdRevisions(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p1, err := cli.Put(ctx, "rev_key", "v1")
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	p2, err := cli.Put(ctx, "rev_key", "v2")
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	if p2.Header.Revision != p1.Header.Revision+1 {
+		t.Fatalf("修订号未递增: %d -> %d", p1.Header.Revision, p2.Header.Revision)
+	}
+
+	resp, err := cli.Get(ctx, "rev_key")
+	if err != nil {
+		t.Fatalf("Get 操作失败: %v", err)
+	}
+	kv := resp.Kvs[0]
+	if kv.CreateRevision != p1.Header.Revision || kv.ModRevision != p2.Header.Revision || kv.Version != 2 {
+		t.Fatalf("键的修订信息不正确: %+v", kv)
+	}
+	if resp.Header.Revision != p2.Header.Revision {
+		t.Fatalf("Get 响应的修订号不正确: 期望 %d, 实际 %d", p2.Header.Revision, resp.Header.Revision)
+	}
+}
+
+// TestEtcdRangeRevision 测试按历史修订号读取，以及读取未来修订号时返回错误
+func TestEtcdRangeRevision(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p1, err := cli.Put(ctx, "hist_key", "v1")
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	if _, err := cli.Put(ctx, "hist_key", "v2"); err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	if _, err := cli.Delete(ctx, "hist_key"); err != nil {
+		t.Fatalf("Delete 操作失败: %v", err)
+	}
+
+	resp, err := cli.Get(ctx, "hist_key", clientv3.WithRev(p1.Header.Revision))
+	if err != nil {
+		t.Fatalf("历史读取失败: %v", err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "v1" {
+		t.Fatalf("历史读取结果不正确: %v", resp.Kvs)
+	}
+
+	_, err = cli.Get(ctx, "hist_key", clientv3.WithRev(resp.Header.Revision+100))
+	if err != rpctypes.ErrFutureRev {
+		t.Fatalf("期望 ErrFutureRev, 实际 %v", err)
+	}
+}
+
+// TestEtcdCompact 测试压缩后旧修订号不可读，而压缩点之后的数据仍然可读
+func TestEtcdCompact(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p1, err := cli.Put(ctx, "compact_key", "v1")
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	p2, err := cli.Put(ctx, "compact_key", "v2")
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+
+	if _, err := cli.Compact(ctx, p2.Header.Revision, clientv3.WithCompactPhysical()); err != nil {
+		t.Fatalf("Compact 操作失败: %v", err)
+	}
+
+	if _, err := cli.Get(ctx, "compact_key", clientv3.WithRev(p1.Header.Revision)); err != rpctypes.ErrCompacted {
+		t.Fatalf("期望 ErrCompacted, 实际 %v", err)
+	}
+	resp, err := cli.Get(ctx, "compact_key", clientv3.WithRev(p2.Header.Revision))
+	if err != nil {
+		t.Fatalf("读取压缩点数据失败: %v", err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "v2" {
+		t.Fatalf("压缩点数据不正确: %v", resp.Kvs)
+	}
+
+	if _, err := cli.Compact(ctx, p2.Header.Revision); err != rpctypes.ErrCompacted {
+		t.Fatalf("重复压缩期望 ErrCompacted, 实际 %v", err)
+	}
+}
+
+// TestEtcdTxn 测试事务根据比较结果原子地执行成功或失败分支
+func TestEtcdTxn(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := cli.Put(ctx, "txn_key", "v1"); err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+
+	// 比较成功，执行成功分支
+	resp, err := cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value("txn_key"), "=", "v1")).
+		Then(clientv3.OpPut("txn_key", "v2"), clientv3.OpGet("txn_key")).
+		Else(clientv3.OpPut("txn_key", "failed")).
+		Commit()
+	if err != nil {
+		t.Fatalf("Txn 操作失败: %v", err)
+	}
+	if !resp.Succeeded {
+		t.Fatalf("Txn 比较应当成功")
+	}
+	kvs := resp.Responses[1].GetResponseRange().Kvs
+	if len(kvs) != 1 || string(kvs[0].Value) != "v2" {
+		t.Fatalf("事务内读取结果不正确: %v", kvs)
+	}
+
+	// 比较失败，执行失败分支
+	resp, err = cli.Txn(ctx).
+		If(clientv3.Compare(clientv3.Version("txn_key"), "=", 1)).
+		Then(clientv3.OpPut("txn_key", "v3")).
+		Else(clientv3.OpGet("txn_key")).
+		Commit()
+	if err != nil {
+		t.Fatalf("Txn 操作失败: %v", err)
+	}
+	if resp.Succeeded {
+		t.Fatalf("Txn 比较应当失败")
+	}
+	if v := string(resp.Responses[0].GetResponseRange().Kvs[0].Value); v != "v2" {
+		t.Fatalf("失败分支读取结果不正确: %s", v)
+	}
+
+	// 同一事务中重复写入同一个键
+	_, err = cli.Txn(ctx).Then(clientv3.OpPut("dup", "1"), clientv3.OpPut("dup", "2")).Commit()
+	if err != rpctypes.ErrDuplicateKey {
+		t.Fatalf("期望 ErrDuplicateKey, 实际 %v", err)
+	}
+}
+
+// TestEtcdDeleteRange 测试前缀删除原子地删除所有匹配的键，并返回被删除的键值对
+func TestEtcdDeleteRange(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, k := range []string{"del/a", "del/b", "del/c", "delz"} {
+		if _, err := cli.Put(ctx, k, "v-"+k); err != nil {
+			t.Fatalf("Put 操作失败: %v", err)
+		}
+	}
+
+	resp, err := cli.Delete(ctx, "del/", clientv3.WithPrefix(), clientv3.WithPrevKV())
+	if err != nil {
+		t.Fatalf("Delete 操作失败: %v", err)
+	}
+	if resp.Deleted != 3 || len(resp.PrevKvs) != 3 {
+		t.Fatalf("前缀删除结果不正确: deleted=%d prev_kvs=%d", resp.Deleted, len(resp.PrevKvs))
+	}
+	if string(resp.PrevKvs[0].Key) != "del/a" || string(resp.PrevKvs[0].Value) != "v-del/a" {
+		t.Fatalf("被删除的键值对不正确: %v", resp.PrevKvs[0])
+	}
+
+	get, err := cli.Get(ctx, "del", clientv3.WithPrefix())
+	if err != nil {
+		t.Fatalf("Get 操作失败: %v", err)
+	}
+	if len(get.Kvs) != 1 || string(get.Kvs[0].Key) != "delz" {
+		t.Fatalf("前缀删除后剩余的键不正确: %v", get.Kvs)
+	}
+
+	resp, err = cli.Delete(ctx, "del/missing")
+	if err != nil {
+		t.Fatalf("Delete 操作失败: %v", err)
+	}
+	if resp.Deleted != 0 {
+		t.Fatalf("删除不存在的键应当返回 0, 实际 %d", resp.Deleted)
+	}
+}
+
+// TestEtcdPutPrevKV 测试 Put 返回被覆盖的键值对，并支持 IgnoreValue
+func TestEtcdPutPrevKV(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p1, err := cli.Put(ctx, "prev_key", "v1")
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	resp, err := cli.Put(ctx, "prev_key", "v2", clientv3.WithPrevKV())
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	if resp.PrevKv == nil || string(resp.PrevKv.Value) != "v1" || resp.PrevKv.ModRevision != p1.Header.Revision {
+		t.Fatalf("返回的旧键值对不正确: %v", resp.PrevKv)
+	}
+
+	if _, err := cli.Put(ctx, "prev_key", "", clientv3.WithIgnoreValue()); err != nil {
+		t.Fatalf("IgnoreValue Put 操作失败: %v", err)
+	}
+	get, err := cli.Get(ctx, "prev_key")
+	if err != nil {
+		t.Fatalf("Get 操作失败: %v", err)
+	}
+	if string(get.Kvs[0].Value) != "v2" || get.Kvs[0].Version != 3 {
+		t.Fatalf("IgnoreValue 后的键值不正确: %v", get.Kvs[0])
+	}
+
+	if _, err := cli.Put(ctx, "prev_missing", "", clientv3.WithIgnoreValue()); err != rpctypes.ErrKeyNotFound {
+		t.Fatalf("期望 ErrKeyNotFound, 实际 %v", err)
+	}
+}
+
+// TestEtcdWatch 测试 Watch：前缀监听、历史回放、prev_kv、过滤、进度通知与取消
+func TestEtcdWatch(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p1, err := cli.Put(ctx, "watch/a", "v1")
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+
+	// 同一个客户端的多个 watcher 复用同一个 gRPC 流
+	wctx, wcancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	defer wcancel()
+	live := cli.Watch(wctx, "watch/", clientv3.WithPrefix(), clientv3.WithPrevKV())
+	past := cli.Watch(wctx, "watch/a", clientv3.WithRev(p1.Header.Revision))
+	noDel := cli.Watch(wctx, "watch/", clientv3.WithPrefix(), clientv3.WithFilterDelete())
+
+	// 等待 watcher 创建完成
+	time.Sleep(500 * time.Millisecond)
+
+	if _, err := cli.Put(ctx, "watch/a", "v2"); err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	if _, err := cli.Delete(ctx, "watch/a"); err != nil {
+		t.Fatalf("Delete 操作失败: %v", err)
+	}
+
+	var events []*clientv3.Event
+	for len(events) < 2 {
+		wr := <-live
+		if err := wr.Err(); err != nil {
+			t.Fatalf("Watch 失败: %v", err)
+		}
+		events = append(events, wr.Events...)
+	}
+	if !events[0].IsModify() || string(events[0].Kv.Value) != "v2" || string(events[0].PrevKv.Value) != "v1" {
+		t.Fatalf("更新事件不正确: %v", events[0])
+	}
+	if events[1].Type != clientv3.EventTypeDelete || string(events[1].PrevKv.Value) != "v2" {
+		t.Fatalf("删除事件不正确: %v", events[1])
+	}
+
+	// 从历史修订号开始的 watcher 先回放创建事件
+	events = nil
+	for len(events) < 3 {
+		wr := <-past
+		if err := wr.Err(); err != nil {
+			t.Fatalf("Watch 失败: %v", err)
+		}
+		events = append(events, wr.Events...)
+	}
+	if !events[0].IsCreate() || events[0].Kv.ModRevision != p1.Header.Revision || events[2].Type != clientv3.EventTypeDelete {
+		t.Fatalf("回放事件不正确: %v", events)
+	}
+
+	// 过滤删除事件的 watcher 只收到更新
+	wr := <-noDel
+	if len(wr.Events) != 1 || !wr.Events[0].IsModify() {
+		t.Fatalf("过滤后的事件不正确: %v", wr.Events)
+	}
+
+	// 进度通知携带当前修订号
+	if err := cli.RequestProgress(wctx); err != nil {
+		t.Fatalf("RequestProgress 失败: %v", err)
+	}
+	wr = <-noDel
+	if !wr.IsProgressNotify() || wr.Header.Revision < p1.Header.Revision+2 {
+		t.Fatalf("进度通知不正确: %+v", wr)
+	}
+
+	// 取消后通道关闭
+	wcancel()
+	for range live {
+	}
+}
+
+// TestEtcdWatchCompacted 测试从已压缩的修订号开始监听
+func TestEtcdWatchCompacted(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	p1, err := cli.Put(ctx, "watch_compact", "v1")
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	p2, err := cli.Put(ctx, "watch_compact", "v2")
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	if _, err := cli.Compact(ctx, p2.Header.Revision); err != nil {
+		t.Fatalf("Compact 操作失败: %v", err)
+	}
+
+	wr := <-cli.Watch(ctx, "watch_compact", clientv3.WithRev(p1.Header.Revision))
+	if wr.CompactRevision != p2.Header.Revision || wr.Err() != rpctypes.ErrCompacted {
+		t.Fatalf("应当返回压缩错误, 实际 compact_revision=%d err=%v", wr.CompactRevision, wr.Err())
+	}
+}
+
+// TestEtcdLease 测试租约：授予、绑定键、续约、查询、撤销与过期
+func TestEtcdLease(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	grant, err := cli.Grant(ctx, 30)
+	if err != nil {
+		t.Fatalf("Grant 操作失败: %v", err)
+	}
+	if _, err := cli.Put(ctx, "lease/a", "v1", clientv3.WithLease(grant.ID)); err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	if _, err := cli.Put(ctx, "lease/missing", "v1", clientv3.WithLease(grant.ID+1)); err != rpctypes.ErrLeaseNotFound {
+		t.Fatalf("绑定不存在的租约应当失败, 实际 %v", err)
+	}
+
+	ka, err := cli.KeepAliveOnce(ctx, grant.ID)
+	if err != nil || ka.TTL != 30 {
+		t.Fatalf("KeepAliveOnce 失败: %v %v", ka, err)
+	}
+
+	ttl, err := cli.TimeToLive(ctx, grant.ID, clientv3.WithAttachedKeys())
+	if err != nil {
+		t.Fatalf("TimeToLive 操作失败: %v", err)
+	}
+	if ttl.GrantedTTL != 30 || ttl.TTL <= 0 || len(ttl.Keys) != 1 || string(ttl.Keys[0]) != "lease/a" {
+		t.Fatalf("租约信息不正确: %+v", ttl)
+	}
+
+	leases, err := cli.Leases(ctx)
+	if err != nil || len(leases.Leases) == 0 {
+		t.Fatalf("Leases 操作失败: %v %v", leases, err)
+	}
+
+	get, err := cli.Get(ctx, "lease/a")
+	if err != nil || get.Kvs[0].Lease != int64(grant.ID) {
+		t.Fatalf("键没有绑定到租约: %v %v", get, err)
+	}
+
+	// 撤销租约会删除绑定的键
+	if _, err := cli.Revoke(ctx, grant.ID); err != nil {
+		t.Fatalf("Revoke 操作失败: %v", err)
+	}
+	get, err = cli.Get(ctx, "lease/a")
+	if err != nil || len(get.Kvs) != 0 {
+		t.Fatalf("撤销租约后键仍然存在: %v %v", get, err)
+	}
+	ttl, err = cli.TimeToLive(ctx, grant.ID)
+	if err != nil || ttl.TTL != -1 {
+		t.Fatalf("撤销后的租约 TTL 应当为 -1: %v %v", ttl, err)
+	}
+
+	// 不续约的租约到期后由 leader 撤销
+	short, err := cli.Grant(ctx, store.MinLeaseTTL)
+	if err != nil {
+		t.Fatalf("Grant 操作失败: %v", err)
+	}
+	if _, err := cli.Put(ctx, "lease/b", "v1", clientv3.WithLease(short.ID)); err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	time.Sleep((store.MinLeaseTTL + 2) * time.Second)
+	get, err = cli.Get(ctx, "lease/b")
+	if err != nil || len(get.Kvs) != 0 {
+		t.Fatalf("租约过期后键仍然存在: %v %v", get, err)
+	}
+}
+
+// TestEtcdCluster 测试成员管理：成员列表、添加/提升/移除 learner
+func TestEtcdCluster(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	list, err := cli.MemberList(ctx)
+	if err != nil {
+		t.Fatalf("MemberList 操作失败: %v", err)
+	}
+	if len(list.Members) != 1 {
+		t.Fatalf("成员数量不正确: %v", list.Members)
+	}
+	self := list.Members[0]
+	if self.Name != "node0" || self.IsLearner || len(self.ClientURLs) != 1 || self.ClientURLs[0] != "http://"+testEtcdAddr {
+		t.Fatalf("成员信息不正确: %+v", self)
+	}
+	if self.ID != list.Header.MemberId {
+		t.Fatalf("响应头中的成员 ID 不正确: %x != %x", list.Header.MemberId, self.ID)
+	}
+
+	// learner 不参与投票，节点未运行也可以添加
+	add, err := cli.MemberAddAsLearner(ctx, []string{"http://127.0.0.1:12999"})
+	if err != nil {
+		t.Fatalf("MemberAddAsLearner 操作失败: %v", err)
+	}
+	if len(add.Members) != 2 || !add.Member.IsLearner {
+		t.Fatalf("添加 learner 的结果不正确: %+v", add)
+	}
+	if _, err := cli.MemberAddAsLearner(ctx, []string{"http://127.0.0.1:12999"}); err != rpctypes.ErrPeerURLExist {
+		t.Fatalf("重复添加应当失败, 实际 %v", err)
+	}
+	if _, err := cli.MemberPromote(ctx, self.ID); err != rpctypes.ErrMemberNotLearner {
+		t.Fatalf("提升 voter 应当失败, 实际 %v", err)
+	}
+
+	if _, err := cli.MemberRemove(ctx, add.Member.ID); err != nil {
+		t.Fatalf("MemberRemove 操作失败: %v", err)
+	}
+	if _, err := cli.MemberRemove(ctx, add.Member.ID); err != rpctypes.ErrMemberNotFound {
+		t.Fatalf("移除不存在的成员应当失败, 实际 %v", err)
+	}
+	list, err = cli.MemberList(ctx)
+	if err != nil || len(list.Members) != 1 {
+		t.Fatalf("移除后的成员列表不正确: %v %v", list, err)
+	}
+}
+
+// TestEtcdMaintenance 测试维护接口：状态、HashKV、快照、碎片整理与告警
+func TestEtcdMaintenance(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	put, err := cli.Put(ctx, "maintenance", "v1")
+	if err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+
+	st, err := cli.Status(ctx, testEtcdAddr)
+	if err != nil {
+		t.Fatalf("Status 操作失败: %v", err)
+	}
+	if st.Leader != st.Header.MemberId || st.Version == "" || st.RaftIndex == 0 || st.RaftTerm == 0 || st.DbSize == 0 {
+		t.Fatalf("状态信息不正确: %+v", st)
+	}
+	if put.Header.RaftTerm != st.RaftTerm || st.Header.RaftTerm != st.RaftTerm {
+		t.Fatalf("响应头中的 Raft 任期不正确: %d, %d != %d", put.Header.RaftTerm, st.Header.RaftTerm, st.RaftTerm)
+	}
+
+	h1, err := cli.HashKV(ctx, testEtcdAddr, put.Header.Revision)
+	if err != nil {
+		t.Fatalf("HashKV 操作失败: %v", err)
+	}
+	if _, err := cli.Put(ctx, "maintenance", "v2"); err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+	h2, err := cli.HashKV(ctx, testEtcdAddr, put.Header.Revision)
+	if err != nil || h1.Hash != h2.Hash {
+		t.Fatalf("同一修订号的哈希应当相同: %v %v %v", h1, h2, err)
+	}
+
+	rc, err := cli.Snapshot(ctx)
+	if err != nil {
+		t.Fatalf("Snapshot 操作失败: %v", err)
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("读取快照失败: %v", err)
+	}
+	if len(b) <= sha256.Size {
+		t.Fatalf("快照过小: %d 字节", len(b))
+	}
+	if sum := sha256.Sum256(b[:len(b)-sha256.Size]); !bytes.Equal(sum[:], b[len(b)-sha256.Size:]) {
+		t.Fatalf("快照校验和不正确")
+	}
+
+	if _, err := cli.Defragment(ctx, testEtcdAddr); err != nil {
+		t.Fatalf("Defragment 操作失败: %v", err)
+	}
+
+	// NOSPACE 告警期间拒绝写入，解除后恢复。clientv3 没有激活告警的方法，直接使用 gRPC 客户端
+	mc := pb.NewMaintenanceClient(cli.ActiveConnection())
+	if _, err := mc.Alarm(ctx, &pb.AlarmRequest{
+		Action:   pb.AlarmRequest_ACTIVATE,
+		MemberID: st.Header.MemberId,
+		Alarm:    pb.AlarmType_NOSPACE,
+	}); err != nil {
+		t.Fatalf("激活告警失败: %v", err)
+	}
+	alarms, err := cli.AlarmList(ctx)
+	if err != nil || len(alarms.Alarms) != 1 || alarms.Alarms[0].Alarm != pb.AlarmType_NOSPACE {
+		t.Fatalf("告警列表不正确: %v %v", alarms, err)
+	}
+	if _, err := cli.Put(ctx, "maintenance", "v3"); err != rpctypes.ErrNoSpace {
+		t.Fatalf("告警期间写入应当失败, 实际 %v", err)
+	}
+	if _, err := cli.AlarmDisarm(ctx, &clientv3.AlarmMember{MemberID: st.Header.MemberId, Alarm: pb.AlarmType_NOSPACE}); err != nil {
+		t.Fatalf("AlarmDisarm 操作失败: %v", err)
+	}
+	if _, err := cli.Put(ctx, "maintenance", "v3"); err != nil {
+		t.Fatalf("解除告警后写入失败: %v", err)
+	}
+}
+
+func TestEtcdAuth(t *testing.T) {
+	cli := newTestClient(t)
+	defer cli.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	if _, err := cli.AuthEnable(ctx); err != rpctypes.ErrRootUserNotExist {
+		t.Fatalf("没有 root 用户时启用认证应当失败, 实际 %v", err)
+	}
+	for _, f := range []func() error{
+		func() error { _, err := cli.UserAdd(ctx, "root", "rootpw"); return err },
+		func() error { _, err := cli.UserGrantRole(ctx, "root", "root"); return err },
+		func() error { _, err := cli.UserAdd(ctx, "alice", "alicepw"); return err },
+		func() error { _, err := cli.RoleAdd(ctx, "auth-reader"); return err },
+		func() error {
+			_, err := cli.RoleGrantPermission(ctx, "auth-reader", "auth/", clientv3.GetPrefixRangeEnd("auth/"), clientv3.PermissionType(clientv3.PermRead))
+			return err
+		},
+		func() error { _, err := cli.UserGrantRole(ctx, "alice", "auth-reader"); return err },
+		func() error { _, err := cli.Put(ctx, "auth/a", "v1"); return err },
+		func() error { _, err := cli.AuthEnable(ctx); return err },
+	} {
+		if err := f(); err != nil {
+			t.Fatalf("配置认证失败: %v", err)
+		}
+	}
+
+	root, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{testEtcdAddr},
+		DialTimeout: 5 * time.Second,
+		Username:    "root",
+		Password:    "rootpw",
+	})
+	if err != nil {
+		t.Fatalf("root 用户认证失败: %v", err)
+	}
+	defer root.Close()
+	defer func() {
+		if _, err := root.AuthDisable(context.Background()); err != nil {
+			t.Errorf("禁用认证失败: %v", err)
+		}
+	}()
+
+	if _, err := cli.Get(ctx, "auth/a"); err != rpctypes.ErrPermissionDenied {
+		t.Fatalf("匿名读取应当被拒绝, 实际 %v", err)
+	}
+	if _, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{testEtcdAddr},
+		DialTimeout: 5 * time.Second,
+		Username:    "alice",
+		Password:    "wrong",
+	}); err != rpctypes.ErrAuthFailed {
+		t.Fatalf("错误的密码应当认证失败, 实际 %v", err)
+	}
+
+	alice, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{testEtcdAddr},
+		DialTimeout: 5 * time.Second,
+		Username:    "alice",
+		Password:    "alicepw",
+	})
+	if err != nil {
+		t.Fatalf("alice 用户认证失败: %v", err)
+	}
+	defer alice.Close()
+
+	get, err := alice.Get(ctx, "auth/", clientv3.WithPrefix())
+	if err != nil || len(get.Kvs) != 1 {
+		t.Fatalf("有权限的读取失败: %v %v", get, err)
+	}
+	if _, err := alice.Get(ctx, "", clientv3.WithFromKey()); err != rpctypes.ErrPermissionDenied {
+		t.Fatalf("超出权限范围的读取应当被拒绝, 实际 %v", err)
+	}
+	if _, err := alice.Put(ctx, "auth/b", "v1"); err != rpctypes.ErrPermissionDenied {
+		t.Fatalf("没有写权限的 Put 应当被拒绝, 实际 %v", err)
+	}
+	if _, err := alice.Txn(ctx).Then(clientv3.OpDelete("auth/a")).Commit(); err != rpctypes.ErrPermissionDenied {
+		t.Fatalf("没有写权限的 Txn 应当被拒绝, 实际 %v", err)
+	}
+	if _, err := alice.UserList(ctx); err != rpctypes.ErrPermissionDenied {
+		t.Fatalf("非 root 用户管理认证应当被拒绝, 实际 %v", err)
+	}
+
+	wch := alice.Watch(ctx, "other")
+	if wresp := <-wch; !wresp.Canceled {
+		t.Fatalf("没有读权限的 Watch 应当被取消: %+v", wresp)
+	}
+
+	if _, err := root.Put(ctx, "auth/b", "v2"); err != nil {
+		t.Fatalf("root 用户 Put 失败: %v", err)
+	}
+	users, err := root.UserList(ctx)
+	if err != nil || len(users.Users) != 2 {
+		t.Fatalf("UserList 操作失败: %v %v", users, err)
+	}
+	role, err := root.RoleGet(ctx, "auth-reader")
+	if err != nil || len(role.Perm) != 1 || string(role.Perm[0].Key) != "auth/" {
+		t.Fatalf("RoleGet 操作失败: %v %v", role, err)
+	}
+
+	// 使用 JWT 令牌的服务
+	e := etcdapi.New("127.0.0.1:23791", testStore)
+	e.AuthToken = etcdapi.TokenJWT
+	if err := e.Start(); err != nil {
+		t.Fatalf("启动 etcd API 服务失败: %v", err)
+	}
+	defer e.Close()
+	jwt, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{"127.0.0.1:23791"},
+		DialTimeout: 5 * time.Second,
+		Username:    "alice",
+		Password:    "alicepw",
+	})
+	if err != nil {
+		t.Fatalf("使用 JWT 令牌认证失败: %v", err)
+	}
+	defer jwt.Close()
+	if get, err := jwt.Get(ctx, "auth/a"); err != nil || len(get.Kvs) != 1 {
+		t.Fatalf("使用 JWT 令牌读取失败: %v %v", get, err)
+	}
+	if _, err := jwt.Put(ctx, "auth/a", "v2"); err != rpctypes.ErrPermissionDenied {
+		t.Fatalf("没有写权限的 Put 应当被拒绝, 实际 %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package etcdapi
+
+import (
+	"context"
+
+	"github.com/otoolep/hraftd/store"
+	"go.etcd.io/etcd/api/v3/authpb"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// AuthEnable implements the etcd v3 AuthEnable API. The root user must exist
+// and have the root role.
+func (s *Service) AuthEnable(ctx context.Context, req *pb.AuthEnableRequest) (*pb.AuthEnableResponse, error) {
+	if err := s.store.AuthEnable(); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthEnableResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// AuthDisable implements the etcd v3 AuthDisable API.
+func (s *Service) AuthDisable(ctx context.Context, req *pb.AuthDisableRequest) (*pb.AuthDisableResponse, error) {
+	if err := s.store.AuthDisable(); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthDisableResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// AuthStatus implements the etcd v3 AuthStatus API.
+func (s *Service) AuthStatus(ctx context.Context, req *pb.AuthStatusRequest) (*pb.AuthStatusResponse, error) {
+	enabled, rev := s.store.AuthStatus()
+	return &pb.AuthStatusResponse{
+		Header:       s.header(s.store.Revision()),
+		Enabled:      enabled,
+		AuthRevision: uint64(rev),
+	}, nil
+}
+
+// Authenticate implements the etcd v3 Authenticate API, issuing a token for
+// the user if the password is right.
+func (s *Service) Authenticate(ctx context.Context, req *pb.AuthenticateRequest) (*pb.AuthenticateResponse, error) {
+	enabled, rev := s.store.AuthStatus()
+	if !enabled {
+		return nil, rpctypes.ErrGRPCAuthNotEnabled
+	}
+	if err := s.store.Authenticate(req.Name, req.Password); err != nil {
+		return nil, toGRPCError(err)
+	}
+	token, err := s.tokens.assign(req.Name, rev)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.AuthenticateResponse{
+		Header: s.header(s.store.Revision()),
+		Token:  token,
+	}, nil
+}
+
+// UserAdd implements the etcd v3 UserAdd API. Passwords are hashed by this
+// node, so pre-hashed passwords are not accepted.
+func (s *Service) UserAdd(ctx context.Context, req *pb.AuthUserAddRequest) (*pb.AuthUserAddResponse, error) {
+	if req.HashedPassword != "" {
+		return nil, status.Error(codes.InvalidArgument, "hashed passwords are not supported")
+	}
+	noPassword := req.Options != nil && req.Options.NoPassword
+	if err := s.store.UserAdd(req.Name, req.Password, noPassword); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthUserAddResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// UserGet implements the etcd v3 UserGet API, returning the roles of the
+// user.
+func (s *Service) UserGet(ctx context.Context, req *pb.AuthUserGetRequest) (*pb.AuthUserGetResponse, error) {
+	u, err := s.store.User(req.Name)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthUserGetResponse{
+		Header: s.header(s.store.Revision()),
+		Roles:  u.Roles,
+	}, nil
+}
+
+// UserList implements the etcd v3 UserList API.
+func (s *Service) UserList(ctx context.Context, req *pb.AuthUserListRequest) (*pb.AuthUserListResponse, error) {
+	return &pb.AuthUserListResponse{
+		Header: s.header(s.store.Revision()),
+		Users:  s.store.Users(),
+	}, nil
+}
+
+// UserDelete implements the etcd v3 UserDelete API.
+func (s *Service) UserDelete(ctx context.Context, req *pb.AuthUserDeleteRequest) (*pb.AuthUserDeleteResponse, error) {
+	if err := s.store.UserDelete(req.Name); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthUserDeleteResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// UserChangePassword implements the etcd v3 UserChangePassword API.
+func (s *Service) UserChangePassword(ctx context.Context, req *pb.AuthUserChangePasswordRequest) (*pb.AuthUserChangePasswordResponse, error) {
+	if req.HashedPassword != "" {
+		return nil, status.Error(codes.InvalidArgument, "hashed passwords are not supported")
+	}
+	if err := s.store.UserChangePassword(req.Name, req.Password); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthUserChangePasswordResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// UserGrantRole implements the etcd v3 UserGrantRole API.
+func (s *Service) UserGrantRole(ctx context.Context, req *pb.AuthUserGrantRoleRequest) (*pb.AuthUserGrantRoleResponse, error) {
+	if err := s.store.UserGrantRole(req.User, req.Role); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthUserGrantRoleResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// UserRevokeRole implements the etcd v3 UserRevokeRole API.
+func (s *Service) UserRevokeRole(ctx context.Context, req *pb.AuthUserRevokeRoleRequest) (*pb.AuthUserRevokeRoleResponse, error) {
+	if err := s.store.UserRevokeRole(req.Name, req.Role); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthUserRevokeRoleResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// RoleAdd implements the etcd v3 RoleAdd API.
+func (s *Service) RoleAdd(ctx context.Context, req *pb.AuthRoleAddRequest) (*pb.AuthRoleAddResponse, error) {
+	if err := s.store.RoleAdd(req.Name); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthRoleAddResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// RoleGet implements the etcd v3 RoleGet API, returning the permissions of
+// the role.
+func (s *Service) RoleGet(ctx context.Context, req *pb.AuthRoleGetRequest) (*pb.AuthRoleGetResponse, error) {
+	r, err := s.store.Role(req.Role)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	resp := &pb.AuthRoleGetResponse{Header: s.header(s.store.Revision())}
+	for _, p := range r.Perms {
+		resp.Perm = append(resp.Perm, &authpb.Permission{
+			PermType: authpb.Permission_Type(authpb.Permission_Type_value[p.Type]),
+			Key:      []byte(p.Key),
+			RangeEnd: []byte(p.End),
+		})
+	}
+	return resp, nil
+}
+
+// RoleList implements the etcd v3 RoleList API.
+func (s *Service) RoleList(ctx context.Context, req *pb.AuthRoleListRequest) (*pb.AuthRoleListResponse, error) {
+	return &pb.AuthRoleListResponse{
+		Header: s.header(s.store.Revision()),
+		Roles:  s.store.Roles(),
+	}, nil
+}
+
+// RoleDelete implements the etcd v3 RoleDelete API.
+func (s *Service) RoleDelete(ctx context.Context, req *pb.AuthRoleDeleteRequest) (*pb.AuthRoleDeleteResponse, error) {
+	if err := s.store.RoleDelete(req.Role); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthRoleDeleteResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// RoleGrantPermission implements the etcd v3 RoleGrantPermission API.
+func (s *Service) RoleGrantPermission(ctx context.Context, req *pb.AuthRoleGrantPermissionRequest) (*pb.AuthRoleGrantPermissionResponse, error) {
+	if req.Perm == nil {
+		return nil, rpctypes.ErrGRPCPermissionNotGiven
+	}
+	typ, ok := authpb.Permission_Type_name[int32(req.Perm.PermType)]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid permission type %v", req.Perm.PermType)
+	}
+	err := s.store.RoleGrantPermission(req.Name, store.Permission{
+		Type: typ,
+		Key:  string(req.Perm.Key),
+		End:  string(req.Perm.RangeEnd),
+	})
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthRoleGrantPermissionResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// RoleRevokePermission implements the etcd v3 RoleRevokePermission API.
+func (s *Service) RoleRevokePermission(ctx context.Context, req *pb.AuthRoleRevokePermissionRequest) (*pb.AuthRoleRevokePermissionResponse, error) {
+	if err := s.store.RoleRevokePermission(req.Role, string(req.Key), string(req.RangeEnd)); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.AuthRoleRevokePermissionResponse{Header: s.header(s.store.Revision())}, nil
+}
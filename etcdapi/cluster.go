@@ -0,0 +1,188 @@
+package etcdapi
+
+import (
+	"context"
+	"hash/fnv"
+	"net/url"
+	"strings"
+
+	"github.com/otoolep/hraftd/store"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MemberList implements the etcd v3 MemberList API. Every node of the Raft
+// configuration is a member, with its Raft address as peer URL and its etcd
+// API address as client URL.
+func (s *Service) MemberList(ctx context.Context, req *pb.MemberListRequest) (*pb.MemberListResponse, error) {
+	members, err := s.members()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.MemberListResponse{
+		Header:  s.header(s.store.Revision()),
+		Members: members,
+	}, nil
+}
+
+// MemberAdd implements the etcd v3 MemberAdd API. etcd members are named once
+// they start, but Raft needs an ID up front, so the new member is identified
+// by its Raft address, which is the default node ID of hraftd. The new node
+// must be started with that ID, and join the cluster to register its client
+// URL.
+func (s *Service) MemberAdd(ctx context.Context, req *pb.MemberAddRequest) (*pb.MemberAddResponse, error) {
+	if len(req.PeerURLs) != 1 {
+		return nil, status.Error(codes.InvalidArgument, "exactly one peer URL is required")
+	}
+	addr, err := peerAddr(req.PeerURLs[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.store.AddMember(addr, addr, !req.IsLearner); err != nil {
+		return nil, toGRPCError(err)
+	}
+
+	members, err := s.members()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.MemberAddResponse{
+		Header: s.header(s.store.Revision()),
+		Member: &pb.Member{
+			ID:        memberID(addr),
+			PeerURLs:  req.PeerURLs,
+			IsLearner: req.IsLearner,
+		},
+		Members: members,
+	}, nil
+}
+
+// MemberRemove implements the etcd v3 MemberRemove API.
+func (s *Service) MemberRemove(ctx context.Context, req *pb.MemberRemoveRequest) (*pb.MemberRemoveResponse, error) {
+	id, err := s.memberName(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.RemoveMember(id); err != nil {
+		return nil, toGRPCError(err)
+	}
+
+	members, err := s.members()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.MemberRemoveResponse{
+		Header:  s.header(s.store.Revision()),
+		Members: members,
+	}, nil
+}
+
+// MemberUpdate implements the etcd v3 MemberUpdate API, by moving the member
+// to a new Raft address.
+func (s *Service) MemberUpdate(ctx context.Context, req *pb.MemberUpdateRequest) (*pb.MemberUpdateResponse, error) {
+	if len(req.PeerURLs) != 1 {
+		return nil, status.Error(codes.InvalidArgument, "exactly one peer URL is required")
+	}
+	addr, err := peerAddr(req.PeerURLs[0])
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.memberName(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.UpdateMember(id, addr); err != nil {
+		return nil, toGRPCError(err)
+	}
+
+	members, err := s.members()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.MemberUpdateResponse{
+		Header:  s.header(s.store.Revision()),
+		Members: members,
+	}, nil
+}
+
+// MemberPromote implements the etcd v3 MemberPromote API, turning a
+// non-voting member into a voter.
+func (s *Service) MemberPromote(ctx context.Context, req *pb.MemberPromoteRequest) (*pb.MemberPromoteResponse, error) {
+	id, err := s.memberName(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.PromoteMember(id); err != nil {
+		return nil, toGRPCError(err)
+	}
+
+	members, err := s.members()
+	if err != nil {
+		return nil, err
+	}
+	return &pb.MemberPromoteResponse{
+		Header:  s.header(s.store.Revision()),
+		Members: members,
+	}, nil
+}
+
+// members returns the members of the cluster, in their etcd representation.
+func (s *Service) members() ([]*pb.Member, error) {
+	members, err := s.store.Members()
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+
+	out := make([]*pb.Member, 0, len(members))
+	for _, m := range members {
+		pm := &pb.Member{
+			ID:        memberID(m.ID),
+			Name:      m.ID,
+			PeerURLs:  []string{"http://" + m.Addr},
+			IsLearner: !m.Voter,
+		}
+		if addr := m.Meta[store.MetaEtcdAddr]; addr != "" {
+			pm.ClientURLs = []string{"http://" + addr}
+		}
+		out = append(out, pm)
+	}
+	return out, nil
+}
+
+// memberName returns the Raft server ID of the member with the given etcd ID.
+func (s *Service) memberName(id uint64) (string, error) {
+	members, err := s.store.Members()
+	if err != nil {
+		return "", toGRPCError(err)
+	}
+	for _, m := range members {
+		if memberID(m.ID) == id {
+			return m.ID, nil
+		}
+	}
+	return "", rpctypes.ErrGRPCMemberNotFound
+}
+
+// memberID returns the etcd member ID of the node with the given Raft server
+// ID. etcd member IDs are integers, so the server ID is hashed.
+func memberID(id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return h.Sum64()
+}
+
+// peerAddr returns the Raft address of a peer URL. A bare host:port is
+// accepted as well.
+func peerAddr(peerURL string) (string, error) {
+	if !strings.Contains(peerURL, "://") {
+		return peerURL, nil
+	}
+	u, err := url.Parse(peerURL)
+	if err != nil || u.Host == "" {
+		return "", status.Errorf(codes.InvalidArgument, "invalid peer URL %q", peerURL)
+	}
+	return u.Host, nil
+}
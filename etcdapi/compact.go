@@ -0,0 +1,18 @@
+package etcdapi
+
+import (
+	"context"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// Compact implements the etcd v3 Compact API. The compaction is replicated
+// to every node, and has always been applied on this node by the time the
+// response is sent, so physical compactions need no extra waiting.
+func (s *Service) Compact(ctx context.Context, req *pb.CompactionRequest) (*pb.CompactionResponse, error) {
+	r, err := s.store.Compact(req.Revision)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.CompactionResponse{Header: s.header(r.Revision)}, nil
+}
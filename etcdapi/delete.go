@@ -4,6 +4,7 @@ import (
 	"context"
 
 	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -14,35 +15,22 @@ func (s *Service) DeleteRange(ctx context.Context, req *pb.DeleteRangeRequest) (
 		return nil, status.Error(codes.InvalidArgument, "key is required")
 	}
 
-	// Convert byte slice to string
-	key := string(req.Key)
-
-	// For now, we only support deleting a single key
-	// In a real implementation, we would handle range deletes
-	if len(req.RangeEnd) > 0 {
-		// This is a simplified implementation that doesn't handle range deletes
-		// In a real implementation, we would need to handle all range types
-		return nil, status.Error(codes.Unimplemented, "range delete not implemented")
-	}
-
-	// Delete the key from the store
-	if err := s.store.Delete(key); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	// Delete every key in the range from the store, as a single command
+	r, err := s.store.DeleteRange(req.Key, req.RangeEnd, req.PrevKv)
+	if err != nil {
+		return nil, toGRPCError(err)
 	}
 
 	// Build response
 	resp := &pb.DeleteRangeResponse{
-		Header: &pb.ResponseHeader{
-			// In a real implementation, these would be actual cluster information
-			ClusterId: 1,
-			MemberId:  1,
-			Revision:  1,
-			RaftTerm:  1,
-		},
-		// We always delete at most one key in this implementation
-		Deleted: 1,
-		// In a real etcd implementation, we would return the previous values if prev_kv was set
-		// But our current store implementation doesn't support getting the previous values
+		Header:  s.header(r.Revision),
+		Deleted: r.Deleted,
+	}
+	if req.PrevKv {
+		resp.PrevKvs = make([]*mvccpb.KeyValue, 0, len(r.PrevKVs))
+		for _, kv := range r.PrevKVs {
+			resp.PrevKvs = append(resp.PrevKvs, kv.ToProto())
+		}
 	}
 
 	return resp, nil
@@ -0,0 +1,103 @@
+package etcdapi
+
+import (
+	"errors"
+
+	"github.com/otoolep/hraftd/store"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// toGRPCError converts an error returned by the store to the gRPC error an
+// etcd client expects. Errors without an etcd equivalent are reported as
+// internal errors.
+func toGRPCError(err error) error {
+	var nle *store.NotLeaderError
+	switch {
+	case errors.Is(err, store.ErrCompacted):
+		return rpctypes.ErrGRPCCompacted
+	case errors.Is(err, store.ErrFutureRev):
+		return rpctypes.ErrGRPCFutureRev
+	case errors.Is(err, store.ErrKeyNotFound):
+		return rpctypes.ErrGRPCKeyNotFound
+	case errors.Is(err, store.ErrEmptyKey):
+		return rpctypes.ErrGRPCEmptyKey
+	case errors.Is(err, store.ErrTooManyOps):
+		return rpctypes.ErrGRPCTooManyOps
+	case errors.Is(err, store.ErrDuplicateKey):
+		return rpctypes.ErrGRPCDuplicateKey
+	case errors.Is(err, store.ErrLeaseNotFound):
+		return rpctypes.ErrGRPCLeaseNotFound
+	case errors.Is(err, store.ErrLeaseExists):
+		return rpctypes.ErrGRPCLeaseExist
+	case errors.Is(err, store.ErrLeaseTTLTooLarge):
+		return rpctypes.ErrGRPCLeaseTTLTooLarge
+	case errors.As(err, &nle):
+		return notLeaderError(nle)
+	case errors.Is(err, store.ErrNotLeader):
+		return rpctypes.ErrGRPCNotLeader
+	case errors.Is(err, store.ErrReadTimeout):
+		return rpctypes.ErrGRPCTimeout
+	case errors.Is(err, store.ErrMemberNotFound):
+		return rpctypes.ErrGRPCMemberNotFound
+	case errors.Is(err, store.ErrMemberExists):
+		return rpctypes.ErrGRPCMemberExist
+	case errors.Is(err, store.ErrAddrExists):
+		return rpctypes.ErrGRPCPeerURLExist
+	case errors.Is(err, store.ErrMemberNotLearner):
+		return rpctypes.ErrGRPCMemberNotLearner
+	case errors.Is(err, store.ErrNoSpace):
+		return rpctypes.ErrGRPCNoSpace
+	case errors.Is(err, store.ErrAuthNotEnabled):
+		return rpctypes.ErrGRPCAuthNotEnabled
+	case errors.Is(err, store.ErrAuthFailed):
+		return rpctypes.ErrGRPCAuthFailed
+	case errors.Is(err, store.ErrPermissionDenied):
+		return rpctypes.ErrGRPCPermissionDenied
+	case errors.Is(err, store.ErrRootUserNotExist):
+		return rpctypes.ErrGRPCRootUserNotExist
+	case errors.Is(err, store.ErrRootRoleNotExist):
+		return rpctypes.ErrGRPCRootRoleNotExist
+	case errors.Is(err, store.ErrInvalidAuthMgmt):
+		return rpctypes.ErrGRPCInvalidAuthMgmt
+	case errors.Is(err, store.ErrUserEmpty):
+		return rpctypes.ErrGRPCUserEmpty
+	case errors.Is(err, store.ErrUserAlreadyExist):
+		return rpctypes.ErrGRPCUserAlreadyExist
+	case errors.Is(err, store.ErrUserNotFound):
+		return rpctypes.ErrGRPCUserNotFound
+	case errors.Is(err, store.ErrRoleEmpty):
+		return rpctypes.ErrGRPCRoleEmpty
+	case errors.Is(err, store.ErrRoleAlreadyExist):
+		return rpctypes.ErrGRPCRoleAlreadyExist
+	case errors.Is(err, store.ErrRoleNotFound):
+		return rpctypes.ErrGRPCRoleNotFound
+	case errors.Is(err, store.ErrRoleNotGranted):
+		return rpctypes.ErrGRPCRoleNotGranted
+	case errors.Is(err, store.ErrPermissionNotGranted):
+		return rpctypes.ErrGRPCPermissionNotGranted
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// notLeaderError returns the error of a write made on a follower while
+// forwarding is disabled. The message is the one etcd clients recognize, and
+// the leader is attached as an ErrorInfo detail.
+func notLeaderError(err *store.NotLeaderError) error {
+	st := status.New(codes.Unavailable, rpctypes.ErrGRPCNotLeader.Error())
+	info := &errdetails.ErrorInfo{
+		Reason: "NOT_LEADER",
+		Domain: "hraftd",
+		Metadata: map[string]string{
+			"leader":      err.Leader,
+			"leader_addr": err.Meta[store.MetaEtcdAddr],
+		},
+	}
+	if d, derr := st.WithDetails(info); derr == nil {
+		st = d
+	}
+	return st.Err()
+}
@@ -0,0 +1,233 @@
+package etcdapi
+
+import (
+	"context"
+	"strings"
+
+	"github.com/otoolep/hraftd/store"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// snapshotMethod is the full name of the Snapshot stream, which is
+// restricted to the root role.
+const snapshotMethod = "/etcdserverpb.Maintenance/Snapshot"
+
+// userKey is the context key of the authenticated user of a request.
+type userKey struct{}
+
+// unaryInterceptor authenticates every unary request, and checks the user
+// is permitted to make it, while authentication is enabled.
+func (s *Service) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, store.ForwardService) {
+		// Requests of other nodes were checked by the node which received
+		// them, and are signed with the forwarding key of the cluster.
+		return handler(ctx, req)
+	}
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamInterceptor authenticates every stream. Watchers are checked as they
+// are created, since a stream may create many.
+func (s *Service) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+	if enabled, _ := s.store.AuthStatus(); enabled && info.FullMethod == snapshotMethod {
+		if err := s.checkAdmin(ctx); err != nil {
+			return err
+		}
+	}
+	return handler(srv, &authStream{ServerStream: ss, ctx: ctx})
+}
+
+// authStream is a stream carrying the authenticated user in its context.
+type authStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (a *authStream) Context() context.Context {
+	return a.ctx
+}
+
+// authenticate returns the context with the user of the token sent with the
+// request, if any. Requests without a token are anonymous.
+func (s *Service) authenticate(ctx context.Context) (context.Context, error) {
+	if enabled, _ := s.store.AuthStatus(); !enabled {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	tokens := md.Get(rpctypes.TokenFieldNameGRPC)
+	if len(tokens) == 0 {
+		tokens = md.Get(rpctypes.TokenFieldNameSwagger)
+	}
+	if len(tokens) == 0 {
+		return ctx, nil
+	}
+	user, ok := s.tokens.info(tokens[0])
+	if !ok {
+		return nil, rpctypes.ErrGRPCInvalidAuthToken
+	}
+	return context.WithValue(ctx, userKey{}, user), nil
+}
+
+// authorize checks the user of the context is permitted to make the request.
+// Requests which do not touch keys are open to every user, or restricted to
+// the root role.
+func (s *Service) authorize(ctx context.Context, req interface{}) error {
+	if enabled, _ := s.store.AuthStatus(); !enabled {
+		return nil
+	}
+
+	switch r := req.(type) {
+	case *pb.RangeRequest:
+		return s.checkRange(ctx, r.Key, r.RangeEnd, false)
+	case *pb.PutRequest:
+		return s.checkOp(ctx, &pb.RequestOp{Request: &pb.RequestOp_RequestPut{RequestPut: r}})
+	case *pb.DeleteRangeRequest:
+		return s.checkOp(ctx, &pb.RequestOp{Request: &pb.RequestOp_RequestDeleteRange{RequestDeleteRange: r}})
+	case *pb.TxnRequest:
+		return s.checkTxn(ctx, r)
+
+	case *pb.LeaseRevokeRequest:
+		// Revoking deletes the attached keys.
+		return s.checkLeaseKeys(ctx, r.ID, true)
+	case *pb.LeaseTimeToLiveRequest:
+		if r.Keys {
+			return s.checkLeaseKeys(ctx, r.ID, false)
+		}
+		return nil
+	case *pb.LeaseGrantRequest, *pb.LeaseLeasesRequest:
+		return nil
+
+	case *pb.AuthenticateRequest, *pb.AuthStatusRequest:
+		return nil
+	case *pb.AuthUserGetRequest:
+		return s.checkSelf(ctx, r.Name)
+	case *pb.AuthUserChangePasswordRequest:
+		return s.checkSelf(ctx, r.Name)
+
+	case *pb.StatusRequest, *pb.MemberListRequest:
+		return nil
+	case *pb.AlarmRequest:
+		if r.Action == pb.AlarmRequest_GET {
+			return nil
+		}
+		return s.checkAdmin(ctx)
+
+	default:
+		// Compaction, and the management of users, roles, members and
+		// nodes.
+		return s.checkAdmin(ctx)
+	}
+}
+
+// checkTxn checks the user may read the keys compared by the transaction,
+// and make every operation in either branch.
+func (s *Service) checkTxn(ctx context.Context, txn *pb.TxnRequest) error {
+	for _, c := range txn.Compare {
+		if err := s.checkRange(ctx, c.Key, c.RangeEnd, false); err != nil {
+			return err
+		}
+	}
+	for _, ops := range [][]*pb.RequestOp{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			if err := s.checkOp(ctx, op); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkOp checks the user may make the operation. Returning previous
+// key-values requires reading the keys.
+func (s *Service) checkOp(ctx context.Context, op *pb.RequestOp) error {
+	switch {
+	case op.GetRequestRange() != nil:
+		r := op.GetRequestRange()
+		return s.checkRange(ctx, r.Key, r.RangeEnd, false)
+	case op.GetRequestPut() != nil:
+		r := op.GetRequestPut()
+		if err := s.checkRange(ctx, r.Key, nil, true); err != nil {
+			return err
+		}
+		if r.PrevKv {
+			return s.checkRange(ctx, r.Key, nil, false)
+		}
+	case op.GetRequestDeleteRange() != nil:
+		r := op.GetRequestDeleteRange()
+		if err := s.checkRange(ctx, r.Key, r.RangeEnd, true); err != nil {
+			return err
+		}
+		if r.PrevKv {
+			return s.checkRange(ctx, r.Key, r.RangeEnd, false)
+		}
+	case op.GetRequestTxn() != nil:
+		return s.checkTxn(ctx, op.GetRequestTxn())
+	}
+	return nil
+}
+
+// checkLeaseKeys checks the user may read, or write, every key attached to
+// the lease. A missing lease is left for the handler to report.
+func (s *Service) checkLeaseKeys(ctx context.Context, id int64, write bool) error {
+	info, err := s.store.TimeToLive(id, true)
+	if err != nil {
+		return nil
+	}
+	for _, k := range info.Keys {
+		if err := s.checkRange(ctx, k, nil, write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRange checks the user of the context may read, or write, every key in
+// the range.
+func (s *Service) checkRange(ctx context.Context, key, end []byte, write bool) error {
+	user, _ := ctx.Value(userKey{}).(string)
+	if !s.store.IsPermitted(user, string(key), string(end), write) {
+		return rpctypes.ErrGRPCPermissionDenied
+	}
+	return nil
+}
+
+// checkSelf checks the request concerns the user of the context, or the
+// user has the root role.
+func (s *Service) checkSelf(ctx context.Context, name string) error {
+	if user, _ := ctx.Value(userKey{}).(string); user != "" && user == name {
+		return nil
+	}
+	return s.checkAdmin(ctx)
+}
+
+// checkAdmin checks the user of the context has the root role.
+func (s *Service) checkAdmin(ctx context.Context) error {
+	user, _ := ctx.Value(userKey{}).(string)
+	if !s.store.IsAdmin(user) {
+		return rpctypes.ErrGRPCPermissionDenied
+	}
+	return nil
+}
+
+// watchPermitted returns whether the user of the context may watch the
+// range, while authentication is enabled.
+func (s *Service) watchPermitted(ctx context.Context, req *pb.WatchCreateRequest) bool {
+	if enabled, _ := s.store.AuthStatus(); !enabled {
+		return true
+	}
+	return s.checkRange(ctx, req.Key, req.RangeEnd, false) == nil
+}
@@ -0,0 +1,94 @@
+package etcdapi
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/otoolep/hraftd/store"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// LeaseGrant implements the etcd v3 LeaseGrant API.
+func (s *Service) LeaseGrant(ctx context.Context, req *pb.LeaseGrantRequest) (*pb.LeaseGrantResponse, error) {
+	r, err := s.store.Grant(req.ID, req.TTL)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.LeaseGrantResponse{
+		Header: s.header(r.Revision),
+		ID:     r.ID,
+		TTL:    r.TTL,
+	}, nil
+}
+
+// LeaseRevoke implements the etcd v3 LeaseRevoke API. The keys attached to
+// the lease are deleted.
+func (s *Service) LeaseRevoke(ctx context.Context, req *pb.LeaseRevokeRequest) (*pb.LeaseRevokeResponse, error) {
+	r, err := s.store.Revoke(req.ID)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.LeaseRevokeResponse{Header: s.header(r.Revision)}, nil
+}
+
+// LeaseKeepAlive implements the etcd v3 LeaseKeepAlive API. Every request on
+// the stream renews a lease, and is answered with its TTL, which is zero if
+// the lease does not exist.
+func (s *Service) LeaseKeepAlive(stream pb.Lease_LeaseKeepAliveServer) error {
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		ttl, err := s.store.KeepAlive(req.ID)
+		if err != nil && !errors.Is(err, store.ErrLeaseNotFound) {
+			return toGRPCError(err)
+		}
+		if err := stream.Send(&pb.LeaseKeepAliveResponse{
+			Header: s.header(s.store.Revision()),
+			ID:     req.ID,
+			TTL:    ttl,
+		}); err != nil {
+			return err
+		}
+	}
+}
+
+// LeaseTimeToLive implements the etcd v3 LeaseTimeToLive API. Like etcd, a
+// missing lease is reported with a TTL of -1 rather than an error.
+func (s *Service) LeaseTimeToLive(ctx context.Context, req *pb.LeaseTimeToLiveRequest) (*pb.LeaseTimeToLiveResponse, error) {
+	info, err := s.store.TimeToLive(req.ID, req.Keys)
+	if errors.Is(err, store.ErrLeaseNotFound) {
+		return &pb.LeaseTimeToLiveResponse{
+			Header: s.header(s.store.Revision()),
+			ID:     req.ID,
+			TTL:    -1,
+		}, nil
+	}
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+
+	resp := &pb.LeaseTimeToLiveResponse{
+		Header:     s.header(s.store.Revision()),
+		ID:         info.ID,
+		TTL:        info.TTL,
+		GrantedTTL: info.GrantedTTL,
+		Keys:       info.Keys,
+	}
+	return resp, nil
+}
+
+// LeaseLeases implements the etcd v3 LeaseLeases API.
+func (s *Service) LeaseLeases(ctx context.Context, req *pb.LeaseLeasesRequest) (*pb.LeaseLeasesResponse, error) {
+	resp := &pb.LeaseLeasesResponse{Header: s.header(s.store.Revision())}
+	for _, id := range s.store.Leases() {
+		resp.Leases = append(resp.Leases, &pb.LeaseStatus{ID: id})
+	}
+	return resp, nil
+}
@@ -0,0 +1,188 @@
+package etcdapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/version"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// snapshotChunkSize is the size of the chunks a snapshot is streamed in.
+const snapshotChunkSize = 32 * 1024
+
+// Status implements the etcd v3 Status API, reporting the Raft state of this
+// node.
+func (s *Service) Status(ctx context.Context, req *pb.StatusRequest) (*pb.StatusResponse, error) {
+	st, err := s.store.Status()
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+
+	resp := &pb.StatusResponse{
+		Header:           s.header(s.store.Revision()),
+		Version:          version.Version,
+		DbSize:           st.DBSize,
+		DbSizeInUse:      st.DBSizeInUse,
+		RaftIndex:        st.CommitIndex,
+		RaftTerm:         st.Term,
+		RaftAppliedIndex: st.AppliedIndex,
+		IsLearner:        !st.Voter,
+	}
+	if st.Leader != "" {
+		resp.Leader = memberID(st.Leader)
+	}
+	for _, a := range st.Alarms {
+		resp.Errors = append(resp.Errors, fmt.Sprintf("memberID:%d alarm:%s ", memberID(a.Node), a.Type))
+	}
+	return resp, nil
+}
+
+// HashKV implements the etcd v3 HashKV API.
+func (s *Service) HashKV(ctx context.Context, req *pb.HashKVRequest) (*pb.HashKVResponse, error) {
+	r, err := s.store.HashKV(req.Revision)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.HashKVResponse{
+		Header:          s.header(r.Revision),
+		Hash:            r.Hash,
+		CompactRevision: r.CompactRevision,
+	}, nil
+}
+
+// Hash implements the etcd v3 Hash API, by hashing the keyspace at the
+// current revision.
+func (s *Service) Hash(ctx context.Context, req *pb.HashRequest) (*pb.HashResponse, error) {
+	r, err := s.store.HashKV(0)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.HashResponse{
+		Header: s.header(r.Revision),
+		Hash:   r.Hash,
+	}, nil
+}
+
+// Snapshot implements the etcd v3 Snapshot API, streaming a consistent
+// snapshot of the store. Like etcd, the snapshot is followed by its SHA-256
+// checksum. The snapshot is sent as it is written, without being held in
+// memory, so its size is not known in advance: until the checksum,
+// RemainingBytes only counts the checksum.
+func (s *Service) Snapshot(req *pb.SnapshotRequest, stream pb.Maintenance_SnapshotServer) error {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		_, err := s.store.WriteSnapshot(pw)
+		pw.CloseWithError(err)
+	}()
+
+	// Stop writing the snapshot once the client is gone.
+	ctx := stream.Context()
+	stop := context.AfterFunc(ctx, func() {
+		pr.CloseWithError(ctx.Err())
+	})
+	defer stop()
+
+	header := s.header(s.store.Revision())
+	h := sha256.New()
+	for {
+		chunk := make([]byte, snapshotChunkSize)
+		n, err := io.ReadFull(pr, chunk)
+		if n > 0 {
+			h.Write(chunk[:n])
+			if err := stream.Send(&pb.SnapshotResponse{
+				Header:         header,
+				RemainingBytes: sha256.Size,
+				Blob:           chunk[:n],
+			}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return status.FromContextError(ctx.Err()).Err()
+			}
+			return toGRPCError(err)
+		}
+	}
+	return stream.Send(&pb.SnapshotResponse{
+		Header: header,
+		Blob:   h.Sum(nil),
+	})
+}
+
+// Defragment implements the etcd v3 Defragment API, by taking a Raft
+// snapshot of this node so that its log store is truncated.
+func (s *Service) Defragment(ctx context.Context, req *pb.DefragmentRequest) (*pb.DefragmentResponse, error) {
+	if err := s.store.Defragment(); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.DefragmentResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// Alarm implements the etcd v3 Alarm API. Alarms are replicated, so they
+// can be queried and deactivated on any member.
+func (s *Service) Alarm(ctx context.Context, req *pb.AlarmRequest) (*pb.AlarmResponse, error) {
+	switch req.Action {
+	case pb.AlarmRequest_GET:
+	case pb.AlarmRequest_ACTIVATE, pb.AlarmRequest_DEACTIVATE:
+		if req.Alarm == pb.AlarmType_NONE {
+			return nil, status.Error(codes.InvalidArgument, "alarm type is required")
+		}
+		node, err := s.memberName(req.MemberID)
+		if err != nil {
+			return nil, err
+		}
+		typ := pb.AlarmType_name[int32(req.Alarm)]
+		if req.Action == pb.AlarmRequest_ACTIVATE {
+			err = s.store.ActivateAlarm(node, typ)
+		} else {
+			err = s.store.DeactivateAlarm(node, typ)
+		}
+		if err != nil {
+			return nil, toGRPCError(err)
+		}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown alarm action %v", req.Action)
+	}
+
+	resp := &pb.AlarmResponse{Header: s.header(s.store.Revision())}
+	for _, a := range s.store.Alarms() {
+		typ := pb.AlarmType(pb.AlarmType_value[a.Type])
+		if req.Action == pb.AlarmRequest_GET && req.Alarm != pb.AlarmType_NONE && req.Alarm != typ {
+			continue
+		}
+		resp.Alarms = append(resp.Alarms, &pb.AlarmMember{
+			MemberID: memberID(a.Node),
+			Alarm:    typ,
+		})
+	}
+	return resp, nil
+}
+
+// MoveLeader implements the etcd v3 MoveLeader API, via a Raft leadership
+// transfer. It must be sent to the leader.
+func (s *Service) MoveLeader(ctx context.Context, req *pb.MoveLeaderRequest) (*pb.MoveLeaderResponse, error) {
+	id, err := s.memberName(req.TargetID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.TransferLeadership(id); err != nil {
+		return nil, toGRPCError(err)
+	}
+	return &pb.MoveLeaderResponse{Header: s.header(s.store.Revision())}, nil
+}
+
+// Downgrade implements the etcd v3 Downgrade API. There is only one version
+// of the cluster protocol, so downgrades are not supported.
+func (s *Service) Downgrade(ctx context.Context, req *pb.DowngradeRequest) (*pb.DowngradeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "downgrade is not supported")
+}
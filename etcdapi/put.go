@@ -3,7 +3,9 @@ package etcdapi
 import (
 	"context"
 
+	"github.com/otoolep/hraftd/store"
 	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -13,27 +15,31 @@ func (s *Service) Put(ctx context.Context, req *pb.PutRequest) (*pb.PutResponse,
 	if len(req.Key) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "key is required")
 	}
+	if req.IgnoreValue && len(req.Value) != 0 {
+		return nil, rpctypes.ErrGRPCValueProvided
+	}
+	if req.IgnoreLease && req.Lease != 0 {
+		return nil, rpctypes.ErrGRPCLeaseProvided
+	}
 
-	// Convert byte slices to strings
-	key := string(req.Key)
-	value := string(req.Value)
-
-	// Set the key-value pair in the store
-	if err := s.store.Set(key, value); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	// Set the key-value pair in the store. The previous value, if requested,
+	// is read by the state machine as part of applying the put.
+	r, err := s.store.Put(req.Key, req.Value, store.PutOptions{
+		PrevKV:      req.PrevKv,
+		IgnoreValue: req.IgnoreValue,
+		IgnoreLease: req.IgnoreLease,
+		Lease:       req.Lease,
+	})
+	if err != nil {
+		return nil, toGRPCError(err)
 	}
 
 	// Build response
 	resp := &pb.PutResponse{
-		Header: &pb.ResponseHeader{
-			// In a real implementation, these would be actual cluster information
-			ClusterId: 1,
-			MemberId:  1,
-			Revision:  1,
-			RaftTerm:  1,
-		},
-		// In a real etcd implementation, we would return the previous value if prev_kv was set
-		// But our current store implementation doesn't support atomically getting the previous value
+		Header: s.header(r.Revision),
+	}
+	if r.PrevKV != nil {
+		resp.PrevKv = r.PrevKV.ToProto()
 	}
 
 	return resp, nil
@@ -3,7 +3,6 @@ package etcdapi
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"log"
 	"net"
@@ -12,20 +11,33 @@ import (
 	"strings"
 	"time"
 
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
 	"github.com/otoolep/hraftd/store"
 	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/reflection"
 )
 
 // Service provides etcd v3 API service.
 type Service struct {
+	// AuthToken is the type of the authentication tokens issued, either
+	// TokenSimple or TokenJWT. Simple tokens are issued if empty.
+	AuthToken string
+
+	// AuthTokenTTL is how long an authentication token is valid for.
+	// DefaultTokenTTL is used if zero.
+	AuthTokenTTL time.Duration
+
 	addr       string
 	ln         net.Listener
 	store      *store.Store
 	srv        *grpc.Server
 	httpServer *http.Server
+	tokens     tokenProvider
 }
 
 // New returns an uninitialized etcd API service.
@@ -38,12 +50,39 @@ func New(addr string, store *store.Store) *Service {
 
 // Start starts the service.
 func (s *Service) Start() error {
-	// 创建一个 gRPC 服务器
-	s.srv = grpc.NewServer()
+	tokens, err := newTokenProvider(s.AuthToken, s.AuthTokenTTL, s.store)
+	if err != nil {
+		return err
+	}
+	s.tokens = tokens
+
+	// 创建一个 gRPC 服务器，启用认证后由拦截器检查权限
+	s.srv = grpc.NewServer(
+		grpc.UnaryInterceptor(s.unaryInterceptor),
+		grpc.StreamInterceptor(s.streamInterceptor),
+	)
 
 	// 注册 KV 服务
 	pb.RegisterKVServer(s.srv, s)
 
+	// 注册 Watch 服务
+	pb.RegisterWatchServer(s.srv, s)
+
+	// 注册 Lease 服务
+	pb.RegisterLeaseServer(s.srv, s)
+
+	// 注册 Cluster 服务
+	pb.RegisterClusterServer(s.srv, s)
+
+	// 注册 Maintenance 服务
+	pb.RegisterMaintenanceServer(s.srv, s)
+
+	// 注册 Auth 服务
+	pb.RegisterAuthServer(s.srv, s)
+
+	// 注册内部服务，接收其他节点转发给 leader 的写请求
+	s.store.RegisterForwardServer(s.srv)
+
 	// 启用 gRPC 反射服务，这对于调试和一些客户端很有用
 	reflection.Register(s.srv)
 
@@ -118,7 +157,7 @@ func (s *Service) Start() error {
 			}
 
 			// 使用带超时的上下文
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			ctx, cancel := context.WithTimeout(withToken(r), 5*time.Second)
 			defer cancel()
 
 			resp, err := client.Put(ctx, &req)
@@ -138,7 +177,7 @@ func (s *Service) Start() error {
 			}
 
 			// 使用带超时的上下文
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			ctx, cancel := context.WithTimeout(withToken(r), 5*time.Second)
 			defer cancel()
 
 			resp, err := client.Range(ctx, &req)
@@ -158,7 +197,7 @@ func (s *Service) Start() error {
 			}
 
 			// 使用带超时的上下文
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			ctx, cancel := context.WithTimeout(withToken(r), 5*time.Second)
 			defer cancel()
 
 			resp, err := client.DeleteRange(ctx, &req)
@@ -169,6 +208,25 @@ func (s *Service) Start() error {
 
 			encodeJSONResponse(w, resp)
 
+		case r.URL.Path == "/v3/auth/authenticate" && r.Method == "POST":
+			// 处理认证请求，返回的令牌通过 Authorization 头传递
+			var req pb.AuthenticateRequest
+			if err := decodeJSONRequest(r, &req); err != nil {
+				http.Error(w, "无法解析请求: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			resp, err := pb.NewAuthClient(conn).Authenticate(ctx, &req)
+			if err != nil {
+				http.Error(w, "Authenticate 操作失败: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			encodeJSONResponse(w, resp)
+
 		default:
 			// 对于其他请求，返回 404
 			http.NotFound(w, r)
@@ -195,16 +253,28 @@ func (s *Service) Start() error {
 	return nil
 }
 
-// 从 HTTP 请求中解析 JSON
-func decodeJSONRequest(r *http.Request, v interface{}) error {
+// 从 HTTP 请求中解析 JSON。与 grpc-gateway 一致，bytes 类型的字段（如 key、
+// value）使用 base64 编码，因此可以存取任意二进制数据
+func decodeJSONRequest(r *http.Request, m proto.Message) error {
 	defer r.Body.Close()
-	return json.NewDecoder(r.Body).Decode(v)
+	u := jsonpb.Unmarshaler{AllowUnknownFields: true}
+	return u.Unmarshal(r.Body, m)
+}
+
+// 将 HTTP 请求的 Authorization 头作为认证令牌转发给 gRPC 服务器
+func withToken(r *http.Request) context.Context {
+	ctx := context.Background()
+	if token := r.Header.Get("Authorization"); token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, rpctypes.TokenFieldNameGRPC, token)
+	}
+	return ctx
 }
 
-// 将响应编码为 JSON 并写入 HTTP 响应
-func encodeJSONResponse(w http.ResponseWriter, v interface{}) {
+// 将响应编码为 JSON 并写入 HTTP 响应，bytes 类型的字段使用 base64 编码
+func encodeJSONResponse(w http.ResponseWriter, m proto.Message) {
 	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(v); err != nil {
+	mr := jsonpb.Marshaler{OrigName: true}
+	if err := mr.Marshal(w, m); err != nil {
 		http.Error(w, "无法编码响应: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -217,7 +287,17 @@ func (s *Service) Close() {
 	defer cancel()
 
 	if s.srv != nil {
-		s.srv.GracefulStop()
+		// Watch 流可能长期不结束，超时后强制关闭
+		stopped := make(chan struct{})
+		go func() {
+			s.srv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.srv.Stop()
+		}
 	}
 	if s.ln != nil {
 		s.ln.Close()
@@ -227,6 +307,17 @@ func (s *Service) Close() {
 	}
 }
 
+// header returns a response header carrying the given store revision.
+func (s *Service) header(rev int64) *pb.ResponseHeader {
+	return &pb.ResponseHeader{
+		// The cluster has no ID of its own, so a fixed ID is reported.
+		ClusterId: 1,
+		MemberId:  memberID(s.store.ID()),
+		Revision:  rev,
+		RaftTerm:  s.store.Term(),
+	}
+}
+
 // Addr returns the address on which the Service is listening
 func (s *Service) Addr() net.Addr {
 	return s.ln.Addr()
@@ -0,0 +1,338 @@
+package etcdapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/otoolep/hraftd/store"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// freeAddr 返回一个空闲的本地地址，加 10000 后的 HTTP 网关端口也空闲
+func freeAddr(t *testing.T) string {
+	for i := 0; i < 100; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("监听失败: %v", err)
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+		if port+10000 > 65535 {
+			continue
+		}
+		gw, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port+10000))
+		if err != nil {
+			continue
+		}
+		gw.Close()
+		return fmt.Sprintf("127.0.0.1:%d", port)
+	}
+	t.Fatalf("找不到空闲端口")
+	return ""
+}
+
+// newTestNode 启动一个节点及其 etcd API 服务。leader 为 nil 时节点自举为单节点
+// 集群的 leader，否则加入 leader 所在的集群
+func newTestNode(t *testing.T, id string, leader *store.Store) (*store.Store, *Service) {
+	tmpDir, err := os.MkdirTemp("", "etcdapi_test")
+	if err != nil {
+		t.Fatalf("创建临时目录失败: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("监听失败: %v", err)
+	}
+	raftAddr := ln.Addr().String()
+	ln.Close()
+
+	addr := freeAddr(t)
+	s := store.New(true)
+	s.RaftDir = tmpDir
+	s.RaftBind = raftAddr
+	s.ForwardWrites = true
+	s.NodeMeta = map[string]string{store.MetaEtcdAddr: addr}
+	if err := s.Open(leader == nil, id, nil); err != nil {
+		t.Fatalf("打开存储失败: %v", err)
+	}
+	e := New(addr, s)
+	if err := e.Start(); err != nil {
+		t.Fatalf("启动 etcd API 服务失败: %v", err)
+	}
+	t.Cleanup(func() {
+		e.Close()
+		s.Close()
+		os.RemoveAll(tmpDir)
+	})
+
+	if leader == nil {
+		waitFor(t, "节点成为 leader", s.IsLeader)
+	} else if err := leader.Join(id, raftAddr, s.NodeMeta); err != nil {
+		t.Fatalf("加入集群失败: %v", err)
+	}
+	return s, e
+}
+
+// newTestCluster 启动一个 leader 和一个 follower，并等待 follower 获得 leader
+// 的地址和集群转发密钥（能从 leader 线性一致地读取），以及 leader 开始跟踪租约
+// 的到期时间
+func newTestCluster(t *testing.T) (leader, follower *Service) {
+	s0, e0 := newTestNode(t, "node0", nil)
+	s1, e1 := newTestNode(t, "node1", s0)
+	waitFor(t, "follower 获得 leader 的元数据和转发密钥", func() bool {
+		return s1.Meta("node0")[store.MetaEtcdAddr] != "" && s1.LinearizableRead() == nil
+	})
+	waitFor(t, "leader 跟踪租约", func() bool {
+		_, err := s0.KeepAlive(0)
+		return errors.Is(err, store.ErrLeaseNotFound)
+	})
+	return e0, e1
+}
+
+// newTestClient 返回连接到 etcd API 服务的客户端
+func newTestClient(t *testing.T, e *Service) *clientv3.Client {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{e.Addr().String()},
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("创建 etcd 客户端失败: %v", err)
+	}
+	t.Cleanup(func() { cli.Close() })
+	return cli
+}
+
+// waitFor 等待 cond 成立，超时则测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待超时: %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestFollowerLinearizableRead 测试 follower 上的线性一致读：follower 从 leader
+// 获取读索引，等本地应用到该索引后再读，因此总能读到之前在 leader 上完成的写入
+func TestFollowerLinearizableRead(t *testing.T) {
+	leader, follower := newTestCluster(t)
+	lc := newTestClient(t, leader)
+	fc := newTestClient(t, follower)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for i := 0; i < 50; i++ {
+		value := fmt.Sprintf("v%d", i)
+		if _, err := lc.Put(ctx, "foo", value); err != nil {
+			t.Fatalf("Put 操作失败: %v", err)
+		}
+		resp, err := fc.Get(ctx, "foo")
+		if err != nil {
+			t.Fatalf("follower 上的线性一致读失败: %v", err)
+		}
+		if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != value {
+			t.Fatalf("follower 读到过期的值: %v，期望 %s", resp.Kvs, value)
+		}
+	}
+
+	// 串行化读直接读取 follower 的本地状态
+	if _, err := fc.Get(ctx, "foo", clientv3.WithSerializable()); err != nil {
+		t.Fatalf("follower 上的串行化读失败: %v", err)
+	}
+}
+
+// TestFollowerLease 测试通过 follower 续约和查询租约：只有 leader 跟踪租约的
+// 到期时间，follower 把请求转发给 leader
+func TestFollowerLease(t *testing.T) {
+	_, follower := newTestCluster(t)
+	fc := newTestClient(t, follower)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	grant, err := fc.Grant(ctx, 60)
+	if err != nil {
+		t.Fatalf("Grant 操作失败: %v", err)
+	}
+	if _, err := fc.Put(ctx, "leased", "v", clientv3.WithLease(grant.ID)); err != nil {
+		t.Fatalf("Put 操作失败: %v", err)
+	}
+
+	ka, err := fc.KeepAliveOnce(ctx, grant.ID)
+	if err != nil || ka.TTL != 60 {
+		t.Fatalf("KeepAliveOnce 失败: %v %v", ka, err)
+	}
+	ttl, err := fc.TimeToLive(ctx, grant.ID, clientv3.WithAttachedKeys())
+	if err != nil {
+		t.Fatalf("TimeToLive 操作失败: %v", err)
+	}
+	if ttl.GrantedTTL != 60 || ttl.TTL <= 0 || ttl.TTL > 60 || len(ttl.Keys) != 1 || string(ttl.Keys[0]) != "leased" {
+		t.Fatalf("TimeToLive 结果错误: %+v", ttl)
+	}
+
+	// 不存在的租约：续约返回 TTL 0，查询返回 TTL -1
+	if ka, err := fc.KeepAliveOnce(ctx, grant.ID+1); err == nil && ka.TTL > 0 {
+		t.Fatalf("续约不存在的租约成功: %v", ka)
+	}
+	if ttl, err := fc.TimeToLive(ctx, grant.ID+1); err != nil || ttl.TTL != -1 {
+		t.Fatalf("查询不存在的租约结果错误: %+v %v", ttl, err)
+	}
+
+	// 通过 follower 的续约流保持租约
+	ch, err := fc.KeepAlive(ctx, grant.ID)
+	if err != nil {
+		t.Fatalf("KeepAlive 失败: %v", err)
+	}
+	select {
+	case resp := <-ch:
+		if resp == nil || resp.TTL != 60 {
+			t.Fatalf("KeepAlive 响应错误: %v", resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("KeepAlive 没有响应")
+	}
+}
+
+// TestSnapshotStream 测试快照边写边发送：分块发送快照，最后一条消息是整个快照的
+// SHA-256 校验和；客户端取消后流随之结束
+func TestSnapshotStream(t *testing.T) {
+	_, e := newTestNode(t, "node0", nil)
+	cli := newTestClient(t, e)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	value := strings.Repeat("v", 1024)
+	for i := 0; i < 200; i++ {
+		if _, err := cli.Put(ctx, fmt.Sprintf("key%03d", i), value); err != nil {
+			t.Fatalf("Put 操作失败: %v", err)
+		}
+	}
+
+	mc := pb.NewMaintenanceClient(cli.ActiveConnection())
+	stream, err := mc.Snapshot(ctx, &pb.SnapshotRequest{})
+	if err != nil {
+		t.Fatalf("Snapshot 操作失败: %v", err)
+	}
+	var msgs []*pb.SnapshotResponse
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("接收快照失败: %v", err)
+		}
+		msgs = append(msgs, resp)
+	}
+	if len(msgs) < 3 {
+		t.Fatalf("快照没有分块发送: %d 条消息", len(msgs))
+	}
+	h := sha256.New()
+	for _, m := range msgs[:len(msgs)-1] {
+		if len(m.Blob) > snapshotChunkSize || m.RemainingBytes != sha256.Size {
+			t.Fatalf("快照块错误: %d 字节，剩余 %d 字节", len(m.Blob), m.RemainingBytes)
+		}
+		h.Write(m.Blob)
+	}
+	last := msgs[len(msgs)-1]
+	if !bytes.Equal(last.Blob, h.Sum(nil)) || last.RemainingBytes != 0 {
+		t.Fatalf("最后一条消息不是快照的校验和")
+	}
+
+	// 取消后流以 Canceled 结束
+	cctx, ccancel := context.WithCancel(ctx)
+	stream, err = mc.Snapshot(cctx, &pb.SnapshotRequest{})
+	if err != nil {
+		t.Fatalf("Snapshot 操作失败: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("接收快照失败: %v", err)
+	}
+	ccancel()
+	for {
+		_, err := stream.Recv()
+		if err == nil {
+			continue
+		}
+		if status.Code(err) != codes.Canceled {
+			t.Fatalf("取消后期望 Canceled，得到 %v", err)
+		}
+		break
+	}
+}
+
+// TestGatewayBinaryKeys 测试 HTTP 网关存取非 UTF-8 的键和值：与 grpc-gateway
+// 一致，bytes 类型的字段在 JSON 中使用 base64 编码，存储中保存原始字节
+func TestGatewayBinaryKeys(t *testing.T) {
+	_, e := newTestNode(t, "node0", nil)
+	cli := newTestClient(t, e)
+
+	addr := e.Addr().(*net.TCPAddr)
+	gateway := fmt.Sprintf("http://127.0.0.1:%d", addr.Port+10000)
+	post := func(path string, body interface{}, out interface{}) {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("编码请求失败: %v", err)
+		}
+		resp, err := http.Post(gateway+path, "application/json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("请求 %s 失败: %v", path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(resp.Body)
+			t.Fatalf("请求 %s 返回 %d: %s", path, resp.StatusCode, msg)
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("解析 %s 的响应失败: %v", path, err)
+		}
+	}
+	waitFor(t, "HTTP 网关开始监听", func() bool {
+		conn, err := net.Dial("tcp", gateway[len("http://"):])
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+
+	// encoding/json 把 []byte 编解码为 base64
+	key, value := []byte("k\xff\x00\xfe"), []byte("\x00\x80v\xff")
+	var put struct{}
+	post("/v3/kv/put", map[string][]byte{"key": key, "value": value}, &put)
+
+	var rng struct {
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	post("/v3/kv/range", map[string][]byte{"key": key}, &rng)
+	if len(rng.Kvs) != 1 || !bytes.Equal(rng.Kvs[0].Key, key) || !bytes.Equal(rng.Kvs[0].Value, value) {
+		t.Fatalf("网关读到错误的键值: %+v", rng.Kvs)
+	}
+
+	// gRPC 客户端读到相同的原始字节
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := cli.Get(ctx, string(key))
+	if err != nil {
+		t.Fatalf("Get 操作失败: %v", err)
+	}
+	if len(resp.Kvs) != 1 || !bytes.Equal(resp.Kvs[0].Value, value) {
+		t.Fatalf("gRPC 读到错误的值: %v", resp.Kvs)
+	}
+}
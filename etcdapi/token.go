@@ -0,0 +1,171 @@
+package etcdapi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/otoolep/hraftd/store"
+)
+
+// Token types, selecting how authentication tokens are issued.
+const (
+	// TokenSimple tokens are random strings, only valid on the node which
+	// issued them. Clients authenticate again after switching nodes.
+	TokenSimple = "simple"
+
+	// TokenJWT tokens are JSON Web Tokens signed with a key shared by the
+	// cluster, so they are valid on every node.
+	TokenJWT = "jwt"
+)
+
+// DefaultTokenTTL is how long a token is valid for, by default. Simple tokens
+// are extended every time they are used.
+const DefaultTokenTTL = 5 * time.Minute
+
+// tokenProvider issues authentication tokens, and resolves them to users.
+type tokenProvider interface {
+	// assign issues a token for the user, at the given revision of the
+	// authentication state.
+	assign(user string, rev int64) (string, error)
+
+	// info returns the user of the token, if the token is valid.
+	info(token string) (string, bool)
+}
+
+// newTokenProvider returns the token provider of the given type.
+func newTokenProvider(typ string, ttl time.Duration, st *store.Store) (tokenProvider, error) {
+	if ttl <= 0 {
+		ttl = DefaultTokenTTL
+	}
+	switch typ {
+	case "", TokenSimple:
+		return &simpleTokens{ttl: ttl, tokens: make(map[string]simpleToken)}, nil
+	case TokenJWT:
+		return &jwtTokens{ttl: ttl, store: st}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth token type %q", typ)
+	}
+}
+
+// simpleTokens issues random tokens, held in memory.
+type simpleTokens struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	tokens map[string]simpleToken
+}
+
+type simpleToken struct {
+	user    string
+	expires time.Time
+}
+
+func (t *simpleTokens) assign(user string, rev int64) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := fmt.Sprintf("%s.%d", hex.EncodeToString(b), rev)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for k, v := range t.tokens {
+		if now.After(v.expires) {
+			delete(t.tokens, k)
+		}
+	}
+	t.tokens[token] = simpleToken{user: user, expires: now.Add(t.ttl)}
+	return token, nil
+}
+
+func (t *simpleTokens) info(token string) (string, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.tokens[token]
+	if !ok {
+		return "", false
+	}
+	now := time.Now()
+	if now.After(v.expires) {
+		delete(t.tokens, token)
+		return "", false
+	}
+	v.expires = now.Add(t.ttl)
+	t.tokens[token] = v
+	return v.user, true
+}
+
+// jwtTokens issues JSON Web Tokens signed with HMAC-SHA256, using the
+// signing key replicated by the store.
+type jwtTokens struct {
+	ttl   time.Duration
+	store *store.Store
+}
+
+// jwtHeader is the encoded header of every token.
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+type jwtClaims struct {
+	Username string `json:"username"`
+	Revision int64  `json:"revision"`
+	Expiry   int64  `json:"exp"`
+}
+
+func (t *jwtTokens) assign(user string, rev int64) (string, error) {
+	key := t.store.SigningKey()
+	if key == nil {
+		return "", errors.New("no signing key")
+	}
+	b, err := json.Marshal(jwtClaims{
+		Username: user,
+		Revision: rev,
+		Expiry:   time.Now().Add(t.ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	payload := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + jwtSign(key, payload), nil
+}
+
+func (t *jwtTokens) info(token string) (string, bool) {
+	key := t.store.SigningKey()
+	i := strings.LastIndexByte(token, '.')
+	if key == nil || i < 0 {
+		return "", false
+	}
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(jwtSign(key, payload))) {
+		return "", false
+	}
+	header, claims, ok := strings.Cut(payload, ".")
+	if !ok || header != jwtHeader {
+		return "", false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(claims)
+	if err != nil {
+		return "", false
+	}
+	var c jwtClaims
+	if err := json.Unmarshal(b, &c); err != nil || time.Now().Unix() >= c.Expiry {
+		return "", false
+	}
+	return c.Username, true
+}
+
+// jwtSign returns the encoded signature of the payload.
+func jwtSign(key []byte, payload string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,36 @@
+package etcdapi
+
+import (
+	"context"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// Txn implements the etcd v3 Txn API. The compares and the chosen branch are
+// evaluated and applied atomically by the store, as a single Raft command.
+func (s *Service) Txn(ctx context.Context, req *pb.TxnRequest) (*pb.TxnResponse, error) {
+	resp, err := s.store.Txn(req)
+	if err != nil {
+		return nil, toGRPCError(err)
+	}
+	s.setTxnHeaders(resp)
+	return resp, nil
+}
+
+// setTxnHeaders replaces the headers of the response, and of every nested
+// response, with full response headers carrying the same revision.
+func (s *Service) setTxnHeaders(resp *pb.TxnResponse) {
+	resp.Header = s.header(resp.Header.Revision)
+	for _, r := range resp.Responses {
+		switch v := r.Response.(type) {
+		case *pb.ResponseOp_ResponseRange:
+			v.ResponseRange.Header = s.header(v.ResponseRange.Header.Revision)
+		case *pb.ResponseOp_ResponsePut:
+			v.ResponsePut.Header = s.header(v.ResponsePut.Header.Revision)
+		case *pb.ResponseOp_ResponseDeleteRange:
+			v.ResponseDeleteRange.Header = s.header(v.ResponseDeleteRange.Header.Revision)
+		case *pb.ResponseOp_ResponseTxn:
+			s.setTxnHeaders(v.ResponseTxn)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package etcdapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/otoolep/hraftd/store"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+const (
+	// autoWatchID is the watch ID requesting the server to assign one.
+	autoWatchID int64 = 0
+
+	// invalidWatchID is the watch ID of responses which concern every
+	// watcher of a stream.
+	invalidWatchID int64 = -1
+
+	// maxWatchResponseBytes is the size above which the events of a watcher
+	// created with fragmentation are split over several responses.
+	maxWatchResponseBytes = 1536 * 1024
+)
+
+// progressNotifyInterval is how often a watcher created with progress
+// notifications reports its revision, when it has sent no events.
+var progressNotifyInterval = 10 * time.Minute
+
+// Watch implements the etcd v3 Watch API. Any number of watchers can be
+// created and canceled over a single stream, and each watcher is fed by the
+// store in revision order.
+func (s *Service) Watch(stream pb.Watch_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	ws := &watchStream{
+		s:        s,
+		ctx:      ctx,
+		sendc:    make(chan *pb.WatchResponse, 16),
+		watchers: make(map[int64]*streamWatcher),
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- ws.recvLoop(stream)
+	}()
+
+	for {
+		select {
+		case resp := <-ws.sendc:
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		case err := <-errc:
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// watchStream holds the watchers of a single Watch stream. Responses of all
+// watchers are sent by the goroutine serving the stream.
+type watchStream struct {
+	s     *Service
+	ctx   context.Context
+	sendc chan *pb.WatchResponse
+
+	mu       sync.Mutex
+	nextID   int64
+	watchers map[int64]*streamWatcher
+}
+
+// streamWatcher is a watcher created over a Watch stream.
+type streamWatcher struct {
+	id        int64
+	w         *store.Watcher
+	req       *pb.WatchCreateRequest
+	progressc chan struct{}
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// recvLoop handles the requests received on the stream, until the stream
+// is closed.
+func (ws *watchStream) recvLoop(stream pb.Watch_WatchServer) error {
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch {
+		case req.GetCreateRequest() != nil:
+			ws.create(req.GetCreateRequest())
+		case req.GetCancelRequest() != nil:
+			ws.cancel(req.GetCancelRequest().WatchId)
+		case req.GetProgressRequest() != nil:
+			ws.requestProgress()
+		}
+	}
+}
+
+// send queues a response to be sent on the stream. It returns false if the
+// stream is closed.
+func (ws *watchStream) send(resp *pb.WatchResponse) bool {
+	select {
+	case ws.sendc <- resp:
+		return true
+	case <-ws.ctx.Done():
+		return false
+	}
+}
+
+// create creates a watcher, and starts feeding it to the stream.
+func (ws *watchStream) create(req *pb.WatchCreateRequest) {
+	ws.mu.Lock()
+	id := req.WatchId
+	if id == autoWatchID {
+		for ws.watchers[ws.nextID] != nil {
+			ws.nextID++
+		}
+		id = ws.nextID
+		ws.nextID++
+	} else if ws.watchers[id] != nil {
+		ws.mu.Unlock()
+		ws.send(&pb.WatchResponse{
+			Header:       ws.s.header(ws.s.store.Revision()),
+			WatchId:      id,
+			Created:      true,
+			Canceled:     true,
+			CancelReason: "mvcc: duplicate watch ID provided on the WatchStream",
+		})
+		return
+	}
+
+	if !ws.s.watchPermitted(ws.ctx, req) {
+		ws.mu.Unlock()
+		ws.send(&pb.WatchResponse{
+			Header:       ws.s.header(ws.s.store.Revision()),
+			WatchId:      id,
+			Created:      true,
+			Canceled:     true,
+			CancelReason: rpctypes.ErrGRPCPermissionDenied.Error(),
+		})
+		return
+	}
+
+	w, err := ws.s.store.Watch(req.Key, req.RangeEnd, req.StartRevision)
+	if err != nil {
+		ws.mu.Unlock()
+		// Like etcd, the watcher is created, then canceled at once with the
+		// compaction revision, so that the client can restart from there.
+		ws.send(&pb.WatchResponse{
+			Header:  ws.s.header(ws.s.store.Revision()),
+			WatchId: id,
+			Created: true,
+		})
+		ws.send(&pb.WatchResponse{
+			Header:          ws.s.header(ws.s.store.Revision()),
+			WatchId:         id,
+			Canceled:        true,
+			CompactRevision: ws.s.store.CompactRevision(),
+		})
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ws.ctx)
+	sw := &streamWatcher{
+		id:        id,
+		w:         w,
+		req:       req,
+		progressc: make(chan struct{}, 1),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	ws.watchers[id] = sw
+	ws.mu.Unlock()
+
+	// The created response must precede any event of the watcher.
+	ws.send(&pb.WatchResponse{
+		Header:  ws.s.header(ws.s.store.Revision()),
+		WatchId: id,
+		Created: true,
+	})
+	go ws.run(ctx, sw)
+}
+
+// cancel stops the watcher with the given ID, if it exists.
+func (ws *watchStream) cancel(id int64) {
+	ws.mu.Lock()
+	sw := ws.watchers[id]
+	delete(ws.watchers, id)
+	ws.mu.Unlock()
+	if sw == nil {
+		return
+	}
+
+	// Wait for the watcher to stop, so that no event follows the response.
+	sw.cancel()
+	<-sw.done
+	ws.send(&pb.WatchResponse{
+		Header:   ws.s.header(ws.s.store.Revision()),
+		WatchId:  id,
+		Canceled: true,
+	})
+}
+
+// requestProgress makes every watcher of the stream report its revision.
+func (ws *watchStream) requestProgress() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if len(ws.watchers) == 0 {
+		ws.send(&pb.WatchResponse{
+			Header:  ws.s.header(ws.s.store.Revision()),
+			WatchId: invalidWatchID,
+		})
+		return
+	}
+	for _, sw := range ws.watchers {
+		select {
+		case sw.progressc <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run sends the events of the watcher to the stream, until the watcher is
+// canceled or compacted, or the stream is closed.
+func (ws *watchStream) run(ctx context.Context, sw *streamWatcher) {
+	defer close(sw.done)
+	defer sw.w.Close()
+
+	var tickc <-chan time.Time
+	if sw.req.ProgressNotify {
+		ticker := time.NewTicker(progressNotifyInterval)
+		defer ticker.Stop()
+		tickc = ticker.C
+	}
+
+	sent := false
+	for {
+		var progress bool
+		select {
+		case <-ctx.Done():
+			return
+		case <-sw.w.Ready():
+		case <-sw.progressc:
+			progress = true
+		case <-tickc:
+			progress = !sent
+			sent = false
+		}
+
+		n, ok := ws.flush(sw, progress)
+		if !ok {
+			return
+		}
+		sent = sent || n > 0
+	}
+}
+
+// flush sends the pending events of the watcher, and returns the number of
+// events sent. If there are none and progress is set, a progress
+// notification is sent instead. It returns false if the watcher must stop.
+func (ws *watchStream) flush(sw *streamWatcher, progress bool) (int, bool) {
+	evs, rev, err := sw.w.Next()
+	if err != nil {
+		ws.mu.Lock()
+		delete(ws.watchers, sw.id)
+		ws.mu.Unlock()
+		ws.send(&pb.WatchResponse{
+			Header:          ws.s.header(ws.s.store.Revision()),
+			WatchId:         sw.id,
+			Canceled:        true,
+			CompactRevision: ws.s.store.CompactRevision(),
+		})
+		return 0, false
+	}
+
+	events := toWatchEvents(evs, sw.req)
+	if len(events) == 0 {
+		if !progress {
+			return 0, true
+		}
+		return 0, ws.send(&pb.WatchResponse{
+			Header:  ws.s.header(rev),
+			WatchId: sw.id,
+		})
+	}
+
+	for _, resp := range fragment(events, sw.req.Fragment) {
+		resp.Header = ws.s.header(rev)
+		resp.WatchId = sw.id
+		if !ws.send(resp) {
+			return 0, false
+		}
+	}
+	return len(events), true
+}
+
+// toWatchEvents converts store events to etcd events, applying the filters
+// and previous key-value option of the watch request.
+func toWatchEvents(evs []store.Event, req *pb.WatchCreateRequest) []*mvccpb.Event {
+	var noPut, noDelete bool
+	for _, f := range req.Filters {
+		switch f {
+		case pb.WatchCreateRequest_NOPUT:
+			noPut = true
+		case pb.WatchCreateRequest_NODELETE:
+			noDelete = true
+		}
+	}
+
+	events := make([]*mvccpb.Event, 0, len(evs))
+	for _, ev := range evs {
+		e := &mvccpb.Event{Kv: ev.KV.ToProto()}
+		switch ev.Type {
+		case store.EventPut:
+			if noPut {
+				continue
+			}
+			e.Type = mvccpb.PUT
+		case store.EventDelete:
+			if noDelete {
+				continue
+			}
+			e.Type = mvccpb.DELETE
+			e.Kv.Value = nil
+		}
+		if req.PrevKv && ev.PrevKV != nil {
+			e.PrevKv = ev.PrevKV.ToProto()
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+// fragment returns the responses carrying the events. Unless split is set,
+// all events are carried by a single response. Otherwise responses are kept
+// under maxWatchResponseBytes where possible, and every response but the last
+// is marked as a fragment.
+func fragment(events []*mvccpb.Event, split bool) []*pb.WatchResponse {
+	if !split {
+		return []*pb.WatchResponse{{Events: events}}
+	}
+
+	var resps []*pb.WatchResponse
+	cur := &pb.WatchResponse{}
+	size := 0
+	for _, e := range events {
+		if n := e.Size(); size+n > maxWatchResponseBytes && len(cur.Events) > 0 {
+			cur.Fragment = true
+			resps = append(resps, cur)
+			cur = &pb.WatchResponse{}
+			size = 0
+		}
+		cur.Events = append(cur.Events, e)
+		size += e.Size()
+	}
+	return append(resps, cur)
+}
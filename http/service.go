@@ -4,35 +4,78 @@ package httpd
 
 import (
 	"encoding/json"
+	"errors"
+	"expvar"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+
+	"github.com/otoolep/hraftd/store"
 )
 
 // Store is the interface Raft-backed key-value stores must implement.
 type Store interface {
 	// Get returns the value for the given key, with optional decoding
-	Get(key string, decode bool) (string, error)
+	Get(key []byte, decode bool) ([]byte, error)
 
 	// Set sets the value for the given key, via distributed consensus.
-	Set(key, value string) error
+	Set(key, value []byte) error
 
 	// Delete removes the given key, via distributed consensus.
-	Delete(key string) error
+	Delete(key []byte) error
 
 	// Join joins the node, identitifed by nodeID and reachable at addr, to the cluster.
-	Join(nodeID string, addr string) error
+	// The metadata of the node, if any, is recorded by the cluster.
+	Join(nodeID string, addr string, meta map[string]string) error
 
 	// Count returns the number of key-value pairs in the store.
 	Count() int
 
 	// ListN returns the first n key-value pairs from the store.
 	ListN(n int, decode bool) map[string]string
+
+	// LinearizableRead waits until the local state reflects every write
+	// committed before the call. Followers obtain a read index from the
+	// leader, and fail if the leader is not known.
+	LinearizableRead() error
+
+	// IsLeader returns whether this node is the leader.
+	IsLeader() bool
+
+	// LeaderHTTPAddr returns the HTTP address of the leader, or an empty
+	// string if it is not known.
+	LeaderHTTPAddr() string
 }
 
+// Read consistency levels, selected with the level query parameter of reads.
+const (
+	// levelNone reads the local state of the node, which may be stale. This
+	// is the default.
+	levelNone = "none"
+
+	// levelWeak reads the local state of the leader, without confirming its
+	// leadership first. A deposed leader may serve stale reads until it
+	// notices it lost leadership.
+	levelWeak = "weak"
+
+	// levelStrong reads reflect every write committed before the read.
+	levelStrong = "strong"
+
+	// levelSerializable and levelLinearizable are the etcd names of
+	// levelNone and levelStrong.
+	levelSerializable = "serializable"
+	levelLinearizable = "linearizable"
+)
+
+// contentTypeRaw is the content type of raw values. Values are otherwise
+// read and written as JSON strings, which cannot hold arbitrary bytes.
+const contentTypeRaw = "application/octet-stream"
+
 // Service provides HTTP service.
 type Service struct {
 	addr string
@@ -89,6 +132,8 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		s.handleCount(w, r)
 	} else if r.URL.Path == "/list" {
 		s.handleList(w, r)
+	} else if r.URL.Path == "/debug/vars" {
+		expvar.Handler().ServeHTTP(w, r)
 	} else {
 		w.WriteHeader(http.StatusNotFound)
 	}
@@ -101,11 +146,6 @@ func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(m) != 2 {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
 	remoteAddr, ok := m["addr"]
 	if !ok {
 		w.WriteHeader(http.StatusBadRequest)
@@ -118,12 +158,50 @@ func (s *Service) handleJoin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := s.store.Join(nodeID, remoteAddr); err != nil {
+	// Any other field is metadata of the joining node: the addresses of its
+	// HTTP and etcd APIs, which other nodes redirect and forward requests to.
+	var meta map[string]string
+	for k, v := range m {
+		if k == "addr" || k == "id" {
+			continue
+		}
+		if !joinMeta[k] || !isHostPort(v) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[k] = v
+	}
+
+	if err := s.store.Join(nodeID, remoteAddr, meta); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
+// joinMeta is the metadata a joining node may record with the cluster.
+var joinMeta = map[string]bool{
+	store.MetaHTTPAddr: true,
+	store.MetaEtcdAddr: true,
+}
+
+// isHostPort returns whether addr is a host and a port, such as
+// "localhost:2379". Other nodes connect to the address, so an empty or
+// unspecified host, such as "0.0.0.0", is rejected.
+func isHostPort(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return false
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	return err == nil && n > 0
+}
+
 func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 	getKey := func() string {
 		parts := strings.Split(r.URL.Path, "/")
@@ -141,17 +219,26 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if !s.checkLevel(w, r) {
+			return
+		}
+
 		// 从查询参数获取解码选项，默认为 false
 		query := r.URL.Query()
 		decode := query.Get("decode") == "true"
 
-		v, err := s.store.Get(k, decode)
+		v, err := s.store.Get([]byte(k), decode)
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
 
-		b, err := json.Marshal(map[string]string{k: v})
+		if acceptsRaw(r) {
+			w.Header().Set("Content-Type", contentTypeRaw)
+			w.Write(v)
+			return
+		}
+		b, err := json.Marshal(map[string]string{k: string(v)})
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -159,14 +246,33 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, string(b))
 
 	case "POST":
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		if isRaw(r) {
+			k := getKey()
+			if k == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			v, err := io.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if err := s.store.Set([]byte(k), v); err != nil {
+				writeError(w, err)
+			}
+			return
+		}
 		m := map[string]string{}
 		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
 		for k, v := range m {
-			if err := s.store.Set(k, v); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+			if err := s.store.Set([]byte(k), []byte(v)); err != nil {
+				writeError(w, err)
 				return
 			}
 		}
@@ -177,8 +283,11 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-		if err := s.store.Delete(k); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if s.redirectToLeader(w, r) {
+			return
+		}
+		if err := s.store.Delete([]byte(k)); err != nil {
+			writeError(w, err)
 			return
 		}
 
@@ -188,6 +297,96 @@ func (s *Service) handleKeyRequest(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// isRaw returns whether the body of the request is a raw value, rather than
+// a JSON object of string values.
+func isRaw(r *http.Request) bool {
+	t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return t == contentTypeRaw
+}
+
+// acceptsRaw returns whether the client asked for the raw value of a key,
+// rather than a JSON object of string values.
+func acceptsRaw(r *http.Request) bool {
+	for _, a := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, _ := mime.ParseMediaType(strings.TrimSpace(a)); t == contentTypeRaw {
+			return true
+		}
+	}
+	return false
+}
+
+// leaderError is implemented by the errors of writes made on a node other
+// than the leader, which were not forwarded to the leader.
+type leaderError interface {
+	error
+	LeaderMeta() map[string]string
+}
+
+// writeError writes the response to a failed write. Writes which must be
+// made on the leader are reported as unavailable, naming the leader.
+func writeError(w http.ResponseWriter, err error) {
+	var le leaderError
+	if errors.As(err, &le) {
+		http.Error(w, le.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+// checkLevel prepares the store for a read at the consistency level
+// requested by r. It writes a response and returns false if the read cannot
+// be served by this node at that level, redirecting reads which must be
+// served by the leader to it.
+func (s *Service) checkLevel(w http.ResponseWriter, r *http.Request) bool {
+	switch r.URL.Query().Get("level") {
+	case "", levelNone, levelSerializable:
+		return true
+	case levelWeak:
+		return s.checkLeader(w, r)
+	case levelStrong, levelLinearizable:
+		if !s.checkLeader(w, r) {
+			return false
+		}
+		if err := s.store.LinearizableRead(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return false
+		}
+		return true
+	default:
+		http.Error(w, "invalid read level", http.StatusBadRequest)
+		return false
+	}
+}
+
+// checkLeader returns true if this node is the leader. Otherwise, it
+// redirects the request to the leader, or reports the leader is unknown.
+func (s *Service) checkLeader(w http.ResponseWriter, r *http.Request) bool {
+	if s.redirectToLeader(w, r) {
+		return false
+	}
+	if !s.store.IsLeader() {
+		http.Error(w, "leader unknown", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// redirectToLeader redirects the request to the HTTP API of the leader, with
+// 307 Temporary Redirect so that clients repeat the method and body, and
+// returns true, if this node is not the leader and the leader is known.
+func (s *Service) redirectToLeader(w http.ResponseWriter, r *http.Request) bool {
+	if s.store.IsLeader() {
+		return false
+	}
+	addr := s.store.LeaderHTTPAddr()
+	if addr == "" {
+		return false
+	}
+	u := url.URL{Scheme: "http", Host: addr, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+	http.Redirect(w, r, u.String(), http.StatusTemporaryRedirect)
+	return true
+}
+
 // Addr returns the address on which the Service is listening
 func (s *Service) Addr() net.Addr {
 	return s.ln.Addr()
@@ -200,6 +399,10 @@ func (s *Service) handleCount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.checkLevel(w, r) {
+		return
+	}
+
 	count := s.store.Count()
 
 	// 返回 JSON 格式的数量
@@ -221,6 +424,10 @@ func (s *Service) handleList(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.checkLevel(w, r) {
+		return
+	}
+
 	// 从查询参数获取 n 的值和解码选项
 	query := r.URL.Query()
 	n := 10
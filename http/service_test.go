@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
@@ -49,6 +50,121 @@ func Test_NewServer(t *testing.T) {
 
 }
 
+// Test_ReadLevel tests that reads honour the requested consistency level.
+func Test_ReadLevel(t *testing.T) {
+	store := newTestStore()
+	store.m["k1"] = "v1"
+	s := New(":0", store)
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+
+	for _, path := range []string{"/key/k1", "/key/k1?level=serializable", "/key/k1?level=linearizable", "/count?level=linearizable", "/list?level=linearizable",
+		"/key/k1?level=none", "/key/k1?level=weak", "/key/k1?level=strong", "/list?level=weak", "/list?level=strong"} {
+		if code := get(path); code != http.StatusOK {
+			t.Fatalf("wrong status for %s on leader, exp %d, got %d", path, http.StatusOK, code)
+		}
+	}
+	if code := get("/key/k1?level=bogus"); code != http.StatusBadRequest {
+		t.Fatalf("wrong status for invalid level, exp %d, got %d", http.StatusBadRequest, code)
+	}
+
+	store.follower = true
+	if code := get("/key/k1"); code != http.StatusOK {
+		t.Fatalf("wrong status for serializable read on follower, exp %d, got %d", http.StatusOK, code)
+	}
+	if code := get("/key/k1?level=linearizable"); code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status for linearizable read on follower, exp %d, got %d", http.StatusServiceUnavailable, code)
+	}
+	if code := get("/key/k1?level=weak"); code != http.StatusServiceUnavailable {
+		t.Fatalf("wrong status for weak read on follower, exp %d, got %d", http.StatusServiceUnavailable, code)
+	}
+}
+
+// Test_LeaderRedirect tests that followers redirect writes, and reads which
+// must be served by the leader, to the leader.
+func Test_LeaderRedirect(t *testing.T) {
+	store := newTestStore()
+	store.m["k1"] = "v1"
+	store.follower = true
+	store.leaderAddr = "leader:11000"
+	s := New(":0", store)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	if w := do("GET", "/key/k1?level=none", ""); w.Code != http.StatusOK {
+		t.Fatalf("wrong status for local read on follower, exp %d, got %d", http.StatusOK, w.Code)
+	}
+	for _, tt := range []struct {
+		method, path, body string
+	}{
+		{"GET", "/key/k1?level=weak", ""},
+		{"GET", "/key/k1?level=strong", ""},
+		{"GET", "/list?level=strong&n=5", ""},
+		{"POST", "/key", `{"k2":"v2"}`},
+		{"DELETE", "/key/k1", ""},
+	} {
+		w := do(tt.method, tt.path, tt.body)
+		if w.Code != http.StatusTemporaryRedirect {
+			t.Fatalf("wrong status for %s %s on follower, exp %d, got %d", tt.method, tt.path, http.StatusTemporaryRedirect, w.Code)
+		}
+		if loc, exp := w.Header().Get("Location"), "http://leader:11000"+tt.path; loc != exp {
+			t.Fatalf("wrong redirect for %s %s, exp %s, got %s", tt.method, tt.path, exp, loc)
+		}
+	}
+	if _, ok := store.m["k2"]; ok {
+		t.Fatalf("redirected write applied on follower")
+	}
+	if _, ok := store.m["k1"]; !ok {
+		t.Fatalf("redirected delete applied on follower")
+	}
+}
+
+// Test_RawValues tests that values are written and read as raw bytes with
+// the application/octet-stream content type.
+func Test_RawValues(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store)
+	v := "\x00\xff\xfe{\"not\":\"json\"}"
+
+	req := httptest.NewRequest("POST", "/key/k1", strings.NewReader(v))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status for raw write, exp %d, got %d", http.StatusOK, w.Code)
+	}
+	if store.m["k1"] != v {
+		t.Fatalf("wrong value stored for raw write, exp %q, got %q", v, store.m["k1"])
+	}
+
+	req = httptest.NewRequest("GET", "/key/k1", nil)
+	req.Header.Set("Accept", "text/plain, application/octet-stream")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if ct := w.Header().Get("Content-Type"); ct != "application/octet-stream" {
+		t.Fatalf("wrong content type for raw read, exp application/octet-stream, got %s", ct)
+	}
+	if got := w.Body.String(); got != v {
+		t.Fatalf("wrong value for raw read, exp %q, got %q", v, got)
+	}
+
+	// Without the raw content type, the key is still read as JSON.
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/key/k1", nil))
+	m := map[string]string{}
+	if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+		t.Fatalf("failed to decode JSON read: %s", err)
+	}
+}
+
 type testServer struct {
 	*Service
 }
@@ -58,34 +174,110 @@ func (t *testServer) URL() string {
 	return fmt.Sprintf("http://127.0.0.1:%s", port)
 }
 
+// Test_Join tests that joining nodes may only record the addresses of their
+// APIs with the cluster, and only as a host and a port.
+func Test_Join(t *testing.T) {
+	store := newTestStore()
+	s := New(":0", store)
+
+	join := func(body string) int {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest("POST", "/join", strings.NewReader(body)))
+		return w.Code
+	}
+
+	if code := join(`{"id":"node1","addr":"localhost:12001","http_addr":"localhost:11001","etcd_addr":"[::1]:2380"}`); code != http.StatusOK {
+		t.Fatalf("wrong status for valid join, exp %d, got %d", http.StatusOK, code)
+	}
+	if store.joined["node1"]["http_addr"] != "localhost:11001" || store.joined["node1"]["etcd_addr"] != "[::1]:2380" {
+		t.Fatalf("wrong metadata recorded for joining node: %v", store.joined["node1"])
+	}
+
+	for _, body := range []string{
+		`{"id":"node2"}`,
+		`{"addr":"localhost:12002"}`,
+		`{"id":"node2","addr":"localhost:12002","role":"admin"}`,
+		`{"id":"node2","addr":"localhost:12002","http_addr":"localhost"}`,
+		`{"id":"node2","addr":"localhost:12002","http_addr":"http://evil/"}`,
+		`{"id":"node2","addr":"localhost:12002","etcd_addr":"localhost:0"}`,
+		`{"id":"node2","addr":"localhost:12002","etcd_addr":"localhost:65536"}`,
+		`{"id":"node2","addr":"localhost:12002","etcd_addr":""}`,
+		`{"id":"node2","addr":"localhost:12002","etcd_addr":":2380"}`,
+		`{"id":"node2","addr":"localhost:12002","etcd_addr":"0.0.0.0:2380"}`,
+		`{"id":"node2","addr":"localhost:12002","http_addr":"[::]:11002"}`,
+	} {
+		if code := join(body); code != http.StatusBadRequest {
+			t.Fatalf("wrong status for join %s, exp %d, got %d", body, http.StatusBadRequest, code)
+		}
+	}
+	if _, ok := store.joined["node2"]; ok {
+		t.Fatalf("invalid join recorded")
+	}
+}
+
 type testStore struct {
-	m map[string]string
+	m          map[string]string
+	joined     map[string]map[string]string
+	follower   bool
+	leaderAddr string
 }
 
 func newTestStore() *testStore {
 	return &testStore{
-		m: make(map[string]string),
+		m:      make(map[string]string),
+		joined: make(map[string]map[string]string),
 	}
 }
 
-func (t *testStore) Get(key string) (string, error) {
-	return t.m[key], nil
+func (t *testStore) Get(key []byte, decode bool) ([]byte, error) {
+	return []byte(t.m[string(key)]), nil
+}
+
+func (t *testStore) Set(key, value []byte) error {
+	t.m[string(key)] = string(value)
+	return nil
 }
 
-func (t *testStore) Set(key, value string) error {
-	t.m[key] = value
+func (t *testStore) Delete(key []byte) error {
+	delete(t.m, string(key))
 	return nil
 }
 
-func (t *testStore) Delete(key string) error {
-	delete(t.m, key)
+func (t *testStore) Join(nodeID, addr string, meta map[string]string) error {
+	t.joined[nodeID] = meta
 	return nil
 }
 
-func (t *testStore) Join(nodeID, addr string) error {
+func (t *testStore) Count() int {
+	return len(t.m)
+}
+
+func (t *testStore) ListN(n int, decode bool) map[string]string {
+	m := make(map[string]string)
+	for k, v := range t.m {
+		if len(m) >= n {
+			break
+		}
+		m[k] = v
+	}
+	return m
+}
+
+func (t *testStore) LinearizableRead() error {
+	if t.follower {
+		return fmt.Errorf("not leader")
+	}
 	return nil
 }
 
+func (t *testStore) IsLeader() bool {
+	return !t.follower
+}
+
+func (t *testStore) LeaderHTTPAddr() string {
+	return t.leaderAddr
+}
+
 func doGet(t *testing.T, url, key string) string {
 	resp, err := http.Get(fmt.Sprintf("%s/key/%s", url, key))
 	if err != nil {
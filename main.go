@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"time"
 
 	"github.com/otoolep/hraftd/etcdapi"
 	httpd "github.com/otoolep/hraftd/http"
@@ -19,7 +20,7 @@ import (
 const (
 	DefaultHTTPAddr = "localhost:11000"
 	DefaultRaftAddr = "localhost:12000"
-	DefaultEtcdAddr = "localhost:2379"  // Default etcd API address
+	DefaultEtcdAddr = "localhost:2379" // Default etcd API address
 )
 
 // Command line parameters
@@ -29,6 +30,21 @@ var raftAddr string
 var etcdAddr string
 var joinAddr string
 var nodeID string
+var autoCompactionMode string
+var autoCompactionRetention string
+var quotaBackendBytes int64
+var leaseReads bool
+var maxClockDrift time.Duration
+var forwardWrites bool
+var fsmBackend string
+var batchWrites bool
+var maxBatchBytes int
+var batchLinger time.Duration
+var authToken string
+var authTokenTTL time.Duration
+var configFile string
+var dataDir string
+var raftConfig store.Config
 
 func init() {
 	flag.BoolVar(&inmem, "inmem", false, "Use in-memory storage for Raft")
@@ -37,36 +53,65 @@ func init() {
 	flag.StringVar(&etcdAddr, "eaddr", DefaultEtcdAddr, "Set etcd API bind address")
 	flag.StringVar(&joinAddr, "join", "", "Set join address, if any")
 	flag.StringVar(&nodeID, "id", "", "Node ID. If not set, same as Raft bind address")
+	flag.StringVar(&autoCompactionMode, "auto-compaction-mode", "", "Automatic history compaction mode, 'periodic' or 'revision'. Disabled if not set")
+	flag.StringVar(&autoCompactionRetention, "auto-compaction-retention", "0", "History retained by automatic compaction, a duration in periodic mode or a number of revisions in revision mode. 0 disables automatic compaction")
+	flag.Int64Var(&quotaBackendBytes, "quota-backend-bytes", 0, "Size the keyspace may grow to before the NOSPACE alarm is raised and writes are rejected. 0 disables the quota")
+	flag.BoolVar(&leaseReads, "lease-reads", false, "Serve linearizable reads on the leader without a quorum round while it holds a leader lease")
+	flag.DurationVar(&maxClockDrift, "max-clock-drift", store.DefaultMaxClockDrift, "Bound on the clock drift between nodes, by which leader leases are shortened")
+	flag.BoolVar(&batchWrites, "batch-writes", false, "Coalesce concurrent writes into a single Raft log entry")
+	flag.IntVar(&maxBatchBytes, "max-batch-bytes", store.DefaultMaxBatchBytes, "Size the writes coalesced into a single Raft log entry may reach")
+	flag.DurationVar(&batchLinger, "batch-linger", 0, "How long a batch of writes waits for more writes before it is applied. If 0, batches only hold writes arriving while the previous batch is applied")
+	flag.BoolVar(&forwardWrites, "forward-writes", false, "Forward writes made on followers to the leader. If false, such writes fail with the address of the leader")
+	flag.StringVar(&fsmBackend, "fsm-backend", store.FSMBackendMemory, "Where the keyspace is kept, 'memory' or 'bolt'. With 'bolt', it is kept in a bbolt file next to the Raft log, and a restart only applies the log entries after the last one the file holds")
+	flag.StringVar(&authToken, "auth-token", etcdapi.TokenSimple, "Type of etcd authentication tokens, 'simple' or 'jwt'")
+	flag.DurationVar(&authTokenTTL, "auth-token-ttl", etcdapi.DefaultTokenTTL, "How long etcd authentication tokens are valid for")
+	flag.StringVar(&configFile, "config", "", "Path to a YAML or TOML configuration file. Options set in the environment or on the command line take precedence over it")
+	flag.StringVar(&dataDir, "data-dir", "", "Raft storage directory, if not given as an argument")
+	flag.IntVar(&raftConfig.ClusterSize, "raft-cluster-size", 0, "Number of voters the cluster is expected to have, which the defaults of the other Raft options depend on. 0 for 3")
+	flag.DurationVar(&raftConfig.HeartbeatTimeout, "raft-heartbeat-timeout", 0, "How long a follower goes without contact from the leader before it starts an election. 0 for the default")
+	flag.DurationVar(&raftConfig.ElectionTimeout, "raft-election-timeout", 0, "How long a candidate waits for votes before it starts another election. 0 for the default")
+	flag.DurationVar(&raftConfig.LeaderLeaseTimeout, "raft-leader-lease-timeout", 0, "How long the leader goes without contact from a quorum before it steps down. 0 for the default")
+	flag.DurationVar(&raftConfig.CommitTimeout, "raft-commit-timeout", 0, "How long the leader waits without new entries before it sends the commit index. 0 for the default")
+	flag.IntVar(&raftConfig.MaxAppendEntries, "raft-max-append-entries", 0, "Number of entries sent to a follower in a single request, at most 1024. 0 for the default")
+	flag.DurationVar(&raftConfig.SnapshotInterval, "raft-snapshot-interval", 0, "How often the node checks whether it should take a snapshot. 0 for the default")
+	flag.Uint64Var(&raftConfig.SnapshotThreshold, "raft-snapshot-threshold", 0, "Number of entries applied since the last snapshot above which a snapshot is taken. 0 for the default")
+	flag.Uint64Var(&raftConfig.TrailingLogs, "raft-trailing-logs", 0, "Number of entries left in the log after a snapshot. 0 for the default")
+	flag.IntVar(&raftConfig.RetainSnapshots, "raft-retain-snapshots", 0, "Number of snapshots kept on disk. 0 for the default")
+	flag.IntVar(&raftConfig.TransportMaxPool, "raft-transport-max-pool", 0, "Number of connections kept open to each of the other nodes. 0 for the default")
+	flag.DurationVar(&raftConfig.TransportTimeout, "raft-transport-timeout", 0, "Bound on the I/O of the requests to the other nodes. 0 for the default")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <raft-data-path> \n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s config validate|print [options] [<raft-data-path>]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Every option may also be set in the configuration file, or in an environment\n")
+		fmt.Fprintf(os.Stderr, "variable such as %s for -raft-heartbeat-timeout.\n", envName("raft-heartbeat-timeout"))
 		flag.PrintDefaults()
 	}
 }
 
 func main() {
-	flag.Parse()
-	if flag.NArg() == 0 {
-		fmt.Fprintf(os.Stderr, "No Raft storage directory specified\n")
-		os.Exit(1)
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfig(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	if nodeID == "" {
-		nodeID = raftAddr
+	if err := configure(os.Args[1:]); err != nil {
+		log.Fatalf("failed to configure hraftd: %s", err.Error())
+	}
+	if dataDir == "" {
+		fmt.Fprintf(os.Stderr, "No Raft storage directory specified\n")
+		os.Exit(1)
 	}
 
 	// Ensure Raft storage exists.
-	raftDir := flag.Arg(0)
-	if raftDir == "" {
-		log.Fatalln("No Raft storage directory specified")
-	}
-	if err := os.MkdirAll(raftDir, 0700); err != nil {
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
 		log.Fatalf("failed to create path for Raft storage: %s", err.Error())
 	}
 
-	s := store.New(inmem)
-	s.RaftDir = raftDir
-	s.RaftBind = raftAddr
-	if err := s.Open(joinAddr == "", nodeID); err != nil {
+	s := newStore()
+	if err := s.Open(joinAddr == "", nodeID, &raftConfig); err != nil {
 		log.Fatalf("failed to open store: %s", err.Error())
 	}
 
@@ -78,13 +123,15 @@ func main() {
 
 	// Start the etcd API service
 	e := etcdapi.New(etcdAddr, s)
+	e.AuthToken = authToken
+	e.AuthTokenTTL = authTokenTTL
 	if err := e.Start(); err != nil {
 		log.Fatalf("failed to start etcd API service: %s", err.Error())
 	}
 
 	// If join was specified, make the join request.
 	if joinAddr != "" {
-		if err := join(joinAddr, raftAddr, nodeID); err != nil {
+		if err := join(joinAddr, raftAddr, nodeID, etcdAddr, httpAddr); err != nil {
 			log.Fatalf("failed to join node at %s: %s", joinAddr, err.Error())
 		}
 	}
@@ -100,8 +147,13 @@ func main() {
 	log.Println("hraftd exiting")
 }
 
-func join(joinAddr, raftAddr, nodeID string) error {
-	b, err := json.Marshal(map[string]string{"addr": raftAddr, "id": nodeID})
+func join(joinAddr, raftAddr, nodeID, etcdAddr, httpAddr string) error {
+	b, err := json.Marshal(map[string]string{
+		"addr":             raftAddr,
+		"id":               nodeID,
+		store.MetaEtcdAddr: etcdAddr,
+		store.MetaHTTPAddr: httpAddr,
+	})
 	if err != nil {
 		return err
 	}
@@ -110,5 +162,8 @@ func join(joinAddr, raftAddr, nodeID string) error {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("join request failed: %s", resp.Status)
+	}
 	return nil
 }
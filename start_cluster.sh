@@ -22,6 +22,9 @@ usage() {
     echo "  -n, --nodes NUM     Number of nodes to start (default: $DEFAULT_NODE_COUNT)"
     echo "  -d, --data-dir DIR  Base directory for node data (default: $HRAFTD_DATA_DIR)"
     echo "  -e, --executable PATH  Path to hraftd executable (default: $HRAFTD_EXECUTABLE)"
+    echo "  -b, --fsm-backend BACKEND  FSM backend, memory or bolt (default: bolt, memory with --inmem)"
+    echo "      --inmem         Keep the Raft log in memory"
+    echo "  -c, --config FILE   hraftd configuration file shared by the nodes"
     echo "  -h, --help          Show this help message"
     exit 1
 }
@@ -30,6 +33,8 @@ usage() {
 NODES=$DEFAULT_NODE_COUNT
 DATA_DIR="$HRAFTD_DATA_DIR"
 INMEM=false
+FSM_BACKEND=""
+CONFIG_FILE=""
 
 while [[ $# -gt 0 ]]; do
     key="$1"
@@ -46,6 +51,14 @@ while [[ $# -gt 0 ]]; do
             HRAFTD_EXECUTABLE="$2"
             shift 2
             ;;
+        -b|--fsm-backend)
+            FSM_BACKEND="$2"
+            shift 2
+            ;;
+        -c|--config)
+            CONFIG_FILE="$2"
+            shift 2
+            ;;
         --inmem)
             INMEM=true
             shift
@@ -83,9 +96,26 @@ mkdir -p "$FIRST_NODE_DATA_DIR"
 chmod 755 "$FIRST_NODE_DATA_DIR"
 touch "$FIRST_NODE_DATA_DIR/node.log"
 
-INMEM_FLAG=""
+# 所有节点共享的选项通过 HRAFTD_* 环境变量传递，只有各节点不同的选项在命令行上指定
+export HRAFTD_RAFT_CLUSTER_SIZE="$NODES"
 if [ "$INMEM" = true ]; then
-    INMEM_FLAG="--inmem"
+    export HRAFTD_INMEM=true
+fi
+if [ -n "$CONFIG_FILE" ]; then
+    export HRAFTD_CONFIG="$CONFIG_FILE"
+fi
+
+# 持久化的 FSM 使重启的节点只需重放其最后持久化索引之后的日志
+# 指定了配置文件时，除非使用 -b 参数，否则由配置文件决定
+if [ -z "$FSM_BACKEND" ] && [ -z "$CONFIG_FILE" ]; then
+    if [ "$INMEM" = true ]; then
+        FSM_BACKEND=memory
+    else
+        FSM_BACKEND=bolt
+    fi
+fi
+if [ -n "$FSM_BACKEND" ]; then
+    export HRAFTD_FSM_BACKEND="$FSM_BACKEND"
 fi
 
 "$HRAFTD_EXECUTABLE" \
@@ -93,7 +123,6 @@ fi
     -haddr "localhost:$FIRST_NODE_HTTP_PORT" \
     -raddr "localhost:$FIRST_NODE_RAFT_PORT" \
     -eaddr "localhost:$FIRST_NODE_ETCD_PORT" \
-    $INMEM_FLAG \
     "$FIRST_NODE_DATA_DIR" &> "$FIRST_NODE_DATA_DIR/node.log" &
 
 # 等待第一个节点启动
@@ -118,7 +147,6 @@ for ((i=1; i<NODES; i++)); do
         -raddr "localhost:$NODE_RAFT_PORT" \
         -eaddr "localhost:$NODE_ETCD_PORT" \
         -join "localhost:$FIRST_NODE_HTTP_PORT" \
-        $INMEM_FLAG \
         "$NODE_DATA_DIR" &> "$NODE_DATA_DIR/node.log" &
 
     # 等待节点加入集群
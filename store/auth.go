@@ -0,0 +1,571 @@
+package store
+
+import (
+	"crypto/rand"
+	"errors"
+	"sort"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Names of the user and role with every permission. Authentication can only
+// be enabled once the root user exists, and has the root role.
+const (
+	RootUser = "root"
+	RootRole = "root"
+)
+
+// Permission types.
+const (
+	PermRead      = "READ"
+	PermWrite     = "WRITE"
+	PermReadWrite = "READWRITE"
+)
+
+// signingKeySize is the size of the key signing authentication tokens.
+const signingKeySize = 32
+
+var (
+	// ErrAuthNotEnabled is returned when authentication is required but not
+	// enabled.
+	ErrAuthNotEnabled = errors.New("authentication is not enabled")
+
+	// ErrAuthFailed is returned when a user name or password is wrong.
+	ErrAuthFailed = errors.New("authentication failed, invalid user ID or password")
+
+	// ErrPermissionDenied is returned when a user lacks the permission for a
+	// request.
+	ErrPermissionDenied = errors.New("permission denied")
+
+	// ErrRootUserNotExist is returned when enabling authentication without
+	// a root user.
+	ErrRootUserNotExist = errors.New("root user does not exist")
+
+	// ErrRootRoleNotExist is returned when enabling authentication while the
+	// root user does not have the root role.
+	ErrRootRoleNotExist = errors.New("root user does not have root role")
+
+	// ErrInvalidAuthMgmt is returned when a change would lock every user out
+	// while authentication is enabled.
+	ErrInvalidAuthMgmt = errors.New("invalid auth management")
+
+	ErrUserEmpty            = errors.New("user name is empty")
+	ErrUserAlreadyExist     = errors.New("user name already exists")
+	ErrUserNotFound         = errors.New("user name not found")
+	ErrRoleEmpty            = errors.New("role name is empty")
+	ErrRoleAlreadyExist     = errors.New("role name already exists")
+	ErrRoleNotFound         = errors.New("role name not found")
+	ErrRoleNotGranted       = errors.New("role is not granted to the user")
+	ErrPermissionNotGranted = errors.New("permission is not granted to the role")
+)
+
+// User is a user of the key-value store.
+type User struct {
+	Name string `json:"name"`
+
+	// Password is the bcrypt hash of the password of the user.
+	Password string `json:"password,omitempty"`
+
+	// NoPassword is whether the user can only authenticate by other means
+	// than a password.
+	NoPassword bool `json:"no_password,omitempty"`
+
+	// Roles are the roles granted to the user, sorted.
+	Roles []string `json:"roles,omitempty"`
+}
+
+// Role is a named set of permissions.
+type Role struct {
+	Name  string       `json:"name"`
+	Perms []Permission `json:"perms,omitempty"`
+}
+
+// Permission allows reading or writing the keys in a range, described with
+// etcd range semantics.
+type Permission struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	End  string `json:"end,omitempty"`
+}
+
+// authState is the replicated authentication state of the store.
+type authState struct {
+	enabled    bool
+	revision   int64 // Advanced by every change to the state.
+	users      map[string]User
+	roles      map[string]Role
+	signingKey []byte // Key signing tokens, generated whenever enabled.
+}
+
+func newAuthState() authState {
+	return authState{
+		users: make(map[string]User),
+		roles: make(map[string]Role),
+	}
+}
+
+// authCommand is a change to the authentication state.
+type authCommand struct {
+	Action     string      `json:"action"`
+	User       string      `json:"user,omitempty"`
+	Role       string      `json:"role,omitempty"`
+	Password   string      `json:"password,omitempty"` // bcrypt hash.
+	NoPassword bool        `json:"no_password,omitempty"`
+	Perm       *Permission `json:"perm,omitempty"`
+	SigningKey []byte      `json:"signing_key,omitempty"`
+}
+
+// AuthEnable enables authentication. The root user must exist, and have the
+// root role. Tokens are signed with a new key, so that no token, nor key,
+// obtained while authentication was disabled is valid.
+func (s *Store) AuthEnable() error {
+	c := &authCommand{Action: "enable", SigningKey: make([]byte, signingKeySize)}
+	if _, err := rand.Read(c.SigningKey); err != nil {
+		return err
+	}
+	return s.applyAuth(c)
+}
+
+// AuthDisable disables authentication.
+func (s *Store) AuthDisable() error {
+	return s.applyAuth(&authCommand{Action: "disable"})
+}
+
+// AuthStatus returns whether authentication is enabled, and the revision of
+// the authentication state.
+func (s *Store) AuthStatus() (bool, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.auth.enabled, s.auth.revision
+}
+
+// SigningKey returns the key signing authentication tokens, or nil until
+// authentication has been enabled. The key is the same on every node.
+func (s *Store) SigningKey() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.auth.signingKey
+}
+
+// Authenticate checks the password of the user.
+func (s *Store) Authenticate(name, password string) error {
+	s.mu.Lock()
+	u, ok := s.auth.users[name]
+	s.mu.Unlock()
+	if !ok || u.NoPassword {
+		return ErrAuthFailed
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// UserAdd adds a user. The password is hashed before it is replicated.
+func (s *Store) UserAdd(name, password string, noPassword bool) error {
+	c := &authCommand{Action: "user_add", User: name, NoPassword: noPassword}
+	if !noPassword {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return err
+		}
+		c.Password = string(h)
+	}
+	return s.applyAuth(c)
+}
+
+// UserDelete deletes a user.
+func (s *Store) UserDelete(name string) error {
+	return s.applyAuth(&authCommand{Action: "user_delete", User: name})
+}
+
+// UserChangePassword changes the password of a user.
+func (s *Store) UserChangePassword(name, password string) error {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return s.applyAuth(&authCommand{Action: "user_password", User: name, Password: string(h)})
+}
+
+// UserGrantRole grants a role to a user.
+func (s *Store) UserGrantRole(name, role string) error {
+	return s.applyAuth(&authCommand{Action: "user_grant", User: name, Role: role})
+}
+
+// UserRevokeRole revokes a role from a user.
+func (s *Store) UserRevokeRole(name, role string) error {
+	return s.applyAuth(&authCommand{Action: "user_revoke", User: name, Role: role})
+}
+
+// User returns the user with the given name.
+func (s *Store) User(name string) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.auth.users[name]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return &u, nil
+}
+
+// Users returns the names of all users, sorted.
+func (s *Store) Users() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.auth.users))
+	for n := range s.auth.users {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RoleAdd adds a role without permissions.
+func (s *Store) RoleAdd(name string) error {
+	return s.applyAuth(&authCommand{Action: "role_add", Role: name})
+}
+
+// RoleDelete deletes a role, and revokes it from every user.
+func (s *Store) RoleDelete(name string) error {
+	return s.applyAuth(&authCommand{Action: "role_delete", Role: name})
+}
+
+// RoleGrantPermission grants a permission to a role. A permission on the
+// same range replaces the existing one.
+func (s *Store) RoleGrantPermission(name string, perm Permission) error {
+	return s.applyAuth(&authCommand{Action: "role_grant", Role: name, Perm: &perm})
+}
+
+// RoleRevokePermission revokes the permission on the range from a role.
+func (s *Store) RoleRevokePermission(name, key, end string) error {
+	return s.applyAuth(&authCommand{Action: "role_revoke", Role: name, Perm: &Permission{Key: key, End: end}})
+}
+
+// Role returns the role with the given name.
+func (s *Store) Role(name string) (*Role, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.auth.roles[name]
+	if !ok {
+		return nil, ErrRoleNotFound
+	}
+	return &r, nil
+}
+
+// Roles returns the names of all roles, sorted.
+func (s *Store) Roles() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.auth.roles))
+	for n := range s.auth.roles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// IsAdmin returns whether the user has the root role.
+func (s *Store) IsAdmin(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.auth.users[name]
+	return ok && hasRole(u, RootRole)
+}
+
+// IsPermitted returns whether the user may read, or write if write is set,
+// every key in the range described by key and end. The permissions of all
+// roles of the user are combined, so a range may be covered by several
+// permissions.
+func (s *Store) IsPermitted(name, key, end string, write bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.auth.users[name]
+	if !ok {
+		return false
+	}
+	if hasRole(u, RootRole) {
+		return true
+	}
+
+	var ivs []interval
+	for _, rn := range u.Roles {
+		for _, p := range s.auth.roles[rn].Perms {
+			if p.Type == PermReadWrite || (write && p.Type == PermWrite) || (!write && p.Type == PermRead) {
+				ivs = append(ivs, toInterval(p.Key, p.End))
+			}
+		}
+	}
+	return covers(ivs, toInterval(key, end))
+}
+
+// applyAuth replicates a change to the authentication state.
+func (s *Store) applyAuth(c *authCommand) error {
+	_, err := s.apply(&command{Op: "auth", Auth: c})
+	return err
+}
+
+func (f *fsm) applyAuth(c *authCommand) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	a := &f.auth
+	switch c.Action {
+	case "enable":
+		root, ok := a.users[RootUser]
+		if !ok {
+			return ErrRootUserNotExist
+		}
+		if !hasRole(root, RootRole) {
+			return ErrRootRoleNotExist
+		}
+		// Enabling authentication again keeps the key, and the tokens
+		// signed with it.
+		if c.SigningKey != nil && !a.enabled {
+			a.signingKey = c.SigningKey
+		}
+		a.enabled = true
+
+	case "disable":
+		a.enabled = false
+
+	case "user_add":
+		if c.User == "" {
+			return ErrUserEmpty
+		}
+		if _, ok := a.users[c.User]; ok {
+			return ErrUserAlreadyExist
+		}
+		a.users[c.User] = User{Name: c.User, Password: c.Password, NoPassword: c.NoPassword}
+
+	case "user_delete":
+		if _, ok := a.users[c.User]; !ok {
+			return ErrUserNotFound
+		}
+		if a.enabled && c.User == RootUser {
+			return ErrInvalidAuthMgmt
+		}
+		delete(a.users, c.User)
+
+	case "user_password":
+		u, ok := a.users[c.User]
+		if !ok {
+			return ErrUserNotFound
+		}
+		u.Password, u.NoPassword = c.Password, false
+		a.users[c.User] = u
+
+	case "user_grant":
+		u, ok := a.users[c.User]
+		if !ok {
+			return ErrUserNotFound
+		}
+		if _, ok := a.roles[c.Role]; !ok && c.Role != RootRole {
+			return ErrRoleNotFound
+		}
+		if !hasRole(u, c.Role) {
+			u.Roles = insertSorted(u.Roles, c.Role)
+			a.users[c.User] = u
+		}
+
+	case "user_revoke":
+		u, ok := a.users[c.User]
+		if !ok {
+			return ErrUserNotFound
+		}
+		if !hasRole(u, c.Role) {
+			return ErrRoleNotGranted
+		}
+		if a.enabled && c.User == RootUser && c.Role == RootRole {
+			return ErrInvalidAuthMgmt
+		}
+		u.Roles = removeSorted(u.Roles, c.Role)
+		a.users[c.User] = u
+
+	case "role_add":
+		if c.Role == "" {
+			return ErrRoleEmpty
+		}
+		if _, ok := a.roles[c.Role]; ok {
+			return ErrRoleAlreadyExist
+		}
+		a.roles[c.Role] = Role{Name: c.Role}
+
+	case "role_delete":
+		if _, ok := a.roles[c.Role]; !ok {
+			return ErrRoleNotFound
+		}
+		if a.enabled && c.Role == RootRole {
+			return ErrInvalidAuthMgmt
+		}
+		delete(a.roles, c.Role)
+		for n, u := range a.users {
+			if hasRole(u, c.Role) {
+				u.Roles = removeSorted(u.Roles, c.Role)
+				a.users[n] = u
+			}
+		}
+
+	case "role_grant":
+		r, ok := a.roles[c.Role]
+		if !ok {
+			return ErrRoleNotFound
+		}
+		perms := make([]Permission, 0, len(r.Perms)+1)
+		for _, p := range r.Perms {
+			if p.Key != c.Perm.Key || p.End != c.Perm.End {
+				perms = append(perms, p)
+			}
+		}
+		perms = append(perms, *c.Perm)
+		sort.Slice(perms, func(i, j int) bool {
+			if perms[i].Key != perms[j].Key {
+				return perms[i].Key < perms[j].Key
+			}
+			return perms[i].End < perms[j].End
+		})
+		r.Perms = perms
+		a.roles[c.Role] = r
+
+	case "role_revoke":
+		r, ok := a.roles[c.Role]
+		if !ok {
+			return ErrRoleNotFound
+		}
+		perms := make([]Permission, 0, len(r.Perms))
+		for _, p := range r.Perms {
+			if p.Key != c.Perm.Key || p.End != c.Perm.End {
+				perms = append(perms, p)
+			}
+		}
+		if len(perms) == len(r.Perms) {
+			return ErrPermissionNotGranted
+		}
+		r.Perms = perms
+		a.roles[c.Role] = r
+
+	default:
+		return errors.New("unknown auth action " + c.Action)
+	}
+
+	a.revision++
+	return nil
+}
+
+// hasRole returns whether the role is granted to the user.
+func hasRole(u User, role string) bool {
+	i := sort.SearchStrings(u.Roles, role)
+	return i < len(u.Roles) && u.Roles[i] == role
+}
+
+// insertSorted returns the sorted slice with s inserted, without modifying
+// the original.
+func insertSorted(ss []string, s string) []string {
+	out := append(make([]string, 0, len(ss)+1), ss...)
+	out = append(out, s)
+	sort.Strings(out)
+	return out
+}
+
+// removeSorted returns the slice without s, without modifying the original.
+func removeSorted(ss []string, s string) []string {
+	out := make([]string, 0, len(ss))
+	for _, v := range ss {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// interval is a range of keys [start, end). An empty end is unbounded.
+type interval struct {
+	start, end string
+}
+
+// toInterval converts a range with etcd range semantics to an interval.
+func toInterval(key, end string) interval {
+	switch end {
+	case "":
+		return interval{key, key + "\x00"}
+	case "\x00":
+		return interval{key, ""}
+	}
+	return interval{key, end}
+}
+
+// covers returns whether the union of ivs contains iv.
+func covers(ivs []interval, iv interval) bool {
+	sort.Slice(ivs, func(i, j int) bool { return ivs[i].start < ivs[j].start })
+
+	// Merge overlapping and adjacent intervals, and look for one containing
+	// iv.
+	var cur interval
+	merged := false
+	for _, n := range ivs {
+		if merged && (cur.end == "" || n.start <= cur.end) {
+			if cur.end != "" && (n.end == "" || n.end > cur.end) {
+				cur.end = n.end
+			}
+			continue
+		}
+		if merged && contains(cur, iv) {
+			return true
+		}
+		cur, merged = n, true
+	}
+	return merged && contains(cur, iv)
+}
+
+// contains returns whether a contains b.
+func contains(a, b interval) bool {
+	if b.start < a.start {
+		return false
+	}
+	if a.end == "" {
+		return true
+	}
+	return b.end != "" && b.end <= a.end
+}
+
+// snapshotAuth is the authentication state in a snapshot.
+type snapshotAuth struct {
+	Enabled    bool   `json:"enabled,omitempty"`
+	Revision   int64  `json:"revision"`
+	Users      []User `json:"users,omitempty"`
+	Roles      []Role `json:"roles,omitempty"`
+	SigningKey []byte `json:"signing_key,omitempty"`
+}
+
+// snapshot returns the state for a snapshot. Users and roles are never
+// modified in place, so they are not copied. The caller must hold the lock.
+func (a *authState) snapshot() *snapshotAuth {
+	o := &snapshotAuth{
+		Enabled:    a.enabled,
+		Revision:   a.revision,
+		SigningKey: a.signingKey,
+	}
+	for _, u := range a.users {
+		o.Users = append(o.Users, u)
+	}
+	for _, r := range a.roles {
+		o.Roles = append(o.Roles, r)
+	}
+	sort.Slice(o.Users, func(i, j int) bool { return o.Users[i].Name < o.Users[j].Name })
+	sort.Slice(o.Roles, func(i, j int) bool { return o.Roles[i].Name < o.Roles[j].Name })
+	return o
+}
+
+// restore returns the state in the snapshot.
+func (o *snapshotAuth) restore() authState {
+	a := newAuthState()
+	a.enabled, a.revision, a.signingKey = o.Enabled, o.Revision, o.SigningKey
+	for _, u := range o.Users {
+		a.users[u.Name] = u
+	}
+	for _, r := range o.Roles {
+		a.roles[r.Name] = r
+	}
+	return a
+}
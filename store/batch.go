@@ -0,0 +1,174 @@
+package store
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultMaxBatchBytes is the default bound on the size of the commands
+// coalesced into a single Raft log entry.
+const DefaultMaxBatchBytes = 1 << 20
+
+// batcher coalesces concurrent writes into batches, each replicated as a
+// single Raft log entry and applied by the FSM in order. Writes arriving while
+// a batch is being applied join the next batch, so that a single entry, and
+// a single round of replication, serves many writers.
+type batcher struct {
+	s *Store
+
+	// maxBytes bounds the size of a batch, and linger is how long a batch
+	// waits for more writes before it is applied, unless it is full.
+	maxBytes int
+	linger   time.Duration
+
+	mu      sync.Mutex
+	pending []*batchEntry // Writes waiting for the next batch.
+	size    int           // The size of the pending writes.
+	running bool          // Whether a goroutine is applying batches.
+	full    chan struct{} // Signalled when the pending writes fill a batch.
+}
+
+// batchEntry is an encoded command waiting to be applied.
+type batchEntry struct {
+	b []byte
+	c chan batchResult
+}
+
+type batchResult struct {
+	resp  interface{}
+	index uint64
+	err   error
+}
+
+func newBatcher(s *Store) *batcher {
+	return &batcher{s: s, full: make(chan struct{}, 1)}
+}
+
+// batchable returns whether commands with the given op are batched. Writes
+// to keys are, while rarer commands are applied on their own.
+func batchable(op string) bool {
+	return op == "set" || op == "delete" || op == "txn"
+}
+
+// apply applies the encoded command as part of a batch, and returns its
+// response along with the index of the batch.
+func (b *batcher) apply(cmd []byte) (interface{}, uint64, error) {
+	e := &batchEntry{b: cmd, c: make(chan batchResult, 1)}
+	b.mu.Lock()
+	b.pending = append(b.pending, e)
+	b.size += len(cmd)
+	if b.size >= b.maxBytes {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+	if !b.running {
+		b.running = true
+		go b.run()
+	}
+	b.mu.Unlock()
+
+	res := <-e.c
+	return res.resp, res.index, res.err
+}
+
+// run applies batches until no write is waiting.
+func (b *batcher) run() {
+	for {
+		if b.linger > 0 {
+			timer := time.NewTimer(b.linger)
+			select {
+			case <-timer.C:
+			case <-b.full:
+			}
+			timer.Stop()
+		}
+
+		batch := b.next()
+		if batch == nil {
+			return
+		}
+		b.flush(batch)
+	}
+}
+
+// next takes the writes of the next batch, up to the maximum size. It
+// returns nil, and stops the batcher, if no write is waiting.
+func (b *batcher) next() []*batchEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.pending) == 0 {
+		b.running = false
+		return nil
+	}
+
+	n, size := 0, 0
+	for n < len(b.pending) && (n == 0 || size+len(b.pending[n].b) <= b.maxBytes) {
+		size += len(b.pending[n].b)
+		n++
+	}
+	batch := b.pending[:n:n]
+	b.pending = b.pending[n:]
+	b.size -= size
+	if len(b.pending) == 0 {
+		b.pending = nil
+	}
+	return batch
+}
+
+// flush applies the batch as a single log entry, and hands each write its
+// response. A batch of a single write is applied as a plain command.
+func (b *batcher) flush(batch []*batchEntry) {
+	if len(batch) == 1 {
+		resp, index, err := b.s.applyEntry(batch[0].b)
+		batch[0].c <- batchResult{resp: resp, index: index, err: err}
+		return
+	}
+
+	c := command{Op: "batch", Batch: make([][]byte, len(batch))}
+	for i, e := range batch {
+		c.Batch[i] = e.b
+	}
+	data, err := encodeCommand(&c)
+	var resp interface{}
+	var index uint64
+	if err == nil {
+		resp, index, err = b.s.applyEntry(data)
+	}
+	if err != nil {
+		for _, e := range batch {
+			e.c <- batchResult{err: err}
+		}
+		return
+	}
+
+	results := resp.([]interface{})
+	for i, e := range batch {
+		res := batchResult{resp: results[i], index: index}
+		if err, ok := results[i].(error); ok {
+			res = batchResult{index: index, err: err}
+		}
+		e.c <- res
+	}
+}
+
+// applyBatch applies the commands of a batch in order, and returns their
+// responses.
+func (f *fsm) applyBatch(batch [][]byte) interface{} {
+	results := make([]interface{}, len(batch))
+	for i, b := range batch {
+		var c command
+		if err := decodeCommand(b, &c); err != nil {
+			results[i] = fmt.Errorf("failed to decode batched command: %w", err)
+			continue
+		}
+		if !batchable(c.Op) {
+			results[i] = fmt.Errorf("command %s may not be batched", c.Op)
+			continue
+		}
+		results[i] = f.applyCommand(&c)
+	}
+	return results
+}
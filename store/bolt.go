@@ -0,0 +1,596 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/btree"
+	"github.com/hashicorp/raft"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// FSM backends, selected with FSMBackend.
+const (
+	// FSMBackendMemory keeps the keyspace in memory. It is rebuilt from the
+	// latest snapshot and the Raft log when the node restarts.
+	FSMBackendMemory = "memory"
+
+	// FSMBackendBolt keeps the keyspace in a bbolt file next to the Raft
+	// log, so that it can exceed memory. The index of the last entry applied
+	// is recorded with it, so that a restarting node only applies the
+	// entries after it.
+	FSMBackendBolt = "bolt"
+)
+
+const (
+	// boltFile is the name of the bbolt file in the Raft directory.
+	boltFile = "fsm.db"
+
+	// Applied entries are committed to the bbolt file in batches, of at most
+	// boltCommitEntries entries or boltCommitInterval. Entries applied but
+	// not yet committed are applied again from the Raft log on restart.
+	boltCommitEntries  = 1000
+	boltCommitInterval = 100 * time.Millisecond
+
+	// boltBulkWrites is the number of writes per transaction while a
+	// snapshot is being restored.
+	boltBulkWrites = 10000
+
+	// boltInitialMmapSize is the initial size of the memory map of the bbolt
+	// file. Growing the map waits for read transactions, such as the one of
+	// a snapshot being persisted, so it is made large enough, like etcd, not
+	// to grow in most deployments.
+	boltInitialMmapSize = 10 << 30
+)
+
+var (
+	boltKVBucket   = []byte("kv")   // Keys, and their history.
+	boltMetaBucket = []byte("meta") // The rest of the state of the store.
+	boltStateKey   = []byte("state")
+	boltSumKey     = []byte("checksum")
+)
+
+// errBoltChecksum is returned when the keys or the state of a bbolt file do
+// not match the checksum committed with them.
+var errBoltChecksum = errors.New("bbolt FSM checksum mismatch")
+
+// crc64Table is the table of the checksums of keys in a bbolt file.
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// fieldKVRev is the field number of the revisions of a key in the bbolt file,
+// each encoded like a key-value record of a snapshot.
+const fieldKVRev protowire.Number = 1
+
+// boltIndex is a key index stored in a bbolt file. Every access happens
+// within a single write transaction, which holds the changes applied since
+// the last commit, so that they are visible to reads.
+//
+// The index keeps a checksum of its keys, the XOR of the CRC-64 of every key
+// and its encoded history, which is updated by every write and committed
+// with the state of the store, so that the file can be verified on open
+// without trusting it.
+type boltIndex struct {
+	db *bolt.DB
+	tx *bolt.Tx // The open write transaction, if any.
+
+	sum    uint64 // The checksum of the keys, including uncommitted writes.
+	synced uint64 // The checksum of the keys as of the last commit.
+
+	// bulk commits every boltBulkWrites writes, while restoring a snapshot.
+	bulk   bool
+	writes int // Writes since the last commit.
+
+	entries   int       // Entries applied since the last commit.
+	committed time.Time // The time of the last commit.
+}
+
+// openBolt opens, or creates, the bbolt file at path.
+func openBolt(path string) (*boltIndex, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout:         time.Second,
+		InitialMmapSize: boltInitialMmapSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltKVBucket, boltMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltIndex{db: db, committed: time.Now()}, nil
+}
+
+// createTempBolt creates a bbolt file in dir, into which a snapshot is
+// restored in bulk.
+func createTempBolt(dir string) (*boltIndex, error) {
+	f, err := os.CreateTemp(dir, boltFile+".restore-*")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	b, err := openBolt(f.Name())
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	b.bulk = true
+	return b, nil
+}
+
+// bucket returns the bucket of the keys, within the write transaction.
+func (b *boltIndex) bucket() *bolt.Bucket {
+	if b.tx == nil {
+		tx, err := b.db.Begin(true)
+		if err != nil {
+			panic(fmt.Sprintf("failed to begin bbolt transaction: %s", err.Error()))
+		}
+		b.tx = tx
+	}
+	return b.tx.Bucket(boltKVBucket)
+}
+
+func (b *boltIndex) Get(key kvItem) (kvItem, bool) {
+	v := b.bucket().Get(key.key)
+	if v == nil {
+		return kvItem{}, false
+	}
+	return decodeKVItem(key.key, v), true
+}
+
+func (b *boltIndex) ReplaceOrInsert(item kvItem) (kvItem, bool) {
+	return b.put(item.key, encodeKVItem(item))
+}
+
+func (b *boltIndex) Delete(item kvItem) (kvItem, bool) {
+	return b.put(item.key, nil)
+}
+
+// put writes the encoded history of the key, or deletes the key if v is nil,
+// and updates the checksum of the keys. It returns the previous history of
+// the key, if any.
+func (b *boltIndex) put(k, v []byte) (kvItem, bool) {
+	bk := b.bucket()
+	prev, ok := kvItem{}, false
+	if old := bk.Get(k); old != nil {
+		// The old value is only valid until the bucket is written.
+		prev, ok = decodeKVItem(k, old), true
+		b.sum ^= boltKeySum(k, old)
+	}
+	var err error
+	if v != nil {
+		b.sum ^= boltKeySum(k, v)
+		err = bk.Put(k, v)
+	} else if ok {
+		err = bk.Delete(k)
+	} else {
+		return prev, false
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to write key to bbolt: %s", err.Error()))
+	}
+	b.wrote()
+	return prev, ok
+}
+
+func (b *boltIndex) Ascend(fn btree.ItemIteratorG[kvItem]) {
+	c := b.bucket().Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if !fn(decodeKVItem(k, v)) {
+			return
+		}
+	}
+}
+
+func (b *boltIndex) AscendGreaterOrEqual(pivot kvItem, fn btree.ItemIteratorG[kvItem]) {
+	c := b.bucket().Cursor()
+	for k, v := c.Seek(pivot.key); k != nil; k, v = c.Next() {
+		if !fn(decodeKVItem(k, v)) {
+			return
+		}
+	}
+}
+
+func (b *boltIndex) AscendRange(greaterOrEqual, lessThan kvItem, fn btree.ItemIteratorG[kvItem]) {
+	c := b.bucket().Cursor()
+	for k, v := c.Seek(greaterOrEqual.key); k != nil && bytes.Compare(k, lessThan.key) < 0; k, v = c.Next() {
+		if !fn(decodeKVItem(k, v)) {
+			return
+		}
+	}
+}
+
+// wrote counts a write, and commits the writes of a bulk restore in
+// batches, to bound the size of the transaction.
+func (b *boltIndex) wrote() {
+	b.writes++
+	if b.bulk && b.writes >= boltBulkWrites {
+		if err := b.commit(nil); err != nil {
+			panic(fmt.Sprintf("failed to commit bbolt transaction: %s", err.Error()))
+		}
+	}
+}
+
+// commit commits the write transaction, along with the encoded state of the
+// store but the keys and the checksum of both, unless state is nil.
+func (b *boltIndex) commit(state []byte) error {
+	b.bucket()
+	if state != nil {
+		meta := b.tx.Bucket(boltMetaBucket)
+		err := meta.Put(boltStateKey, state)
+		if err == nil {
+			err = meta.Put(boltSumKey, boltSum(state, b.sum))
+		}
+		if err != nil {
+			b.rollback()
+			return err
+		}
+	}
+	err := b.tx.Commit()
+	b.tx = nil
+	b.synced = b.sum
+	b.writes, b.entries, b.committed = 0, 0, time.Now()
+	return err
+}
+
+// rollback discards the changes made since the last commit.
+func (b *boltIndex) rollback() {
+	if b.tx != nil {
+		b.tx.Rollback()
+		b.tx = nil
+	}
+	b.sum = b.synced
+}
+
+// verify checks the keys and the state committed to the file against their
+// checksum, and returns errBoltChecksum if they do not match. A file the state
+// was never committed to must have no keys.
+func (b *boltIndex) verify() error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		var sum uint64
+		err := tx.Bucket(boltKVBucket).ForEach(func(k, v []byte) error {
+			sum ^= boltKeySum(k, v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		meta := tx.Bucket(boltMetaBucket)
+		state, want := meta.Get(boltStateKey), meta.Get(boltSumKey)
+		if state == nil && want == nil && sum == 0 {
+			return nil
+		}
+		if state == nil || !bytes.Equal(want, boltSum(state, sum)) {
+			return errBoltChecksum
+		}
+		b.sum, b.synced = sum, sum
+		return nil
+	})
+}
+
+// state returns the state of the store but the keys, as of the last commit.
+// It is nil if the state was never committed.
+func (b *boltIndex) state() (*snapshotState, error) {
+	var o *snapshotState
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		o, err = readBoltState(tx)
+		return err
+	})
+	return o, err
+}
+
+// readBoltState returns the state of the store but the keys, as seen by the
+// transaction, or nil if it was never committed.
+func readBoltState(tx *bolt.Tx) (*snapshotState, error) {
+	v := tx.Bucket(boltMetaBucket).Get(boltStateKey)
+	if v == nil {
+		return nil, nil
+	}
+	o := &snapshotState{}
+	if err := json.Unmarshal(v, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// close discards the changes made since the last commit, and closes the
+// file.
+func (b *boltIndex) close() error {
+	b.rollback()
+	return b.db.Close()
+}
+
+// remove closes and removes the file.
+func (b *boltIndex) remove() {
+	path := b.db.Path()
+	b.close()
+	os.Remove(path)
+}
+
+// boltKeySum returns the checksum of a key and its encoded history.
+func boltKeySum(k, v []byte) uint64 {
+	return crc64.Update(crc64.Checksum(k, crc64Table), crc64Table, v)
+}
+
+// boltSum encodes the checksum committed with the state of the store: the
+// CRC-32C of the encoded state, followed by the checksum of the keys.
+func boltSum(state []byte, sum uint64) []byte {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b, crc32.Checksum(state, castagnoli))
+	binary.BigEndian.PutUint64(b[4:], sum)
+	return b
+}
+
+// encodeKVItem encodes the history of a key.
+func encodeKVItem(it kvItem) []byte {
+	var b, r []byte
+	for _, rev := range it.revs {
+		r = appendKeyRev(r[:0], rev)
+		b = protowire.AppendTag(b, fieldKVRev, protowire.BytesType)
+		b = protowire.AppendBytes(b, r)
+	}
+	return b
+}
+
+// decodeKVItem decodes the history of the key. The key and the values are
+// copied, so the item remains valid after the transaction.
+func decodeKVItem(key, b []byte) kvItem {
+	it := kvItem{key: bytes.Clone(key)}
+	err := consumeFields(b, func(num protowire.Number, v []byte, _ uint64) {
+		if num != fieldKVRev {
+			return
+		}
+		var r keyRev
+		if err := consumeFields(v, r.setField); err != nil {
+			panic(fmt.Sprintf("failed to decode revision of key %q: %s", key, err.Error()))
+		}
+		it.revs = append(it.revs, r)
+	})
+	if err != nil {
+		panic(fmt.Sprintf("failed to decode key %q: %s", key, err.Error()))
+	}
+	return it
+}
+
+// loadBolt opens the bbolt file of the FSM at path, verifies it, and restores
+// the state committed to it, so that Raft only applies the entries after the
+// index recorded with it. If the file fails verification it is discarded, and
+// if the latest snapshot is more recent than the file, as when the file was
+// discarded or lost, the snapshot is restored instead.
+func (f *fsm) loadBolt(path string, snapshots raft.SnapshotStore) error {
+	b, err := openBolt(path)
+	if err != nil {
+		return fmt.Errorf("open bbolt FSM: %s", err)
+	}
+	if err := b.verify(); err != nil {
+		f.logger.Printf("bbolt FSM failed verification, discarding it: %s", err)
+		b.remove()
+		if b, err = openBolt(path); err != nil {
+			return fmt.Errorf("open bbolt FSM: %s", err)
+		}
+	}
+	o, err := b.state()
+	if err != nil {
+		b.close()
+		return fmt.Errorf("read bbolt FSM state: %s", err)
+	}
+	sr := newSnapshotRestorer(filepath.Dir(path), true)
+	sr.kv = b
+	if o != nil {
+		sr.setState(o)
+	}
+	sr.finish()
+
+	f.mu.Lock()
+	f.bolt = b
+	f.install(sr)
+	f.durable = sr.applied
+	f.mu.Unlock()
+
+	if snapshots == nil {
+		return nil
+	}
+	list, err := snapshots.List()
+	if err != nil || len(list) == 0 || list[0].Index <= sr.applied {
+		if err == nil && sr.applied > 0 {
+			f.logger.Printf("loaded bbolt FSM at index %d", sr.applied)
+		}
+		return err
+	}
+	f.logger.Printf("bbolt FSM is at index %d, restoring snapshot %s at index %d", sr.applied, list[0].ID, list[0].Index)
+	_, rc, err := snapshots.Open(list[0].ID)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := f.Restore(rc); err != nil {
+		return fmt.Errorf("restore snapshot %s: %s", list[0].ID, err)
+	}
+	f.mu.Lock()
+	f.durable = f.applied
+	f.mu.Unlock()
+	return nil
+}
+
+// appliedBolt records that an entry was applied, and commits the entries
+// applied since the last commit once there are enough of them, or they are
+// old enough. The caller must hold the lock.
+func (f *fsm) appliedBolt() {
+	b := f.bolt
+	b.entries++
+	if b.entries >= boltCommitEntries || time.Since(b.committed) >= boltCommitInterval {
+		f.commitBolt()
+	}
+}
+
+// commitBolt commits the entries applied since the last commit to the bbolt
+// file. The caller must hold the lock.
+func (f *fsm) commitBolt() {
+	state, err := json.Marshal(f.state())
+	if err == nil {
+		err = f.bolt.commit(state)
+	}
+	if err != nil {
+		panic(fmt.Sprintf("failed to commit to bbolt: %s", err.Error()))
+	}
+}
+
+// installBolt replaces the bbolt file of the FSM with the file the keys of a
+// snapshot were restored into. The caller must hold the lock, and install
+// the rest of the state first, so that it is committed with the keys.
+func (f *fsm) installBolt(tmp *boltIndex) error {
+	path := f.bolt.db.Path()
+	f.bolt.close()
+	f.bolt = tmp
+	f.commitBolt()
+	tmpPath := tmp.db.Path()
+	if err := tmp.close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	b, err := openBolt(path)
+	if err != nil {
+		return err
+	}
+	f.bolt, f.kv = b, b
+	return nil
+}
+
+// restoreBolt restores a snapshot holding a copy of a bbolt file.
+func (sr *snapshotRestorer) restoreBolt(br *bufio.Reader, header []byte) error {
+	tmp, err := os.CreateTemp(sr.dir, boltFile+".restore-*")
+	if err != nil {
+		return err
+	}
+	path := tmp.Name()
+	err = func() error {
+		defer tmp.Close()
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return errSnapshotTruncated
+		}
+		crc := crc32.New(castagnoli)
+		if _, err := io.CopyN(io.MultiWriter(tmp, crc), br, int64(size)); err != nil {
+			return errSnapshotTruncated
+		}
+		var sum [4]byte
+		if _, err := io.ReadFull(br, sum[:]); err != nil {
+			return errSnapshotTruncated
+		}
+		if binary.BigEndian.Uint32(sum[:]) != crc.Sum32() {
+			return errSnapshotChecksum
+		}
+		return tmp.Sync()
+	}()
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	b, err := openBolt(path)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if err := b.verify(); err != nil {
+		b.remove()
+		return err
+	}
+	o, err := b.state()
+	if err != nil {
+		b.remove()
+		return err
+	}
+	if o != nil {
+		sr.setState(o)
+	}
+	if sr.persistent {
+		b.bulk = true
+		sr.kv = b
+		sr.finish()
+		return nil
+	}
+
+	// Copy the keys into memory.
+	defer b.remove()
+	sr.kv = newIndex()
+	b.Ascend(func(it kvItem) bool {
+		sr.kv.ReplaceOrInsert(it)
+		return true
+	})
+	sr.finish()
+	return nil
+}
+
+// boltTxKeys iterates over the keys of a bbolt file, as seen by a read
+// transaction.
+type boltTxKeys struct {
+	tx *bolt.Tx
+}
+
+func (k boltTxKeys) Ascend(fn btree.ItemIteratorG[kvItem]) {
+	c := k.tx.Bucket(boltKVBucket).Cursor()
+	for key, v := c.First(); key != nil; key, v = c.Next() {
+		if !fn(decodeKVItem(key, v)) {
+			return
+		}
+	}
+}
+
+// boltSnapshot is a snapshot of the bbolt file of the FSM, persisted from a
+// read transaction while entries continue to be applied.
+type boltSnapshot struct {
+	tx  *bolt.Tx
+	rev int64
+}
+
+func (s *boltSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := func() error {
+		w := bufio.NewWriterSize(sink, snapshotChunkSize)
+		w.WriteString(snapshotMagic)
+		w.WriteByte(snapshotVersionBolt)
+		var l [binary.MaxVarintLen64]byte
+		w.Write(protowire.AppendVarint(l[:0], uint64(s.tx.Size())))
+
+		crc := crc32.New(castagnoli)
+		if _, err := s.tx.WriteTo(io.MultiWriter(w, crc)); err != nil {
+			return err
+		}
+		var sum [4]byte
+		binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+		w.Write(sum[:])
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return sink.Close()
+	}()
+	if err != nil {
+		sink.Cancel()
+	}
+	return err
+}
+
+func (s *boltSnapshot) Release() {
+	s.tx.Rollback()
+}
@@ -0,0 +1,285 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Metadata keys describing how to reach a node.
+const (
+	// MetaEtcdAddr is the address of the etcd API of the node.
+	MetaEtcdAddr = "etcd_addr"
+
+	// MetaHTTPAddr is the address of the HTTP API of the node.
+	MetaHTTPAddr = "http_addr"
+)
+
+// registerInterval is how often a node checks whether its metadata has been
+// recorded by the cluster.
+const registerInterval = time.Second
+
+var (
+	// ErrMemberNotFound is returned when the requested node is not a member
+	// of the cluster.
+	ErrMemberNotFound = errors.New("member not found")
+
+	// ErrMemberExists is returned when adding a node which is already a
+	// member of the cluster.
+	ErrMemberExists = errors.New("member already exists")
+
+	// ErrAddrExists is returned when adding a node at the address of an
+	// existing member.
+	ErrAddrExists = errors.New("member address already exists")
+
+	// ErrMemberNotLearner is returned when promoting a node which is already
+	// a voter.
+	ErrMemberNotLearner = errors.New("member is not a learner")
+)
+
+// Member is a node of the cluster.
+type Member struct {
+	// ID is the Raft server ID of the node.
+	ID string
+
+	// Addr is the Raft address of the node.
+	Addr string
+
+	// Voter is whether the node votes in elections. Other nodes only
+	// replicate the log.
+	Voter bool
+
+	// Meta is the metadata the node registered, such as its API addresses.
+	Meta map[string]string
+}
+
+// ID returns the Raft server ID of this node.
+func (s *Store) ID() string {
+	return s.localID
+}
+
+// Members returns the nodes in the current Raft configuration.
+func (s *Store) Members() ([]Member, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var members []Member
+	for _, srv := range future.Configuration().Servers {
+		members = append(members, Member{
+			ID:    string(srv.ID),
+			Addr:  string(srv.Address),
+			Voter: srv.Suffrage == raft.Voter,
+			Meta:  s.meta[string(srv.ID)],
+		})
+	}
+	return members, nil
+}
+
+// AddMember adds the node, identified by id and located at addr, to the
+// cluster. The node joins as a voter if voter is set, and as a non-voter
+// otherwise.
+func (s *Store) AddMember(id, addr string, voter bool) error {
+	members, err := s.Members()
+	if err != nil {
+		return err
+	}
+	for _, m := range members {
+		if m.Addr == addr {
+			return ErrAddrExists
+		}
+		if m.ID == id {
+			return ErrMemberExists
+		}
+	}
+
+	var future raft.IndexFuture
+	if voter {
+		future = s.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0)
+	} else {
+		future = s.raft.AddNonvoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0)
+	}
+	return raftError(future.Error())
+}
+
+// RemoveMember removes the node from the cluster, along with its metadata.
+func (s *Store) RemoveMember(id string) error {
+	if _, err := s.member(id); err != nil {
+		return err
+	}
+	if err := raftError(s.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()); err != nil {
+		return err
+	}
+	return s.SetMeta(id, nil)
+}
+
+// PromoteMember makes the non-voting node a voter.
+func (s *Store) PromoteMember(id string) error {
+	m, err := s.member(id)
+	if err != nil {
+		return err
+	}
+	if m.Voter {
+		return ErrMemberNotLearner
+	}
+	return raftError(s.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(m.Addr), 0, 0).Error())
+}
+
+// UpdateMember changes the Raft address of the node. Raft has no way of
+// changing an address in place, so the node is removed, and added back at
+// the new address with the same suffrage.
+func (s *Store) UpdateMember(id, addr string) error {
+	m, err := s.member(id)
+	if err != nil {
+		return err
+	}
+	if m.Addr == addr {
+		return nil
+	}
+	if err := raftError(s.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()); err != nil {
+		return err
+	}
+	if m.Voter {
+		return raftError(s.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0).Error())
+	}
+	return raftError(s.raft.AddNonvoter(raft.ServerID(id), raft.ServerAddress(addr), 0, 0).Error())
+}
+
+// member returns the node with the given ID.
+func (s *Store) member(id string) (Member, error) {
+	members, err := s.Members()
+	if err != nil {
+		return Member{}, err
+	}
+	for _, m := range members {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+	return Member{}, ErrMemberNotFound
+}
+
+// SetMeta records the metadata of the node, via distributed consensus. If
+// meta is nil, the metadata of the node is removed.
+func (s *Store) SetMeta(id string, meta map[string]string) error {
+	_, err := s.apply(&command{
+		Op:   "meta",
+		Key:  []byte(id),
+		Meta: meta,
+	})
+	return err
+}
+
+// Meta returns the metadata recorded for the node, or nil if there is none.
+func (s *Store) Meta(id string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.meta[id]
+}
+
+// Term returns the current Raft term of this node.
+func (s *Store) Term() uint64 {
+	term, _ := strconv.ParseUint(s.raft.Stats()["term"], 10, 64)
+	return term
+}
+
+// IsLeader returns whether this node is the leader.
+func (s *Store) IsLeader() bool {
+	return s.raft.State() == raft.Leader
+}
+
+// LeaderHTTPAddr returns the address of the HTTP API of the leader, or an
+// empty string if there is no leader or it did not record the address.
+func (s *Store) LeaderHTTPAddr() string {
+	_, id := s.raft.LeaderWithID()
+	if id == "" {
+		return ""
+	}
+	return s.Meta(string(id))[MetaHTTPAddr]
+}
+
+func (f *fsm) applyMeta(id string, meta map[string]string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if meta == nil {
+		delete(f.meta, id)
+	} else {
+		f.meta[id] = meta
+	}
+	return nil
+}
+
+// register records the metadata of this node, set in Store.NodeMeta before
+// the store was opened, once this node is the leader. Other nodes are expected
+// to send their metadata when joining. It returns once the metadata is
+// recorded, or done is closed.
+func (s *Store) register(meta map[string]string, done <-chan struct{}) {
+	ticker := time.NewTicker(registerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if reflect.DeepEqual(s.Meta(s.localID), meta) {
+				return
+			}
+			if s.raft.State() != raft.Leader {
+				continue
+			}
+			if err := s.SetMeta(s.localID, meta); err != nil {
+				s.logger.Printf("failed to record metadata of node %s: %s", s.localID, err)
+				continue
+			}
+			s.logger.Printf("recorded metadata of node %s", s.localID)
+			return
+		}
+	}
+}
+
+// generateForwardKey generates the forwarding key of the cluster once this
+// node is the leader, unless the key already exists, such as in clusters
+// created before the key was generated up front. It returns once the key is
+// known, or done is closed.
+func (s *Store) generateForwardKey(done <-chan struct{}) {
+	ticker := time.NewTicker(registerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if s.forwardingKey() != nil {
+				return
+			}
+			if s.raft.State() != raft.Leader {
+				continue
+			}
+			if err := s.initForwardKey(); err != nil {
+				s.logger.Printf("failed to generate forwarding key of the cluster: %s", err)
+			}
+		}
+	}
+}
+
+// raftError converts errors returned by Raft to errors of the store.
+func raftError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, raft.ErrNotLeader):
+		return ErrNotLeader
+	default:
+		return fmt.Errorf("raft: %w", err)
+	}
+}
@@ -0,0 +1,359 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Commands are encoded in Raft log entries as a version byte, an op byte,
+// and the fields of the command in the protobuf wire format. Fields are
+// numbered like protobuf fields, so fields can be added to a version
+// without breaking nodes which skip the fields they do not know.
+//
+// Entries written before the binary encoding hold JSON-encoded commands.
+// They always start with '{', which is never a version byte, so they are
+// still applied when logs are replayed.
+const (
+	// commandVersion is the version of the encoding written by this node.
+	commandVersion byte = 1
+
+	// jsonCommand is the first byte of legacy JSON-encoded commands.
+	jsonCommand byte = '{'
+)
+
+// errCommandTooShort is returned when decoding a truncated command.
+var errCommandTooShort = errors.New("command too short")
+
+// ops are the command ops, by op byte. The op byte of a command is its index
+// in ops, so ops are only ever appended.
+var ops = []string{
+	"",
+	"set",
+	"delete",
+	"compact",
+	"lease_grant",
+	"lease_revoke",
+	"meta",
+	"alarm_activate",
+	"alarm_deactivate",
+	"auth",
+	"txn",
+	"batch",
+	"forward_key",
+}
+
+// opCodes are the op bytes, by op.
+var opCodes = func() map[string]byte {
+	m := make(map[string]byte, len(ops))
+	for i, op := range ops[1:] {
+		m[op] = byte(i + 1)
+	}
+	return m
+}()
+
+// Field numbers of commands.
+const (
+	fieldKey protowire.Number = iota + 1
+	fieldValue
+	fieldEnd
+	fieldPrevKV
+	fieldIgnoreValue
+	fieldIgnoreLease
+	fieldLease
+	fieldTTL
+	fieldRevision
+	fieldTxn
+	fieldMeta
+	fieldAuth
+	fieldBatch
+	fieldHasMeta
+)
+
+// Field numbers of metadata entries, the key and the value.
+const (
+	fieldMetaKey protowire.Number = iota + 1
+	fieldMetaValue
+)
+
+// Field numbers of auth commands.
+const (
+	fieldAuthAction protowire.Number = iota + 1
+	fieldAuthUser
+	fieldAuthRole
+	fieldAuthPassword
+	fieldAuthNoPassword
+	fieldAuthPerm
+	fieldAuthSigningKey
+)
+
+// Field numbers of permissions.
+const (
+	fieldPermType protowire.Number = iota + 1
+	fieldPermKey
+	fieldPermEnd
+)
+
+// encodeCommand encodes the command for a Raft log entry.
+func encodeCommand(c *command) ([]byte, error) {
+	op, ok := opCodes[c.Op]
+	if !ok {
+		return nil, fmt.Errorf("unrecognized command op: %s", c.Op)
+	}
+	b := []byte{commandVersion, op}
+	b = appendBytes(b, fieldKey, c.Key)
+	b = appendBytes(b, fieldValue, c.Value)
+	b = appendBytes(b, fieldEnd, c.End)
+	b = appendBool(b, fieldPrevKV, c.PrevKV)
+	b = appendBool(b, fieldIgnoreValue, c.IgnoreValue)
+	b = appendBool(b, fieldIgnoreLease, c.IgnoreLease)
+	b = appendInt(b, fieldLease, c.Lease)
+	b = appendInt(b, fieldTTL, c.TTL)
+	b = appendInt(b, fieldRevision, c.Revision)
+	b = appendBytes(b, fieldTxn, c.Txn)
+	// Empty metadata is distinct from none, which removes the metadata of a
+	// node.
+	b = appendBool(b, fieldHasMeta, c.Meta != nil)
+	for k, v := range c.Meta {
+		var m []byte
+		m = appendString(m, fieldMetaKey, k)
+		m = appendString(m, fieldMetaValue, v)
+		b = protowire.AppendTag(b, fieldMeta, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	if c.Auth != nil {
+		b = protowire.AppendTag(b, fieldAuth, protowire.BytesType)
+		b = protowire.AppendBytes(b, encodeAuthCommand(c.Auth))
+	}
+	for _, e := range c.Batch {
+		b = protowire.AppendTag(b, fieldBatch, protowire.BytesType)
+		b = protowire.AppendBytes(b, e)
+	}
+	return b, nil
+}
+
+// decodeCommand decodes a command from a Raft log entry, in either the
+// binary or the legacy JSON encoding.
+func decodeCommand(b []byte, c *command) error {
+	if len(b) == 0 {
+		return errCommandTooShort
+	}
+	if b[0] == jsonCommand {
+		if err := json.Unmarshal(b, c); err != nil {
+			return err
+		}
+		for _, e := range c.LegacyBatch {
+			c.Batch = append(c.Batch, e)
+		}
+		c.LegacyBatch = nil
+		if c.LegacyKey != "" {
+			c.Key = []byte(c.LegacyKey)
+		}
+		if c.LegacyValue != "" {
+			c.Value = []byte(c.LegacyValue)
+		}
+		if c.LegacyEnd != "" {
+			c.End = []byte(c.LegacyEnd)
+		}
+		c.LegacyKey, c.LegacyValue, c.LegacyEnd = "", "", ""
+		return nil
+	}
+	if b[0] != commandVersion {
+		return fmt.Errorf("unsupported command version %d", b[0])
+	}
+	if len(b) < 2 {
+		return errCommandTooShort
+	}
+	if int(b[1]) == 0 || int(b[1]) >= len(ops) {
+		return fmt.Errorf("unrecognized command op byte: %d", b[1])
+	}
+	c.Op = ops[b[1]]
+
+	var nested error
+	err := consumeFields(b[2:], func(num protowire.Number, v []byte, n uint64) {
+		switch num {
+		case fieldKey:
+			c.Key = append([]byte(nil), v...)
+		case fieldValue:
+			c.Value = append([]byte(nil), v...)
+		case fieldEnd:
+			c.End = append([]byte(nil), v...)
+		case fieldPrevKV:
+			c.PrevKV = n != 0
+		case fieldIgnoreValue:
+			c.IgnoreValue = n != 0
+		case fieldIgnoreLease:
+			c.IgnoreLease = n != 0
+		case fieldLease:
+			c.Lease = int64(n)
+		case fieldTTL:
+			c.TTL = int64(n)
+		case fieldRevision:
+			c.Revision = int64(n)
+		case fieldTxn:
+			c.Txn = append([]byte(nil), v...)
+		case fieldMeta:
+			var k, val string
+			nested = consumeFields(v, func(num protowire.Number, v []byte, _ uint64) {
+				switch num {
+				case fieldMetaKey:
+					k = string(v)
+				case fieldMetaValue:
+					val = string(v)
+				}
+			})
+			if c.Meta == nil {
+				c.Meta = make(map[string]string)
+			}
+			c.Meta[k] = val
+		case fieldAuth:
+			c.Auth, nested = decodeAuthCommand(v)
+		case fieldBatch:
+			c.Batch = append(c.Batch, v)
+		case fieldHasMeta:
+			if c.Meta == nil && n != 0 {
+				c.Meta = make(map[string]string)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return nested
+}
+
+// encodeAuthCommand encodes the fields of an auth command.
+func encodeAuthCommand(a *authCommand) []byte {
+	var b []byte
+	b = appendString(b, fieldAuthAction, a.Action)
+	b = appendString(b, fieldAuthUser, a.User)
+	b = appendString(b, fieldAuthRole, a.Role)
+	b = appendString(b, fieldAuthPassword, a.Password)
+	b = appendBool(b, fieldAuthNoPassword, a.NoPassword)
+	if a.Perm != nil {
+		var p []byte
+		p = appendString(p, fieldPermType, a.Perm.Type)
+		p = appendString(p, fieldPermKey, a.Perm.Key)
+		p = appendString(p, fieldPermEnd, a.Perm.End)
+		b = protowire.AppendTag(b, fieldAuthPerm, protowire.BytesType)
+		b = protowire.AppendBytes(b, p)
+	}
+	if len(a.SigningKey) > 0 {
+		b = protowire.AppendTag(b, fieldAuthSigningKey, protowire.BytesType)
+		b = protowire.AppendBytes(b, a.SigningKey)
+	}
+	return b
+}
+
+// decodeAuthCommand decodes the fields of an auth command.
+func decodeAuthCommand(b []byte) (*authCommand, error) {
+	a := &authCommand{}
+	var nested error
+	err := consumeFields(b, func(num protowire.Number, v []byte, n uint64) {
+		switch num {
+		case fieldAuthAction:
+			a.Action = string(v)
+		case fieldAuthUser:
+			a.User = string(v)
+		case fieldAuthRole:
+			a.Role = string(v)
+		case fieldAuthPassword:
+			a.Password = string(v)
+		case fieldAuthNoPassword:
+			a.NoPassword = n != 0
+		case fieldAuthPerm:
+			p := &Permission{}
+			nested = consumeFields(v, func(num protowire.Number, v []byte, _ uint64) {
+				switch num {
+				case fieldPermType:
+					p.Type = string(v)
+				case fieldPermKey:
+					p.Key = string(v)
+				case fieldPermEnd:
+					p.End = string(v)
+				}
+			})
+			a.Perm = p
+		case fieldAuthSigningKey:
+			a.SigningKey = append([]byte(nil), v...)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nested
+}
+
+// consumeFields calls fn with every field of b, passing the contents of
+// length-delimited fields as v, and the value of varint fields as n. Fields
+// of other types are skipped.
+func consumeFields(b []byte, fn func(num protowire.Number, v []byte, n uint64)) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		switch typ {
+		case protowire.BytesType:
+			v, l := protowire.ConsumeBytes(b)
+			if l < 0 {
+				return protowire.ParseError(l)
+			}
+			fn(num, v, 0)
+			b = b[l:]
+		case protowire.VarintType:
+			n, l := protowire.ConsumeVarint(b)
+			if l < 0 {
+				return protowire.ParseError(l)
+			}
+			fn(num, nil, n)
+			b = b[l:]
+		default:
+			l := protowire.ConsumeFieldValue(num, typ, b)
+			if l < 0 {
+				return protowire.ParseError(l)
+			}
+			b = b[l:]
+		}
+	}
+	return nil
+}
+
+// appendString appends a length-delimited field, unless it is empty.
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendBytes appends a length-delimited field, unless it is empty.
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// appendBool appends a varint field, unless it is false.
+func appendBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, 1)
+}
+
+// appendInt appends a varint field, unless it is zero.
+func appendInt(b []byte, num protowire.Number, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, uint64(v))
+}
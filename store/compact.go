@@ -0,0 +1,200 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Automatic compaction modes.
+const (
+	// CompactionModePeriodic retains the history written during the
+	// retention period, given as a duration.
+	CompactionModePeriodic = "periodic"
+
+	// CompactionModeRevision retains the given number of most recent
+	// revisions.
+	CompactionModeRevision = "revision"
+)
+
+// revisionCompactionInterval is how often the revision compactor checks
+// whether the history should be compacted.
+const revisionCompactionInterval = 5 * time.Minute
+
+// CompactResult is the result of a compaction.
+type CompactResult struct {
+	// Revision is the store revision when the compaction was applied.
+	Revision int64
+}
+
+// Compact discards all history of the key-value store before the given
+// revision, on every node of the cluster. The latest version of each key
+// at or before rev is kept, so that the store can still be read at rev. It
+// returns once the compaction has been applied on this node.
+func (s *Store) Compact(rev int64) (*CompactResult, error) {
+	resp, err := s.apply(&command{
+		Op:       "compact",
+		Revision: rev,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*CompactResult), nil
+}
+
+// CompactRevision returns the revision the store was last compacted at.
+func (s *Store) CompactRevision() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactRev
+}
+
+func (f *fsm) applyCompact(rev int64) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if rev > f.rev {
+		return ErrFutureRev
+	}
+	if rev <= f.compactRev {
+		return ErrCompacted
+	}
+
+	// The index is modified once every key has been visited, as it must
+	// not be modified while iterating.
+	var compacted []kvItem
+	var deleted [][]byte
+	f.kv.Ascend(func(it kvItem) bool {
+		// Find the version of the key visible at rev. Everything older is
+		// no longer reachable.
+		i := len(it.revs) - 1
+		for i >= 0 && it.revs[i].modRev > rev {
+			i--
+		}
+		if i < 0 {
+			return true
+		}
+		if it.revs[i].tombstone {
+			i++
+		}
+		if i == 0 {
+			return true
+		}
+		if i == len(it.revs) {
+			deleted = append(deleted, it.key)
+			return true
+		}
+		it.revs = append([]keyRev(nil), it.revs[i:]...)
+		compacted = append(compacted, it)
+		return true
+	})
+	for _, it := range compacted {
+		f.kv.ReplaceOrInsert(it)
+	}
+	for _, k := range deleted {
+		f.kv.Delete(kvItem{key: k})
+	}
+
+	f.compactRev = rev
+	f.size = indexSize(f.kv)
+	return &CompactResult{Revision: f.rev}
+}
+
+// compactor periodically compacts the history of the store, according to
+// the automatic compaction settings. Only the leader compacts, since the
+// compaction is replicated to the rest of the cluster.
+type compactor struct {
+	s         *Store
+	mode      string
+	period    time.Duration // Retention of periodic mode.
+	retention int64         // Retention of revision mode.
+}
+
+// newCompactor returns a compactor for the given mode and retention. It
+// returns nil if automatic compaction is disabled.
+func newCompactor(s *Store, mode, retention string) (*compactor, error) {
+	c := &compactor{s: s, mode: mode}
+	switch mode {
+	case "":
+		return nil, nil
+	case CompactionModePeriodic:
+		// Like etcd, a bare number is a number of hours.
+		if h, err := strconv.Atoi(retention); err == nil {
+			c.period = time.Duration(h) * time.Hour
+		} else if d, err := time.ParseDuration(retention); err == nil {
+			c.period = d
+		} else {
+			return nil, fmt.Errorf("invalid periodic compaction retention %q", retention)
+		}
+		if c.period <= 0 {
+			return nil, nil
+		}
+	case CompactionModeRevision:
+		n, err := strconv.ParseInt(retention, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid revision compaction retention %q", retention)
+		}
+		if n <= 0 {
+			return nil, nil
+		}
+		c.retention = n
+	default:
+		return nil, fmt.Errorf("unknown compaction mode %q", mode)
+	}
+	return c, nil
+}
+
+// run compacts the store until done is closed.
+func (c *compactor) run(done <-chan struct{}) {
+	interval := revisionCompactionInterval
+	if c.mode == CompactionModePeriodic {
+		// Sample the revision ten times per retention period, so the
+		// retained history is never more than 10% longer than requested.
+		interval = c.period / 10
+		if interval < time.Second {
+			interval = time.Second
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	type sample struct {
+		t   time.Time
+		rev int64
+	}
+	var samples []sample
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			rev := c.s.Revision()
+			var target int64
+			switch c.mode {
+			case CompactionModePeriodic:
+				samples = append(samples, sample{t: now, rev: rev})
+				for len(samples) > 0 && now.Sub(samples[0].t) >= c.period {
+					target = samples[0].rev
+					samples = samples[1:]
+				}
+			case CompactionModeRevision:
+				target = rev - c.retention
+			}
+			c.compact(target)
+		}
+	}
+}
+
+func (c *compactor) compact(rev int64) {
+	if rev <= c.s.CompactRevision() || c.s.raft.State() != raft.Leader {
+		return
+	}
+	if _, err := c.s.Compact(rev); err != nil {
+		c.s.logger.Printf("failed to compact at revision %d: %s", rev, err)
+		return
+	}
+	c.s.logger.Printf("compacted history at revision %d", rev)
+}
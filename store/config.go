@@ -0,0 +1,202 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// Config is the configuration of the Raft node of a store: the timeouts of
+// the consensus protocol, when snapshots are taken and how much of the log
+// they leave, and the connections to the other nodes. Fields left zero take
+// the values of DefaultConfig for the size of the cluster.
+type Config struct {
+	// ClusterSize is the number of voters the cluster is expected to have,
+	// which the defaults of the other fields depend on. 3 if zero.
+	ClusterSize int
+
+	// HeartbeatTimeout is how long a follower goes without contact from the
+	// leader before it starts an election.
+	HeartbeatTimeout time.Duration
+
+	// ElectionTimeout is how long a candidate waits for the votes of a
+	// quorum before it starts another election.
+	ElectionTimeout time.Duration
+
+	// LeaderLeaseTimeout is how long the leader goes without contact from a
+	// quorum before it steps down. It may not exceed HeartbeatTimeout.
+	LeaderLeaseTimeout time.Duration
+
+	// CommitTimeout is how long the leader waits without new entries before
+	// it sends the commit index to the followers.
+	CommitTimeout time.Duration
+
+	// MaxAppendEntries is the number of entries sent to a follower in a
+	// single request, at most 1024.
+	MaxAppendEntries int
+
+	// SnapshotInterval is how often the node checks whether it should take
+	// a snapshot. The checks are spread at random over up to twice as long,
+	// so that the nodes do not take snapshots at the same time.
+	SnapshotInterval time.Duration
+
+	// SnapshotThreshold is the number of entries applied since the last
+	// snapshot above which a snapshot is taken.
+	SnapshotThreshold uint64
+
+	// TrailingLogs is the number of entries left in the log after a snapshot,
+	// so that a follower which fell slightly behind catches up from the log
+	// instead of being sent the snapshot.
+	TrailingLogs uint64
+
+	// RetainSnapshots is the number of snapshots kept on disk.
+	RetainSnapshots int
+
+	// TransportMaxPool is the number of connections kept open to each of the
+	// other nodes.
+	TransportMaxPool int
+
+	// TransportTimeout bounds the I/O of the requests to the other nodes.
+	// Requests to install snapshots are given longer, in proportion to the
+	// size of the snapshot.
+	TransportTimeout time.Duration
+}
+
+// DefaultConfig returns the configuration for a cluster of clusterSize voters.
+// Up to 5 voters, it is the default configuration of Hashicorp's Raft. The
+// leader of a larger cluster spreads its heartbeats and entries over more
+// followers, so the timeouts are longer, not to start elections spuriously
+// under load, requests carry more entries, and more of the log is kept after
+// a snapshot, as followers falling behind are more likely.
+func DefaultConfig(clusterSize int) *Config {
+	if clusterSize <= 0 {
+		clusterSize = 3
+	}
+	c := &Config{
+		ClusterSize:        clusterSize,
+		HeartbeatTimeout:   time.Second,
+		ElectionTimeout:    time.Second,
+		LeaderLeaseTimeout: 500 * time.Millisecond,
+		CommitTimeout:      50 * time.Millisecond,
+		MaxAppendEntries:   64,
+		SnapshotInterval:   120 * time.Second,
+		SnapshotThreshold:  8192,
+		TrailingLogs:       10240,
+		RetainSnapshots:    2,
+		TransportMaxPool:   3,
+		TransportTimeout:   10 * time.Second,
+	}
+	switch {
+	case clusterSize > 15:
+		c.HeartbeatTimeout, c.ElectionTimeout = 2*time.Second, 2*time.Second
+		c.LeaderLeaseTimeout = time.Second
+		c.MaxAppendEntries = 256
+		c.TrailingLogs = 40960
+	case clusterSize > 5:
+		c.HeartbeatTimeout, c.ElectionTimeout = 1500*time.Millisecond, 1500*time.Millisecond
+		c.LeaderLeaseTimeout = 750 * time.Millisecond
+		c.MaxAppendEntries = 128
+		c.TrailingLogs = 20480
+	}
+	return c
+}
+
+// WithDefaults returns the configuration, with the fields left zero set to
+// their defaults for the size of the cluster.
+func (c Config) WithDefaults() Config {
+	d := DefaultConfig(c.ClusterSize)
+	if c.ClusterSize == 0 {
+		c.ClusterSize = d.ClusterSize
+	}
+	if c.HeartbeatTimeout == 0 {
+		c.HeartbeatTimeout = d.HeartbeatTimeout
+	}
+	if c.ElectionTimeout == 0 {
+		c.ElectionTimeout = d.ElectionTimeout
+	}
+	if c.LeaderLeaseTimeout == 0 {
+		c.LeaderLeaseTimeout = d.LeaderLeaseTimeout
+	}
+	if c.CommitTimeout == 0 {
+		c.CommitTimeout = d.CommitTimeout
+	}
+	if c.MaxAppendEntries == 0 {
+		c.MaxAppendEntries = d.MaxAppendEntries
+	}
+	if c.SnapshotInterval == 0 {
+		c.SnapshotInterval = d.SnapshotInterval
+	}
+	if c.SnapshotThreshold == 0 {
+		c.SnapshotThreshold = d.SnapshotThreshold
+	}
+	if c.TrailingLogs == 0 {
+		c.TrailingLogs = d.TrailingLogs
+	}
+	if c.RetainSnapshots == 0 {
+		c.RetainSnapshots = d.RetainSnapshots
+	}
+	if c.TransportMaxPool == 0 {
+		c.TransportMaxPool = d.TransportMaxPool
+	}
+	if c.TransportTimeout == 0 {
+		c.TransportTimeout = d.TransportTimeout
+	}
+	return c
+}
+
+// Validate returns an error if the configuration, with the fields left zero
+// set to their defaults, is not valid.
+func (c *Config) Validate() error {
+	if c.ClusterSize < 0 {
+		return fmt.Errorf("cluster size may not be negative, got %d", c.ClusterSize)
+	}
+	d := c.WithDefaults()
+	for _, t := range []struct {
+		name string
+		v    time.Duration
+		min  time.Duration
+	}{
+		{"heartbeat timeout", d.HeartbeatTimeout, 5 * time.Millisecond},
+		{"election timeout", d.ElectionTimeout, 5 * time.Millisecond},
+		{"leader lease timeout", d.LeaderLeaseTimeout, 5 * time.Millisecond},
+		{"commit timeout", d.CommitTimeout, time.Millisecond},
+		{"snapshot interval", d.SnapshotInterval, 5 * time.Millisecond},
+		{"transport timeout", d.TransportTimeout, time.Millisecond},
+	} {
+		if t.v < t.min {
+			return fmt.Errorf("%s must be at least %s, got %s", t.name, t.min, t.v)
+		}
+	}
+	if d.ElectionTimeout < d.HeartbeatTimeout {
+		return fmt.Errorf("election timeout %s must be at least the heartbeat timeout %s", d.ElectionTimeout, d.HeartbeatTimeout)
+	}
+	if d.LeaderLeaseTimeout > d.HeartbeatTimeout {
+		return fmt.Errorf("leader lease timeout %s may not exceed the heartbeat timeout %s", d.LeaderLeaseTimeout, d.HeartbeatTimeout)
+	}
+	if d.MaxAppendEntries < 1 || d.MaxAppendEntries > 1024 {
+		return fmt.Errorf("max append entries must be between 1 and 1024, got %d", d.MaxAppendEntries)
+	}
+	if d.RetainSnapshots < 1 {
+		return fmt.Errorf("retained snapshots must be at least 1, got %d", d.RetainSnapshots)
+	}
+	if d.TransportMaxPool < 1 {
+		return fmt.Errorf("transport pool size must be at least 1, got %d", d.TransportMaxPool)
+	}
+	return nil
+}
+
+// raftConfig returns the configuration of Hashicorp's Raft for the node.
+func (c *Config) raftConfig(localID string) *raft.Config {
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(localID)
+	config.HeartbeatTimeout = c.HeartbeatTimeout
+	config.ElectionTimeout = c.ElectionTimeout
+	config.LeaderLeaseTimeout = c.LeaderLeaseTimeout
+	config.CommitTimeout = c.CommitTimeout
+	config.MaxAppendEntries = c.MaxAppendEntries
+	config.SnapshotInterval = c.SnapshotInterval
+	config.SnapshotThreshold = c.SnapshotThreshold
+	config.TrailingLogs = c.TrailingLogs
+	return config
+}
@@ -0,0 +1,651 @@
+package store
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// ForwardService is the prefix of the full names of the internal gRPC
+// methods through which nodes make requests to the leader. They are served
+// next to the etcd API of every node, and authenticate themselves, so they
+// must be exempt from the authentication of client requests.
+const ForwardService = "/hraftd.Forward/"
+
+// ForwardMethod is the full name of the internal gRPC method through which
+// followers forward commands to the leader.
+const ForwardMethod = ForwardService + "Apply"
+
+// ReadIndexMethod is the full name of the internal gRPC method through
+// which followers obtain read indexes from the leader, for linearizable
+// reads.
+const ReadIndexMethod = ForwardService + "ReadIndex"
+
+// KeepAliveMethod and TimeToLiveMethod are the full names of the internal
+// gRPC methods through which followers renew leases on the leader, and ask
+// it for their remaining TTL. Only the leader tracks lease deadlines.
+const (
+	KeepAliveMethod  = ForwardService + "KeepAlive"
+	TimeToLiveMethod = ForwardService + "TimeToLive"
+)
+
+// Metadata keys of the requests to the internal methods: the signature of
+// the request, made with the forwarding key of the cluster, and the time and
+// the nonce of the request, which are signed with it.
+const (
+	forwardSignatureKey = "hraftd-forward-signature"
+	forwardTimeKey      = "hraftd-forward-time"
+	forwardNonceKey     = "hraftd-forward-nonce"
+)
+
+const (
+	// forwardKeySize is the size of the forwarding key of the cluster.
+	forwardKeySize = 32
+
+	// forwardNonceSize is the size of the nonces of the requests.
+	forwardNonceSize = 16
+
+	// forwardMaxAge bounds how far the time of a request to the internal
+	// methods may be from the clock of the leader. The nonces of requests
+	// are remembered for as long, so that no request is accepted twice.
+	forwardMaxAge = 30 * time.Second
+)
+
+// errNoForwardKey is returned by requests to the internal methods before the
+// forwarding key of the cluster has been replicated to this node.
+var errNoForwardKey = errors.New("forwarding key of the cluster not yet known")
+
+// forwardable are the ops of the commands which followers forward to the
+// leader. Other commands are only applied on the leader itself.
+var forwardable = map[string]bool{
+	"set":          true,
+	"delete":       true,
+	"txn":          true,
+	"lease_grant":  true,
+	"lease_revoke": true,
+}
+
+// NotLeaderError is returned by writes on nodes other than the leader when
+// forwarding is disabled, and carries the location of the leader. It
+// matches ErrNotLeader with errors.Is.
+type NotLeaderError struct {
+	// Leader is the ID of the leader, or empty if there is no leader.
+	Leader string
+
+	// Meta is the metadata of the leader, such as the address of its etcd
+	// API, if known.
+	Meta map[string]string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return ErrNotLeader.Error()
+	}
+	if addr := e.Meta[MetaEtcdAddr]; addr != "" {
+		return fmt.Sprintf("%s, leader is %s at %s", ErrNotLeader, e.Leader, addr)
+	}
+	return fmt.Sprintf("%s, leader is %s", ErrNotLeader, e.Leader)
+}
+
+func (e *NotLeaderError) Is(target error) bool {
+	return target == ErrNotLeader
+}
+
+// LeaderMeta returns the metadata of the leader, so that packages which do
+// not depend on the store can locate the leader.
+func (e *NotLeaderError) LeaderMeta() map[string]string {
+	return e.Meta
+}
+
+// forwardResponse is the encoded result of a request to the leader, such as
+// a forwarded command.
+type forwardResponse struct {
+	// Result is the result of the command, protobuf-encoded for
+	// transactions and JSON-encoded otherwise.
+	Result []byte `json:"result,omitempty"`
+
+	// Error is the message of the error returned by the command, if any.
+	Error string `json:"error,omitempty"`
+
+	// Index is the index of the command in the Raft log, or the read index.
+	Index uint64 `json:"index,omitempty"`
+}
+
+// forwardErrors are the errors which commands may return, recognized by
+// their message when a forwarded command fails, so that callers can
+// inspect them as if the command had been applied locally.
+var forwardErrors = []error{
+	ErrNotLeader, ErrKeyNotFound, ErrCompacted, ErrFutureRev, ErrEmptyKey,
+	ErrTooManyOps, ErrDuplicateKey, ErrLeaseNotFound, ErrLeaseExists,
+	ErrLeaseTTLTooLarge, ErrNoSpace, ErrRootUserNotExist,
+	ErrRootRoleNotExist, ErrInvalidAuthMgmt, ErrUserEmpty,
+	ErrUserAlreadyExist, ErrUserNotFound, ErrRoleEmpty, ErrRoleAlreadyExist,
+	ErrRoleNotFound, ErrRoleNotGranted, ErrPermissionNotGranted,
+}
+
+// forwarder forwards commands to the leader, over connections to the etcd
+// API addresses of the nodes.
+type forwarder struct {
+	s *Store
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn // Connections, by address.
+
+	nonces *nonceCache // Nonces of the requests served as the leader.
+}
+
+func newForwarder(s *Store) *forwarder {
+	return &forwarder{
+		s:      s,
+		conns:  make(map[string]*grpc.ClientConn),
+		nonces: &nonceCache{seen: make(map[string]time.Time)},
+	}
+}
+
+// forward applies the command on the leader, if forwarding is enabled, and
+// waits until this node has applied it too, so that its result is visible
+// to reads on this node. Otherwise, it returns a NotLeaderError.
+func (f *forwarder) forward(c *command) (interface{}, error) {
+	if !f.s.ForwardWrites || !forwardable[c.Op] {
+		return nil, f.notLeader()
+	}
+	b, err := encodeCommand(c)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.request(ForwardMethod, b)
+	if err != nil {
+		return nil, err
+	}
+	result, err := decodeResult(c.Op, resp.Result)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.s.waitApplied(resp.Index, raftTimeout); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// readIndex returns a read index obtained from the leader, which confirms
+// its leadership first.
+func (f *forwarder) readIndex() (uint64, error) {
+	resp, err := f.request(ReadIndexMethod, nil)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Index, nil
+}
+
+// keepAlive renews the lease on the leader, which tracks the deadlines of
+// the leases, and returns its TTL.
+func (f *forwarder) keepAlive(id int64) (int64, error) {
+	var ttl int64
+	if err := f.requestJSON(KeepAliveMethod, leaseRequest{ID: id}, &ttl); err != nil {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+// timeToLive returns information about the lease from the leader, which
+// knows its remaining TTL.
+func (f *forwarder) timeToLive(id int64, keys bool) (*LeaseInfo, error) {
+	info := new(LeaseInfo)
+	if err := f.requestJSON(TimeToLiveMethod, leaseRequest{ID: id, Keys: keys}, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// requestJSON makes a JSON-encoded request to the internal method of the
+// leader, and decodes the result of the response into result.
+func (f *forwarder) requestJSON(method string, req, result interface{}) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := f.request(method, b)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// request makes a request to the internal method of the leader, and returns
+// the response. It returns a NotLeaderError if the leader cannot be reached,
+// or is no longer the leader, and the error of the response if any.
+func (f *forwarder) request(method string, b []byte) (*forwardResponse, error) {
+	_, id := f.s.raft.LeaderWithID()
+	if id == "" {
+		return nil, ErrNotLeader
+	}
+	leader := string(id)
+	meta := f.s.Meta(leader)
+	addr := meta[MetaEtcdAddr]
+	if addr == "" {
+		return nil, &NotLeaderError{Leader: leader, Meta: meta}
+	}
+
+	out, err := f.invoke(addr, method, b)
+	if err != nil {
+		if status.Code(err) == codes.Unavailable {
+			return nil, &NotLeaderError{Leader: leader, Meta: meta}
+		}
+		return nil, fmt.Errorf("request to leader %s: %w", leader, err)
+	}
+	var resp forwardResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, forwardError(resp.Error)
+	}
+	return &resp, nil
+}
+
+// notLeader returns the error of requests which must be made to the leader,
+// carrying its location if known.
+func (f *forwarder) notLeader() error {
+	_, id := f.s.raft.LeaderWithID()
+	if id == "" {
+		return ErrNotLeader
+	}
+	return &NotLeaderError{Leader: string(id), Meta: f.s.Meta(string(id))}
+}
+
+// invoke makes a request to the internal method of the node at addr, signed
+// with the forwarding key of the cluster, and returns the response.
+func (f *forwarder) invoke(addr, method string, b []byte) ([]byte, error) {
+	key := f.s.forwardingKey()
+	if key == nil {
+		return nil, errNoForwardKey
+	}
+	nonce := make([]byte, forwardNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	conn, err := f.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), raftTimeout)
+	defer cancel()
+	ts, n := strconv.FormatInt(time.Now().UnixNano(), 10), hex.EncodeToString(nonce)
+	ctx = metadata.AppendToOutgoingContext(ctx,
+		forwardTimeKey, ts,
+		forwardNonceKey, n,
+		forwardSignatureKey, forwardSignature(key, method, ts, n, b))
+
+	out := new(wrapperspb.BytesValue)
+	if err := conn.Invoke(ctx, method, wrapperspb.Bytes(b), out); err != nil {
+		return nil, err
+	}
+	return out.Value, nil
+}
+
+// conn returns a connection to the address.
+func (f *forwarder) conn(addr string) (*grpc.ClientConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if conn := f.conns[addr]; conn != nil {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, err
+	}
+	f.conns[addr] = conn
+	return conn, nil
+}
+
+// close closes every connection.
+func (f *forwarder) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for addr, conn := range f.conns {
+		conn.Close()
+		delete(f.conns, addr)
+	}
+}
+
+// RegisterForwardServer registers the internal service through which
+// followers make requests to the leader with the gRPC server.
+func (s *Store) RegisterForwardServer(srv *grpc.Server) {
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "hraftd.Forward",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			s.forwardMethod("Apply", s.applyForwarded),
+			s.forwardMethod("ReadIndex", s.readIndexForwarded),
+			s.forwardMethod("KeepAlive", s.keepAliveForwarded),
+			s.forwardMethod("TimeToLive", s.timeToLiveForwarded),
+		},
+	}, s)
+}
+
+// forwardMethod returns the internal method with the given name, which
+// checks the signature of every request before handing it to fn.
+func (s *Store) forwardMethod(name string, fn func(b []byte) (*wrapperspb.BytesValue, error)) grpc.MethodDesc {
+	method := ForwardService + name
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(_ interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+			in := new(wrapperspb.BytesValue)
+			if err := dec(in); err != nil {
+				return nil, err
+			}
+			if err := s.checkSignature(ctx, method, in.Value); err != nil {
+				return nil, err
+			}
+			return fn(in.Value)
+		},
+	}
+}
+
+// checkSignature returns an error unless the request to the internal method
+// is signed with the forwarding key of the cluster, which only its members
+// know, and is recent and not a replay of an earlier request. Requests are
+// rejected until the key has been replicated to this node.
+func (s *Store) checkSignature(ctx context.Context, method string, b []byte) error {
+	key := s.forwardingKey()
+	if key == nil {
+		return status.Error(codes.Unavailable, errNoForwardKey.Error())
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	ts, nonce, sig := md.Get(forwardTimeKey), md.Get(forwardNonceKey), md.Get(forwardSignatureKey)
+	if len(ts) == 0 || len(nonce) == 0 || len(sig) == 0 ||
+		!hmac.Equal([]byte(sig[0]), []byte(forwardSignature(key, method, ts[0], nonce[0], b))) {
+		return status.Error(codes.PermissionDenied, "invalid forward signature")
+	}
+	n, err := strconv.ParseInt(ts[0], 10, 64)
+	if err != nil {
+		return status.Error(codes.PermissionDenied, "invalid forward time")
+	}
+	t := time.Unix(0, n)
+	if age := time.Since(t); age > forwardMaxAge || age < -forwardMaxAge {
+		return status.Error(codes.PermissionDenied, "forward request expired")
+	}
+	if !s.forwarder.nonces.add(nonce[0], t.Add(forwardMaxAge)) {
+		return status.Error(codes.PermissionDenied, "forward request replayed")
+	}
+	return nil
+}
+
+// nonceCache remembers the nonces of the requests to the internal methods
+// until their time is too old for them to be accepted anyway.
+type nonceCache struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time // The expiry of the nonces, by nonce.
+	pruned time.Time            // When expired nonces were last removed.
+}
+
+// add records the nonce, which expires at the given time, and returns
+// whether it was not already recorded.
+func (c *nonceCache) add(nonce string, expiry time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.pruned) >= forwardMaxAge {
+		for n, e := range c.seen {
+			if now.After(e) {
+				delete(c.seen, n)
+			}
+		}
+		c.pruned = now
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = expiry
+	return true
+}
+
+// forwardingKey returns the key signing the requests nodes make to the
+// leader, or nil until it has been generated by the leader and replicated
+// to this node. Unlike the key signing authentication tokens, it is never
+// sent to clients.
+func (s *Store) forwardingKey() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.forwardKey
+}
+
+// initForwardKey generates the forwarding key of the cluster, unless it has
+// already been generated. Only the leader may generate the key.
+func (s *Store) initForwardKey() error {
+	if s.forwardingKey() != nil {
+		return nil
+	}
+	key := make([]byte, forwardKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	_, err := s.apply(&command{Op: "forward_key", Value: key})
+	return err
+}
+
+func (f *fsm) applyForwardKey(key []byte) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The first key wins.
+	if f.forwardKey == nil && len(key) > 0 {
+		f.forwardKey = key
+	}
+	return nil
+}
+
+// applyForwarded applies a command forwarded by a follower. Commands are
+// never forwarded twice: if this node is no longer the leader, the follower
+// is told to try again.
+func (s *Store) applyForwarded(b []byte) (*wrapperspb.BytesValue, error) {
+	var c command
+	if err := decodeCommand(b, &c); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if !forwardable[c.Op] {
+		return nil, status.Errorf(codes.InvalidArgument, "command %s may not be forwarded", c.Op)
+	}
+
+	// The command is checked again, as the leader must never append an
+	// entry which the FSM cannot apply.
+	if err := checkCommand(&c); err != nil {
+		return forwardReply(nil, 0, err)
+	}
+	result, index, err := s.applyLocal(&c)
+	if err != nil {
+		return forwardReply(nil, index, err)
+	}
+	b, err = encodeResult(result)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return forwardReply(b, index, nil)
+}
+
+// readIndexForwarded returns a read index to a follower, once the leadership
+// of this node has been confirmed.
+func (s *Store) readIndexForwarded([]byte) (*wrapperspb.BytesValue, error) {
+	if s.raft.State() != raft.Leader {
+		return nil, status.Error(codes.Unavailable, ErrNotLeader.Error())
+	}
+	index, err := s.readIndex()
+	return forwardReply(nil, index, err)
+}
+
+// leaseRequest is a request of a follower about a lease.
+type leaseRequest struct {
+	ID   int64 `json:"id"`
+	Keys bool  `json:"keys,omitempty"`
+}
+
+// keepAliveForwarded renews a lease kept alive through a follower.
+func (s *Store) keepAliveForwarded(b []byte) (*wrapperspb.BytesValue, error) {
+	var req leaseRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	ttl, err := s.lessor.renew(req.ID)
+	if err != nil {
+		return forwardReply(nil, 0, err)
+	}
+	return forwardReplyJSON(ttl)
+}
+
+// timeToLiveForwarded returns information about a lease to a follower.
+func (s *Store) timeToLiveForwarded(b []byte) (*wrapperspb.BytesValue, error) {
+	var req leaseRequest
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if s.raft.State() != raft.Leader {
+		return nil, status.Error(codes.Unavailable, ErrNotLeader.Error())
+	}
+	info, err := s.leaseInfo(req.ID, req.Keys)
+	if err != nil {
+		return forwardReply(nil, 0, err)
+	}
+	return forwardReplyJSON(info)
+}
+
+// forwardReply returns the response to a request of a follower, with the
+// encoded result, the index and the error of the request. Errors caused by
+// this node not being the leader are returned as Unavailable instead, so
+// that the follower reports the request was not made.
+func forwardReply(result []byte, index uint64, err error) (*wrapperspb.BytesValue, error) {
+	if errors.Is(err, ErrNotLeader) || errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	resp := forwardResponse{Result: result, Index: index}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return wrapperspb.Bytes(out), nil
+}
+
+// forwardReplyJSON returns the response to a request of a follower, with
+// the JSON-encoded result.
+func forwardReplyJSON(result interface{}) (*wrapperspb.BytesValue, error) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return forwardReply(b, 0, nil)
+}
+
+// checkCommand returns an error if the FSM could not apply the command:
+// keys must be provided, and transactions and batches must decode to valid
+// requests and commands.
+func checkCommand(c *command) error {
+	switch c.Op {
+	case "set", "delete":
+		if len(c.Key) == 0 {
+			return ErrEmptyKey
+		}
+	case "txn":
+		var req pb.TxnRequest
+		if err := req.Unmarshal(c.Txn); err != nil {
+			return fmt.Errorf("invalid txn: %w", err)
+		}
+		return checkTxn(&req)
+	case "batch":
+		for _, b := range c.Batch {
+			var bc command
+			if err := decodeCommand(b, &bc); err != nil {
+				return fmt.Errorf("invalid batched command: %w", err)
+			}
+			if !batchable(bc.Op) {
+				return fmt.Errorf("command %s may not be batched", bc.Op)
+			}
+			if err := checkCommand(&bc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// encodeResult encodes the result of a command.
+func encodeResult(result interface{}) ([]byte, error) {
+	switch r := result.(type) {
+	case nil:
+		return nil, nil
+	case *pb.TxnResponse:
+		return r.Marshal()
+	default:
+		return json.Marshal(r)
+	}
+}
+
+// decodeResult decodes the result of a command with the given op.
+func decodeResult(op string, b []byte) (interface{}, error) {
+	var result interface{}
+	switch op {
+	case "set":
+		result = new(PutResult)
+	case "delete":
+		result = new(DeleteResult)
+	case "compact":
+		result = new(CompactResult)
+	case "lease_grant":
+		result = new(LeaseGrantResult)
+	case "lease_revoke":
+		result = new(LeaseRevokeResult)
+	case "txn":
+		r := new(pb.TxnResponse)
+		if err := r.Unmarshal(b); err != nil {
+			return nil, err
+		}
+		return r, nil
+	default:
+		return nil, nil
+	}
+	if err := json.Unmarshal(b, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// forwardError returns the error with the given message.
+func forwardError(msg string) error {
+	for _, err := range forwardErrors {
+		if err.Error() == msg {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+// forwardSignature returns the signature of a request to the internal
+// method, made at time ts with the given nonce. The method is signed too, so
+// that a request to one method cannot be replayed to another.
+func forwardSignature(key []byte, method, ts, nonce string, b []byte) string {
+	h := hmac.New(sha256.New, key)
+	for _, f := range []string{method, ts, nonce} {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
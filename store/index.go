@@ -0,0 +1,192 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/google/btree"
+)
+
+// indexDegree is the degree of the B-tree backing the key-value index.
+const indexDegree = 32
+
+var (
+	// ErrKeyNotFound is returned when a key which must exist does not.
+	ErrKeyNotFound = errors.New("key not found")
+
+	// ErrCompacted is returned when the requested revision has been compacted.
+	ErrCompacted = errors.New("required revision has been compacted")
+
+	// ErrFutureRev is returned when the requested revision is ahead of the
+	// current revision of the store.
+	ErrFutureRev = errors.New("required revision is a future revision")
+)
+
+// keyRev is a single revision of a key.
+type keyRev struct {
+	value     []byte
+	createRev int64 // Revision at which the key was created.
+	modRev    int64 // Revision of this modification to the key.
+	version   int64 // Number of modifications since the key was created.
+	lease     int64 // Lease the key is attached to, or zero.
+	tombstone bool  // Whether this revision deleted the key.
+}
+
+// kvItem is a single entry in the ordered key index. It holds the history of
+// the key, ordered by modification revision.
+type kvItem struct {
+	key  []byte
+	revs []keyRev
+}
+
+func kvItemLess(a, b kvItem) bool {
+	return bytes.Compare(a.key, b.key) < 0
+}
+
+// kvIndex is the ordered key index of the store, holding the history of
+// every key. It is a B-tree in memory, or a bbolt file with FSMBackendBolt.
+// Items must not be inserted or deleted while iterating.
+type kvIndex interface {
+	Get(key kvItem) (kvItem, bool)
+	ReplaceOrInsert(item kvItem) (kvItem, bool)
+	Delete(item kvItem) (kvItem, bool)
+	Ascend(fn btree.ItemIteratorG[kvItem])
+	AscendGreaterOrEqual(pivot kvItem, fn btree.ItemIteratorG[kvItem])
+	AscendRange(greaterOrEqual, lessThan kvItem, fn btree.ItemIteratorG[kvItem])
+}
+
+// newIndex returns an empty ordered key index.
+func newIndex() *btree.BTreeG[kvItem] {
+	return btree.NewG(indexDegree, kvItemLess)
+}
+
+// latest returns the most recent revision of the key, and whether the key
+// currently exists.
+func (it kvItem) latest() (keyRev, bool) {
+	if len(it.revs) == 0 {
+		return keyRev{}, false
+	}
+	r := it.revs[len(it.revs)-1]
+	return r, !r.tombstone
+}
+
+// at returns the revision of the key visible at store revision rev, and
+// whether the key existed at that revision.
+func (it kvItem) at(rev int64) (keyRev, bool) {
+	for i := len(it.revs) - 1; i >= 0; i-- {
+		if r := it.revs[i]; r.modRev <= rev {
+			return r, !r.tombstone
+		}
+	}
+	return keyRev{}, false
+}
+
+// keyValue converts a revision of the key to its exported representation.
+// The key and the value are copied, so that callers may modify them.
+func (it kvItem) keyValue(r keyRev) KeyValue {
+	return KeyValue{
+		Key:            bytes.Clone(it.key),
+		Value:          bytes.Clone(r.value),
+		CreateRevision: r.createRev,
+		ModRevision:    r.modRev,
+		Version:        r.version,
+		Lease:          r.lease,
+	}
+}
+
+// KeyValue is a key-value pair returned by range queries, along with its
+// MVCC revision information. Keys and values are arbitrary bytes.
+type KeyValue struct {
+	Key   []byte
+	Value []byte
+
+	// CreateRevision is the revision of the last creation of the key.
+	CreateRevision int64
+	// ModRevision is the revision of the last modification of the key.
+	ModRevision int64
+	// Version is the number of modifications of the key since its creation.
+	// A deletion resets the version to zero.
+	Version int64
+	// Lease is the ID of the lease the key is attached to, or zero.
+	Lease int64
+}
+
+// RangeResult is the result of a range query.
+type RangeResult struct {
+	// KVs are the matching key-value pairs, sorted by key. At most limit
+	// pairs are returned.
+	KVs []KeyValue
+
+	// Count is the total number of keys in the range, regardless of limit.
+	Count int
+
+	// Revision is the current store revision. It is not the revision the
+	// range was read at, which may be older.
+	Revision int64
+}
+
+// PutOptions are the optional settings of a put.
+type PutOptions struct {
+	// PrevKV requests the key-value pair as it was before the put.
+	PrevKV bool
+
+	// IgnoreValue keeps the current value of the key. The key must exist.
+	IgnoreValue bool
+
+	// IgnoreLease keeps the current lease of the key. The key must exist.
+	IgnoreLease bool
+
+	// Lease attaches the key to the lease with this ID, which must exist.
+	// If zero, the key is detached from any lease.
+	Lease int64
+}
+
+// PutResult is the result of a put.
+type PutResult struct {
+	// Revision is the store revision after the put.
+	Revision int64
+
+	// PrevKV is the key-value pair before the put, if requested and the key
+	// existed.
+	PrevKV *KeyValue
+}
+
+// DeleteResult is the result of a delete.
+type DeleteResult struct {
+	// Revision is the store revision after the delete.
+	Revision int64
+
+	// Deleted is the number of keys deleted.
+	Deleted int64
+
+	// PrevKVs are the deleted key-value pairs, if requested.
+	PrevKVs []KeyValue
+}
+
+// ascendRange calls fn, in key order, for every item in the range described
+// by start and end, using etcd range semantics:
+//
+//   - end is empty: only the key start itself.
+//   - end is "\x00": every key greater than or equal to start.
+//   - otherwise: every key in [start, end).
+//
+// Items are visited regardless of whether the key currently exists. Iteration
+// stops when fn returns false.
+func ascendRange(t kvIndex, start, end []byte, fn func(kvItem) bool) {
+	switch {
+	case len(end) == 0:
+		if it, ok := t.Get(kvItem{key: start}); ok {
+			fn(it)
+		}
+	case isRangeEnd(end):
+		t.AscendGreaterOrEqual(kvItem{key: start}, fn)
+	case bytes.Compare(start, end) < 0:
+		t.AscendRange(kvItem{key: start}, kvItem{key: end}, fn)
+	}
+}
+
+// isRangeEnd returns whether end is "\x00", which ends a range at the end of
+// the keyspace.
+func isRangeEnd(end []byte) bool {
+	return len(end) == 1 && end[0] == 0
+}
@@ -0,0 +1,404 @@
+package store
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// MinLeaseTTL is the minimum TTL of a lease, in seconds. Shorter TTLs are
+	// raised to it, so that a lease outlives a leader election.
+	MinLeaseTTL = 2
+
+	// MaxLeaseTTL is the maximum TTL of a lease, in seconds.
+	MaxLeaseTTL = 9000000000
+
+	// leaseCheckInterval is how often the leader looks for expired leases.
+	leaseCheckInterval = 500 * time.Millisecond
+)
+
+var (
+	// ErrLeaseNotFound is returned when the requested lease does not exist.
+	ErrLeaseNotFound = errors.New("requested lease not found")
+
+	// ErrLeaseExists is returned when granting a lease with the ID of an
+	// existing lease.
+	ErrLeaseExists = errors.New("lease already exists")
+
+	// ErrLeaseTTLTooLarge is returned when the requested TTL is above
+	// MaxLeaseTTL.
+	ErrLeaseTTLTooLarge = errors.New("too large lease TTL")
+)
+
+// lease is a lease granted in the key-value store.
+type lease struct {
+	id   int64
+	ttl  int64               // Granted TTL, in seconds.
+	keys map[string]struct{} // Keys attached to the lease.
+}
+
+func newLease(id, ttl int64) *lease {
+	return &lease{id: id, ttl: ttl, keys: make(map[string]struct{})}
+}
+
+// LeaseGrantResult is the result of granting a lease.
+type LeaseGrantResult struct {
+	ID  int64
+	TTL int64
+
+	// Revision is the store revision when the lease was granted.
+	Revision int64
+}
+
+// LeaseRevokeResult is the result of revoking a lease.
+type LeaseRevokeResult struct {
+	// Revision is the store revision after the attached keys were deleted.
+	Revision int64
+}
+
+// LeaseInfo describes a lease.
+type LeaseInfo struct {
+	ID int64
+
+	// GrantedTTL is the TTL the lease was granted with, in seconds.
+	GrantedTTL int64
+
+	// TTL is the remaining TTL of the lease, in seconds.
+	TTL int64
+
+	// Keys are the keys attached to the lease, sorted, if requested.
+	Keys [][]byte
+}
+
+// Grant grants a lease with the given TTL in seconds. If id is zero, an ID
+// is chosen by the store. Keys attached to the lease are deleted when the
+// lease is revoked, or expires after not being kept alive for the TTL.
+func (s *Store) Grant(id, ttl int64) (*LeaseGrantResult, error) {
+	if ttl > MaxLeaseTTL {
+		return nil, ErrLeaseTTLTooLarge
+	}
+	if ttl < MinLeaseTTL {
+		ttl = MinLeaseTTL
+	}
+	if err := s.checkQuota(); err != nil {
+		return nil, err
+	}
+
+	auto := id == 0
+	for {
+		if auto {
+			id = rand.Int63()
+		}
+		resp, err := s.apply(&command{
+			Op:    "lease_grant",
+			Lease: id,
+			TTL:   ttl,
+		})
+		if err == ErrLeaseExists && auto {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return resp.(*LeaseGrantResult), nil
+	}
+}
+
+// Revoke revokes the lease, deleting every key attached to it.
+func (s *Store) Revoke(id int64) (*LeaseRevokeResult, error) {
+	resp, err := s.apply(&command{
+		Op:    "lease_revoke",
+		Lease: id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*LeaseRevokeResult), nil
+}
+
+// KeepAlive renews the lease, and returns its TTL in seconds. Only the
+// leader tracks lease deadlines, so other nodes renew the lease on the
+// leader.
+func (s *Store) KeepAlive(id int64) (int64, error) {
+	if s.raft.State() != raft.Leader {
+		return s.forwarder.keepAlive(id)
+	}
+	return s.lessor.renew(id)
+}
+
+// TimeToLive returns information about the lease, including the attached
+// keys if keys is set. Only the leader tracks lease deadlines, so other
+// nodes ask the leader.
+func (s *Store) TimeToLive(id int64, keys bool) (*LeaseInfo, error) {
+	if s.raft.State() != raft.Leader {
+		return s.forwarder.timeToLive(id, keys)
+	}
+	return s.leaseInfo(id, keys)
+}
+
+// leaseInfo returns information about the lease as known to this node. The
+// remaining TTL is only known while this node tracks lease deadlines, and is
+// the granted TTL otherwise.
+func (s *Store) leaseInfo(id int64, keys bool) (*LeaseInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := s.leases[id]
+	if l == nil {
+		return nil, ErrLeaseNotFound
+	}
+	info := &LeaseInfo{ID: id, GrantedTTL: l.ttl, TTL: l.ttl}
+	if remaining, ok := s.lessor.remaining(id); ok {
+		info.TTL = remaining
+	}
+	if keys {
+		ks := make([]string, 0, len(l.keys))
+		for k := range l.keys {
+			ks = append(ks, k)
+		}
+		sort.Strings(ks)
+		for _, k := range ks {
+			info.Keys = append(info.Keys, []byte(k))
+		}
+	}
+	return info, nil
+}
+
+// Leases returns the IDs of all granted leases, sorted.
+func (s *Store) Leases() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]int64, 0, len(s.leases))
+	for id := range s.leases {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func (f *fsm) applyLeaseGrant(id, ttl int64) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.noSpace() {
+		return ErrNoSpace
+	}
+	if f.leases[id] != nil {
+		return ErrLeaseExists
+	}
+	f.leases[id] = newLease(id, ttl)
+	f.lessor.grant(id, ttl)
+	return &LeaseGrantResult{ID: id, TTL: ttl, Revision: f.rev}
+}
+
+func (f *fsm) applyLeaseRevoke(id int64) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	l := f.leases[id]
+	if l == nil {
+		return ErrLeaseNotFound
+	}
+
+	// Delete the attached keys in key order, so that every node emits the
+	// same events. All keys are deleted at a single revision.
+	keys := make([]string, 0, len(l.keys))
+	for k := range l.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f.del([]byte(k), f.rev+1)
+	}
+	if len(keys) > 0 {
+		f.rev++
+	}
+
+	delete(f.leases, id)
+	f.lessor.revoke(id)
+	return &LeaseRevokeResult{Revision: f.rev}
+}
+
+// attach attaches the key to the lease, if any. The caller must hold the lock.
+func (f *fsm) attach(key []byte, id int64) {
+	if l := f.leases[id]; l != nil {
+		l.keys[string(key)] = struct{}{}
+	}
+}
+
+// detach detaches the key from the lease, if any. The caller must hold the
+// lock.
+func (f *fsm) detach(key []byte, id int64) {
+	if l := f.leases[id]; l != nil {
+		delete(l.keys, string(key))
+	}
+}
+
+// lessor tracks the deadlines of the leases while this node is the leader,
+// and revokes the leases which expire. Deadlines are not replicated: a new
+// leader extends every lease by its full TTL, so that a lease never expires
+// early because of a leader change.
+type lessor struct {
+	s *Store
+
+	mu        sync.Mutex
+	primary   bool                // Whether this node is tracking deadlines.
+	deadlines map[int64]time.Time // Deadlines of the leases, while primary.
+	ttls      map[int64]int64     // TTLs of the leases, while primary.
+}
+
+func newLessor(s *Store) *lessor {
+	return &lessor{s: s}
+}
+
+// run tracks leadership changes and revokes expired leases until done is
+// closed.
+func (l *lessor) run(done <-chan struct{}) {
+	ticker := time.NewTicker(leaseCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			leader := l.s.raft.State() == raft.Leader
+			l.mu.Lock()
+			primary := l.primary
+			l.mu.Unlock()
+
+			switch {
+			case leader && !primary:
+				// Apply every committed entry first, so that all leases
+				// granted by the previous leader are known.
+				if err := l.s.raft.Barrier(raftTimeout).Error(); err != nil {
+					continue
+				}
+				l.promote()
+			case !leader && primary:
+				l.demote()
+			case leader:
+				l.expire()
+			}
+		}
+	}
+}
+
+// promote starts tracking the deadlines of all leases, which are set to a
+// full TTL from now.
+func (l *lessor) promote() {
+	l.s.mu.Lock()
+	defer l.s.mu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.primary = true
+	l.reset(l.s.leases)
+	l.s.logger.Printf("tracking deadlines of %d leases", len(l.s.leases))
+}
+
+// demote stops tracking lease deadlines.
+func (l *lessor) demote() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.primary = false
+	l.deadlines, l.ttls = nil, nil
+}
+
+// reset sets the deadlines of the leases to a full TTL from now. The caller
+// must hold the lessor lock.
+func (l *lessor) reset(leases map[int64]*lease) {
+	now := time.Now()
+	l.deadlines = make(map[int64]time.Time, len(leases))
+	l.ttls = make(map[int64]int64, len(leases))
+	for id, ls := range leases {
+		l.deadlines[id] = now.Add(time.Duration(ls.ttl) * time.Second)
+		l.ttls[id] = ls.ttl
+	}
+}
+
+// restore replaces the tracked leases after the store was restored from a
+// snapshot.
+func (l *lessor) restore(leases map[int64]*lease) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.primary {
+		l.reset(leases)
+	}
+}
+
+// grant starts tracking a newly granted lease.
+func (l *lessor) grant(id, ttl int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.primary {
+		l.deadlines[id] = time.Now().Add(time.Duration(ttl) * time.Second)
+		l.ttls[id] = ttl
+	}
+}
+
+// revoke stops tracking a revoked lease.
+func (l *lessor) revoke(id int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.deadlines, id)
+	delete(l.ttls, id)
+}
+
+// renew extends the deadline of the lease by its TTL, and returns the TTL.
+func (l *lessor) renew(id int64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.primary {
+		return 0, ErrNotLeader
+	}
+	ttl, ok := l.ttls[id]
+	if !ok {
+		return 0, ErrLeaseNotFound
+	}
+	l.deadlines[id] = time.Now().Add(time.Duration(ttl) * time.Second)
+	return ttl, nil
+}
+
+// remaining returns the remaining TTL of the lease in seconds, if its
+// deadline is tracked.
+func (l *lessor) remaining(id int64) (int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d, ok := l.deadlines[id]
+	if !ok {
+		return 0, false
+	}
+	r := int64(time.Until(d).Round(time.Second) / time.Second)
+	if r < 0 {
+		r = 0
+	}
+	return r, true
+}
+
+// expire revokes every lease past its deadline, via Raft.
+func (l *lessor) expire() {
+	now := time.Now()
+	var expired []int64
+	l.mu.Lock()
+	for id, d := range l.deadlines {
+		if now.After(d) {
+			expired = append(expired, id)
+		}
+	}
+	l.mu.Unlock()
+
+	for _, id := range expired {
+		if _, err := l.s.Revoke(id); err != nil && err != ErrLeaseNotFound {
+			l.s.logger.Printf("failed to revoke expired lease %x: %s", id, err)
+			continue
+		}
+		l.s.logger.Printf("revoked expired lease %x", id)
+	}
+}
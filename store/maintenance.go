@@ -0,0 +1,349 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/hashicorp/raft"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// Alarm types.
+const (
+	// AlarmNoSpace is raised when the keyspace grows above the quota. Writes
+	// are rejected until it is deactivated.
+	AlarmNoSpace = "NOSPACE"
+
+	// AlarmCorrupt is raised when the keyspace of a node is found to differ
+	// from the rest of the cluster.
+	AlarmCorrupt = "CORRUPT"
+)
+
+// revOverhead is the approximate number of bytes taken by a revision of a
+// key, besides its key and value.
+const revOverhead = 48
+
+// ErrNoSpace is returned for writes while the NOSPACE alarm is active.
+var ErrNoSpace = errors.New("database space exceeded")
+
+// Alarm is an alarm raised on a node.
+type Alarm struct {
+	Node string `json:"node"`
+	Type string `json:"type"`
+}
+
+// Status is the status of this node.
+type Status struct {
+	// Leader is the ID of the node this node believes is the leader, or
+	// empty if there is no leader.
+	Leader string
+
+	// Voter is whether this node votes in elections.
+	Voter bool
+
+	Term         uint64
+	CommitIndex  uint64
+	AppliedIndex uint64
+
+	// DBSize is the size of the Raft directory on disk, or of the keyspace
+	// for an in-memory store.
+	DBSize int64
+
+	// DBSizeInUse is the approximate size of the keyspace, including its
+	// history.
+	DBSizeInUse int64
+
+	// Alarms are the active alarms of the cluster.
+	Alarms []Alarm
+}
+
+// HashResult is the result of hashing the keyspace.
+type HashResult struct {
+	// Hash is the hash of every revision of every key up to Revision.
+	Hash uint32
+
+	// Revision is the revision the keyspace was hashed at.
+	Revision int64
+
+	// CompactRevision is the revision the history was compacted at.
+	CompactRevision int64
+}
+
+// Status returns the status of this node.
+func (s *Store) Status() (*Status, error) {
+	future := s.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	st := &Status{
+		CommitIndex:  s.raft.CommitIndex(),
+		AppliedIndex: s.raft.AppliedIndex(),
+	}
+	_, leader := s.raft.LeaderWithID()
+	st.Leader = string(leader)
+	st.Term = s.Term()
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID == raft.ServerID(s.localID) {
+			st.Voter = srv.Suffrage == raft.Voter
+		}
+	}
+
+	s.mu.Lock()
+	st.DBSizeInUse = s.size
+	st.Alarms = append(st.Alarms, s.alarms...)
+	s.mu.Unlock()
+
+	st.DBSize = st.DBSizeInUse
+	if !s.inmem {
+		st.DBSize = dirSize(s.RaftDir)
+	}
+	return st, nil
+}
+
+// HashKV hashes every revision of every key up to rev, or up to the current
+// revision if rev is zero. Nodes which applied the same log hash to the same
+// value, so comparing hashes detects diverging replicas.
+func (s *Store) HashKV(rev int64) (*HashResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rev == 0 {
+		rev = s.rev
+	}
+	if rev > s.rev {
+		return nil, ErrFutureRev
+	} else if rev < s.compactRev {
+		return nil, ErrCompacted
+	}
+
+	h := crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	var buf [8]byte
+	writeInt := func(v int64) {
+		binary.BigEndian.PutUint64(buf[:], uint64(v))
+		h.Write(buf[:])
+	}
+	s.kv.Ascend(func(it kvItem) bool {
+		for _, r := range it.revs {
+			if r.modRev > rev {
+				break
+			}
+			h.Write([]byte(it.key))
+			writeInt(r.modRev)
+			writeInt(r.createRev)
+			writeInt(r.version)
+			writeInt(r.lease)
+			if r.tombstone {
+				h.Write([]byte{1})
+			} else {
+				h.Write([]byte{0})
+			}
+			h.Write([]byte(r.value))
+		}
+		return true
+	})
+	return &HashResult{Hash: h.Sum32(), Revision: rev, CompactRevision: s.compactRev}, nil
+}
+
+// WriteSnapshot writes a consistent snapshot of the state of the store to
+// w, in the binary format of Raft snapshots, and returns the revision of the
+// snapshot. The snapshot is meant for clients, so it leaves out the
+// forwarding key of the cluster.
+func (s *Store) WriteSnapshot(w io.Writer) (int64, error) {
+	snap, rev, err := (*fsm)(s).snapshot(false)
+	if err != nil {
+		return 0, err
+	}
+	defer snap.Release()
+
+	var o snapshotState
+	var kv keyIterator
+	switch snap := snap.(type) {
+	case *fsmSnapshot:
+		o, kv = *snap.state, snap.kv
+	case *boltSnapshot:
+		state, err := readBoltState(snap.tx)
+		if err != nil {
+			return 0, err
+		}
+		if state != nil {
+			o = *state
+		}
+		kv = boltTxKeys{tx: snap.tx}
+	}
+	o.ForwardKey = nil
+	if err := writeSnapshot(w, &o, kv); err != nil {
+		return 0, err
+	}
+	return rev, nil
+}
+
+// Defragment takes a Raft snapshot of this node, which truncates its Raft log
+// store. The space freed in the log store is reused by later entries.
+func (s *Store) Defragment() error {
+	err := s.raft.Snapshot().Error()
+	if err != nil && !errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		return err
+	}
+	return nil
+}
+
+// TransferLeadership transfers the leadership of the cluster to the node
+// with the given ID. This node must be the leader. Its leader lease is
+// given up during the transfer, as the target does not wait for it to
+// expire.
+func (s *Store) TransferLeadership(id string) error {
+	m, err := s.member(id)
+	if err != nil {
+		return err
+	}
+	s.reads.suspendLease()
+	defer s.reads.resumeLease()
+	future := s.raft.LeadershipTransferToServer(raft.ServerID(m.ID), raft.ServerAddress(m.Addr))
+	return raftError(future.Error())
+}
+
+// Alarms returns the active alarms of the cluster.
+func (s *Store) Alarms() []Alarm {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Alarm(nil), s.alarms...)
+}
+
+// ActivateAlarm raises an alarm on the node, via distributed consensus.
+func (s *Store) ActivateAlarm(node, typ string) error {
+	_, err := s.apply(&command{
+		Op:    "alarm_activate",
+		Key:   []byte(node),
+		Value: []byte(typ),
+	})
+	return err
+}
+
+// DeactivateAlarm clears an alarm of the node, via distributed consensus.
+func (s *Store) DeactivateAlarm(node, typ string) error {
+	_, err := s.apply(&command{
+		Op:    "alarm_deactivate",
+		Key:   []byte(node),
+		Value: []byte(typ),
+	})
+	return err
+}
+
+// checkQuota raises the NOSPACE alarm, and returns ErrNoSpace, if the
+// keyspace has grown above the quota.
+func (s *Store) checkQuota() error {
+	if s.QuotaBackendBytes <= 0 {
+		return nil
+	}
+	s.mu.Lock()
+	size, full := s.size, (*fsm)(s).noSpace()
+	s.mu.Unlock()
+	if full {
+		return ErrNoSpace
+	}
+	if size < s.QuotaBackendBytes {
+		return nil
+	}
+
+	s.logger.Printf("keyspace size %d exceeds quota %d, raising %s alarm", size, s.QuotaBackendBytes, AlarmNoSpace)
+	if err := s.ActivateAlarm(s.localID, AlarmNoSpace); err != nil {
+		return err
+	}
+	return ErrNoSpace
+}
+
+func (f *fsm) applyAlarm(node, typ string, active bool) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	a := Alarm{Node: node, Type: typ}
+	i := sort.Search(len(f.alarms), func(i int) bool { return !alarmLess(f.alarms[i], a) })
+	exists := i < len(f.alarms) && f.alarms[i] == a
+	switch {
+	case active && !exists:
+		f.alarms = append(f.alarms, Alarm{})
+		copy(f.alarms[i+1:], f.alarms[i:])
+		f.alarms[i] = a
+	case !active && exists:
+		f.alarms = append(f.alarms[:i], f.alarms[i+1:]...)
+	}
+	return nil
+}
+
+// noSpace returns whether the NOSPACE alarm is active on any node. The
+// caller must hold the lock.
+func (f *fsm) noSpace() bool {
+	for _, a := range f.alarms {
+		if a.Type == AlarmNoSpace {
+			return true
+		}
+	}
+	return false
+}
+
+func alarmLess(a, b Alarm) bool {
+	if a.Node != b.Node {
+		return a.Node < b.Node
+	}
+	return a.Type < b.Type
+}
+
+// size returns the approximate number of bytes taken by the history of the
+// key.
+func (it kvItem) size() int64 {
+	var n int64
+	for _, r := range it.revs {
+		n += revSize(it.key, r)
+	}
+	return n
+}
+
+// indexSize returns the approximate number of bytes taken by the history of
+// every key in the index.
+func indexSize(t kvIndex) int64 {
+	var n int64
+	t.Ascend(func(it kvItem) bool {
+		n += it.size()
+		return true
+	})
+	return n
+}
+
+// revSize returns the approximate number of bytes taken by a revision of the
+// key.
+func revSize(key []byte, r keyRev) int64 {
+	return int64(len(key) + len(r.value) + revOverhead)
+}
+
+// txnHasPut returns whether any branch of the transaction puts a key.
+func txnHasPut(req *pb.TxnRequest) bool {
+	for _, ops := range [][]*pb.RequestOp{req.Success, req.Failure} {
+		for _, op := range ops {
+			if op.GetRequestPut() != nil {
+				return true
+			}
+			if t := op.GetRequestTxn(); t != nil && txnHasPut(t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dirSize returns the total size of the files in the directory tree.
+func dirSize(dir string) int64 {
+	var n int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			n += info.Size()
+		}
+		return nil
+	})
+	return n
+}
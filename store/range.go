@@ -0,0 +1,139 @@
+package store
+
+import (
+	"bytes"
+	"sort"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+)
+
+// RangeKV evaluates an etcd range request against the key-value store,
+// honouring the revision, limit, sort, filter, count-only and keys-only
+// options of the request. The header of the response carries only the
+// current store revision.
+func (s *Store) RangeKV(req *pb.RangeRequest) (*pb.RangeResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rangeKVLocked(req)
+}
+
+// rangeKVLocked is like RangeKV, but the caller must hold the lock. A request
+// without a revision reads the latest version of every key, which inside a
+// transaction includes the writes made earlier in the same transaction.
+func (s *Store) rangeKVLocked(req *pb.RangeRequest) (*pb.RangeResponse, error) {
+	if req.Revision > s.rev {
+		return nil, ErrFutureRev
+	} else if req.Revision > 0 && req.Revision < s.compactRev {
+		return nil, ErrCompacted
+	}
+
+	// Like etcd, a sort target without an order implies ascending order.
+	sortOrder := req.SortOrder
+	if sortOrder == pb.RangeRequest_NONE && req.SortTarget != pb.RangeRequest_KEY {
+		sortOrder = pb.RangeRequest_ASCEND
+	}
+
+	// The index is already in ascending key order, so the limit can only be
+	// pushed down when no other ordering or filtering is requested.
+	sortByKey := sortOrder == pb.RangeRequest_NONE ||
+		(req.SortTarget == pb.RangeRequest_KEY && sortOrder == pb.RangeRequest_ASCEND)
+	filtered := req.MinModRevision != 0 || req.MaxModRevision != 0 ||
+		req.MinCreateRevision != 0 || req.MaxCreateRevision != 0
+	limit := 0
+	if sortByKey && !filtered {
+		limit = int(req.Limit)
+	}
+
+	kvs, count := s.rangeLocked(req.Key, req.RangeEnd, limit, req.Revision)
+	more := len(kvs) < count
+	if filtered {
+		kvs = filterKeyValues(kvs, req)
+	}
+	if !sortByKey {
+		sortKeyValues(kvs, req.SortTarget, sortOrder)
+	}
+	if limit == 0 {
+		more = req.Limit > 0 && len(kvs) > int(req.Limit)
+		if more {
+			kvs = kvs[:req.Limit]
+		}
+	}
+
+	resp := &pb.RangeResponse{
+		Header: &pb.ResponseHeader{Revision: s.rev},
+		Count:  int64(count),
+		More:   more,
+	}
+	if req.CountOnly {
+		return resp, nil
+	}
+
+	resp.Kvs = make([]*mvccpb.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		pkv := kv.ToProto()
+		if req.KeysOnly {
+			pkv.Value = nil
+		}
+		resp.Kvs = append(resp.Kvs, pkv)
+	}
+	return resp, nil
+}
+
+// ToProto converts the pair to its etcd representation.
+func (kv KeyValue) ToProto() *mvccpb.KeyValue {
+	return &mvccpb.KeyValue{
+		Key:            kv.Key,
+		Value:          kv.Value,
+		CreateRevision: kv.CreateRevision,
+		ModRevision:    kv.ModRevision,
+		Version:        kv.Version,
+		Lease:          kv.Lease,
+	}
+}
+
+// filterKeyValues returns the pairs in kvs matching the revision filters of
+// the request.
+func filterKeyValues(kvs []KeyValue, req *pb.RangeRequest) []KeyValue {
+	out := kvs[:0]
+	for _, kv := range kvs {
+		if req.MinModRevision != 0 && kv.ModRevision < req.MinModRevision {
+			continue
+		}
+		if req.MaxModRevision != 0 && kv.ModRevision > req.MaxModRevision {
+			continue
+		}
+		if req.MinCreateRevision != 0 && kv.CreateRevision < req.MinCreateRevision {
+			continue
+		}
+		if req.MaxCreateRevision != 0 && kv.CreateRevision > req.MaxCreateRevision {
+			continue
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+// sortKeyValues sorts kvs in place according to the requested etcd sort
+// target and order.
+func sortKeyValues(kvs []KeyValue, target pb.RangeRequest_SortTarget, order pb.RangeRequest_SortOrder) {
+	less := func(i, j int) bool {
+		switch target {
+		case pb.RangeRequest_VERSION:
+			return kvs[i].Version < kvs[j].Version
+		case pb.RangeRequest_CREATE:
+			return kvs[i].CreateRevision < kvs[j].CreateRevision
+		case pb.RangeRequest_MOD:
+			return kvs[i].ModRevision < kvs[j].ModRevision
+		case pb.RangeRequest_VALUE:
+			return bytes.Compare(kvs[i].Value, kvs[j].Value) < 0
+		default:
+			return bytes.Compare(kvs[i].Key, kvs[j].Key) < 0
+		}
+	}
+	if order == pb.RangeRequest_DESCEND {
+		sort.SliceStable(kvs, func(i, j int) bool { return less(j, i) })
+		return
+	}
+	sort.SliceStable(kvs, less)
+}
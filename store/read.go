@@ -0,0 +1,346 @@
+package store
+
+import (
+	"errors"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// DefaultMaxClockDrift is the default bound on the clock drift between
+// nodes, by which leader leases are shortened.
+const DefaultMaxClockDrift = 100 * time.Millisecond
+
+// ErrReadTimeout is returned when this node does not catch up with the read
+// index of a linearizable read in time.
+var ErrReadTimeout = errors.New("timed out waiting for read index")
+
+// waitPollInterval is how often a node waiting for entries it has not
+// received yet checks its log for them.
+const waitPollInterval = 10 * time.Millisecond
+
+// readStats counts the linearizable reads of every store in the process by
+// the path they took, published with expvar.
+var readStats = expvar.NewMap("store_reads")
+
+// ReadStats counts the linearizable reads served by a store.
+type ReadStats struct {
+	// Lease is the number of reads served under the leader lease, without
+	// contacting the rest of the cluster.
+	Lease int64
+
+	// ReadIndex is the number of reads which confirmed leadership with a
+	// quorum first.
+	ReadIndex int64
+}
+
+// LinearizableRead waits until the state of this node reflects every write
+// committed before the call, so that a read made once it returns is
+// linearizable. It returns ErrNotLeader if the leader is unknown, or if
+// leadership is lost while confirming it.
+//
+// The read index is the last index of the leader's log, which includes
+// every committed entry. Leadership is confirmed with a heartbeat round to
+// a quorum, which is shared by every read waiting for the same round. If
+// LeaseReads is set, the round is skipped while the leader holds a lease.
+// Followers ask the leader for a read index over an internal RPC, and wait
+// until they have applied it themselves.
+func (s *Store) LinearizableRead() error {
+	var index uint64
+	var err error
+	if s.raft.State() == raft.Leader {
+		index, err = s.readIndex()
+	} else {
+		index, err = s.forwarder.readIndex()
+	}
+	if err != nil {
+		return err
+	}
+	return s.waitApplied(index, raftTimeout)
+}
+
+// readIndex returns a read index, once the leadership of this node has been
+// confirmed.
+func (s *Store) readIndex() (uint64, error) {
+	index, ok := s.reads.leaseIndex()
+	if ok {
+		s.reads.leaseReads.Add(1)
+		readStats.Add("lease", 1)
+		return index, nil
+	}
+	index, err := s.reads.readIndex()
+	if err != nil {
+		return 0, err
+	}
+	s.reads.readIndexReads.Add(1)
+	readStats.Add("read_index", 1)
+	return index, nil
+}
+
+// ReadStats returns the number of linearizable reads served by this store,
+// by the path they took.
+func (s *Store) ReadStats() ReadStats {
+	return ReadStats{
+		Lease:     s.reads.leaseReads.Load(),
+		ReadIndex: s.reads.readIndexReads.Load(),
+	}
+}
+
+// waitApplied waits until the FSM has applied every entry up to index, or
+// the timeout expires. A follower may not have received the entries up to
+// index yet, in which case it waits for them to arrive as well.
+func (s *Store) waitApplied(index uint64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var poll *time.Ticker
+	defer func() {
+		if poll != nil {
+			poll.Stop()
+		}
+	}()
+
+	target, known := s.lastFSMIndex(index)
+	for {
+		s.mu.Lock()
+		applied, c := s.applied, s.appliedc
+		s.mu.Unlock()
+		if known && applied >= target {
+			return nil
+		}
+
+		// Until the entries up to index are in the log, which does not
+		// signal their arrival, check for them periodically.
+		var polled <-chan time.Time
+		if !known {
+			if poll == nil {
+				poll = time.NewTicker(waitPollInterval)
+			}
+			polled = poll.C
+		}
+		select {
+		case <-c:
+		case <-polled:
+		case <-timer.C:
+			return ErrReadTimeout
+		case <-s.done:
+			return ErrReadTimeout
+		}
+		if !known {
+			target, known = s.lastFSMIndex(index)
+		}
+	}
+}
+
+// lastFSMIndex returns the index of the last entry up to index which is
+// passed to the FSM. Raft applies entries such as no-ops and barriers
+// without involving the FSM, so they never advance its applied index.
+// Entries which were compacted away are part of the state of the FSM already.
+// It returns false if the entries up to index are not all in the log yet, as
+// on a follower lagging behind the leader.
+func (s *Store) lastFSMIndex(index uint64) (uint64, bool) {
+	s.mu.Lock()
+	applied := s.applied
+	s.mu.Unlock()
+
+	var l raft.Log
+	for ; index > applied; index-- {
+		if err := s.logStore.GetLog(index, &l); err != nil {
+			first, ferr := s.logStore.FirstIndex()
+			if ferr == nil && index < first {
+				return applied, true
+			}
+			return 0, false
+		}
+		if l.Type == raft.LogCommand || l.Type == raft.LogConfiguration {
+			return index, true
+		}
+	}
+	return index, true
+}
+
+// setApplied records that the FSM applied the entry at index, and wakes the
+// reads waiting for it.
+func (f *fsm) setApplied(index uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if index > f.applied {
+		f.applied = index
+	}
+	if f.bolt != nil {
+		f.appliedBolt()
+	}
+	close(f.appliedc)
+	f.appliedc = make(chan struct{})
+}
+
+// StoreConfiguration is called by Raft when a configuration entry is
+// applied. The configuration is tracked by Raft itself, but the entry
+// advances the applied index of the FSM.
+func (f *fsm) StoreConfiguration(index uint64, _ raft.Configuration) {
+	f.setApplied(index)
+}
+
+// readIndexer confirms the leadership of this node for linearizable reads.
+// Reads arriving while a confirmation round is in flight are batched into
+// the next round, so that concurrent reads share a single heartbeat round.
+//
+// With leader leases, every successful round also extends the lease of the
+// leader. A follower does not start an election until it has not heard from
+// the leader for the heartbeat timeout, so no other leader can be elected
+// before the heartbeat timeout has passed since the start of a round
+// acknowledged by a quorum. The lease is shortened by the bound on clock
+// drift, as followers measure that timeout with their own clocks.
+type readIndexer struct {
+	s *Store
+
+	mu      sync.Mutex
+	pending []chan readIndexResult // Reads waiting for the next round.
+	running bool                   // Whether a goroutine is running rounds.
+	lease   time.Time              // When the leader lease expires.
+
+	// leaseDuration is how long a lease lasts from the start of the round
+	// which granted it, or zero if leases are disabled.
+	leaseDuration time.Duration
+
+	// transfers is the number of leadership transfers in progress. The
+	// target of a transfer starts an election at once, so leases are
+	// suspended while it is non-zero.
+	transfers atomic.Int32
+
+	leaseReads     atomic.Int64
+	readIndexReads atomic.Int64
+}
+
+type readIndexResult struct {
+	index uint64
+	err   error
+}
+
+func newReadIndexer(s *Store) *readIndexer {
+	return &readIndexer{s: s}
+}
+
+// readIndex returns a read index, once this node is confirmed to be the
+// leader by a round started after the call.
+func (r *readIndexer) readIndex() (uint64, error) {
+	c := make(chan readIndexResult, 1)
+	r.mu.Lock()
+	r.pending = append(r.pending, c)
+	if !r.running {
+		r.running = true
+		go r.run()
+	}
+	r.mu.Unlock()
+
+	res := <-c
+	return res.index, res.err
+}
+
+// run confirms leadership for batches of reads, until no read is waiting.
+func (r *readIndexer) run() {
+	for {
+		r.mu.Lock()
+		batch := r.pending
+		r.pending = nil
+		if len(batch) == 0 {
+			r.running = false
+			r.mu.Unlock()
+			return
+		}
+		r.mu.Unlock()
+
+		index, err := r.round()
+		for _, c := range batch {
+			c <- readIndexResult{index: index, err: err}
+		}
+	}
+}
+
+// round confirms the leadership of this node with a quorum, and returns the
+// last index of its log as read index.
+func (r *readIndexer) round() (uint64, error) {
+	if r.s.raft.State() != raft.Leader {
+		return 0, ErrNotLeader
+	}
+	start := time.Now()
+	index := r.s.raft.LastIndex()
+	if err := r.s.raft.VerifyLeader().Error(); err != nil {
+		r.revokeLease()
+		if errors.Is(err, raft.ErrLeadershipLost) {
+			return 0, ErrNotLeader
+		}
+		return 0, raftError(err)
+	}
+	r.extendLease(start)
+	return index, nil
+}
+
+// leaseIndex returns a read index without a round, if this node is the
+// leader and holds a lease.
+func (r *readIndexer) leaseIndex() (uint64, bool) {
+	if r.leaseDuration == 0 || r.transfers.Load() > 0 {
+		return 0, false
+	}
+	r.mu.Lock()
+	lease := r.lease
+	r.mu.Unlock()
+	if !time.Now().Before(lease) || r.s.raft.State() != raft.Leader {
+		return 0, false
+	}
+	return r.s.raft.LastIndex(), true
+}
+
+// extendLease extends the lease to the lease duration past the start of a
+// successful round.
+func (r *readIndexer) extendLease(start time.Time) {
+	if r.leaseDuration == 0 || r.transfers.Load() > 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l := start.Add(r.leaseDuration); l.After(r.lease) {
+		r.lease = l
+	}
+}
+
+// revokeLease gives up the lease.
+func (r *readIndexer) revokeLease() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lease = time.Time{}
+}
+
+// suspendLease gives up the lease until resumeLease is called, for the
+// duration of a leadership transfer.
+func (r *readIndexer) suspendLease() {
+	r.transfers.Add(1)
+	r.revokeLease()
+}
+
+func (r *readIndexer) resumeLease() {
+	r.transfers.Add(-1)
+}
+
+// renewLeases keeps the lease of the leader fresh with a round every third
+// of the lease duration, so that reads rarely wait for one, until done is
+// closed.
+func (r *readIndexer) renewLeases(done <-chan struct{}) {
+	ticker := time.NewTicker(r.leaseDuration / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if r.s.raft.State() != raft.Leader {
+				r.revokeLease()
+				continue
+			}
+			r.readIndex()
+		}
+	}
+}
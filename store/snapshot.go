@@ -0,0 +1,599 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/google/btree"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Snapshots are streamed to the sink as a header, the magic bytes followed
+// by a version byte, and a sequence of records. Each record is its length, as
+// a varint, a record type byte, and the fields of the record in the protobuf
+// wire format, like commands. The last record holds the CRC-32C checksum of
+// everything before it, so that truncated or corrupted snapshots are
+// rejected rather than restored.
+//
+// Snapshots taken before the binary format are a single JSON object. They
+// always start with '{', so they are recognized and still restored.
+const (
+	// snapshotMagic starts every binary snapshot.
+	snapshotMagic = "\x00hraftd"
+
+	// snapshotVersion is the version of the format written by this node.
+	snapshotVersion byte = 1
+
+	// snapshotVersionBolt is the version of snapshots written by nodes with
+	// FSMBackendBolt, which hold a copy of their bbolt file instead of
+	// records. The file is preceded by its size, as a varint, and followed by
+	// its CRC-32C checksum.
+	snapshotVersionBolt byte = 2
+
+	// snapshotChunkSize is the size of the writes to the sink, and of the
+	// reads from a snapshot being restored.
+	snapshotChunkSize = 64 << 10
+
+	// maxSnapshotRecord bounds the size of a record, so that a corrupted
+	// length fails the restore rather than exhausting memory.
+	maxSnapshotRecord = 1 << 30
+)
+
+// Record types.
+const (
+	recordState byte = iota + 1 // The revisions and the applied index.
+	recordKV                    // A single revision of a key.
+	recordLease                 // A granted lease.
+	recordNode                  // The metadata of a node.
+	recordAlarm                 // An active alarm.
+	recordAuth                  // The users and roles, JSON-encoded.
+	recordEnd                   // The checksum, ending the snapshot.
+)
+
+// Field numbers of state records.
+const (
+	fieldStateRevision protowire.Number = iota + 1
+	fieldStateCompactRevision
+	fieldStateAppliedIndex
+	fieldStateForwardKey
+)
+
+// Field numbers of key-value records.
+const (
+	fieldKVKey protowire.Number = iota + 1
+	fieldKVValue
+	fieldKVCreateRevision
+	fieldKVModRevision
+	fieldKVVersion
+	fieldKVLease
+	fieldKVTombstone
+)
+
+// Field numbers of lease records.
+const (
+	fieldLeaseID protowire.Number = iota + 1
+	fieldLeaseTTL
+)
+
+// Field numbers of node records. Metadata entries are encoded like the
+// metadata of commands.
+const (
+	fieldNodeID protowire.Number = iota + 1
+	fieldNodeMeta
+)
+
+// Field numbers of alarm records.
+const (
+	fieldAlarmNode protowire.Number = iota + 1
+	fieldAlarmType
+)
+
+// Field numbers of auth and end records.
+const (
+	fieldAuthState protowire.Number = 1
+	fieldChecksum  protowire.Number = 1
+)
+
+var (
+	// errSnapshotChecksum is returned when restoring a corrupted snapshot.
+	errSnapshotChecksum = errors.New("snapshot checksum mismatch")
+
+	// errSnapshotTruncated is returned when restoring a snapshot which
+	// ends before its checksum.
+	errSnapshotTruncated = errors.New("snapshot truncated")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// snapshotWriter writes the records of a snapshot, in chunks.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf []byte
+}
+
+// newSnapshotWriter returns a writer of a snapshot to w, and writes the
+// header of the snapshot.
+func newSnapshotWriter(w io.Writer) (*snapshotWriter, error) {
+	sw := &snapshotWriter{
+		w:   bufio.NewWriterSize(w, snapshotChunkSize),
+		crc: crc32.New(castagnoli),
+	}
+	if err := sw.write(append([]byte(snapshotMagic), snapshotVersion)); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// write writes b, and adds it to the checksum.
+func (sw *snapshotWriter) write(b []byte) error {
+	sw.crc.Write(b)
+	_, err := sw.w.Write(b)
+	return err
+}
+
+// record writes a record of the given type. fields appends the fields of
+// the record to b.
+func (sw *snapshotWriter) record(typ byte, fields func(b []byte) []byte) error {
+	body := fields(append(sw.buf[:0], typ))
+	sw.buf = body
+	var l [binary.MaxVarintLen64]byte
+	if err := sw.write(protowire.AppendVarint(l[:0], uint64(len(body)))); err != nil {
+		return err
+	}
+	return sw.write(body)
+}
+
+// close writes the checksum, ending the snapshot, and flushes the writes.
+func (sw *snapshotWriter) close() error {
+	sum := sw.crc.Sum32()
+	err := sw.record(recordEnd, func(b []byte) []byte {
+		b = protowire.AppendTag(b, fieldChecksum, protowire.VarintType)
+		return protowire.AppendVarint(b, uint64(sum))
+	})
+	if err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+// keyIterator iterates over the keys of an index, in order.
+type keyIterator interface {
+	Ascend(fn btree.ItemIteratorG[kvItem])
+}
+
+// writeSnapshot streams the state, and the keys of the index, to w.
+func writeSnapshot(w io.Writer, o *snapshotState, kv keyIterator) error {
+	sw, err := newSnapshotWriter(w)
+	if err != nil {
+		return err
+	}
+	err = sw.record(recordState, func(b []byte) []byte {
+		b = appendInt(b, fieldStateRevision, o.Revision)
+		b = appendInt(b, fieldStateCompactRevision, o.CompactRevision)
+		b = appendInt(b, fieldStateAppliedIndex, int64(o.AppliedIndex))
+		return appendBytes(b, fieldStateForwardKey, o.ForwardKey)
+	})
+	if err != nil {
+		return err
+	}
+	kv.Ascend(func(it kvItem) bool {
+		for _, r := range it.revs {
+			err = sw.record(recordKV, func(b []byte) []byte {
+				b = protowire.AppendTag(b, fieldKVKey, protowire.BytesType)
+				b = protowire.AppendBytes(b, it.key)
+				return appendKeyRev(b, r)
+			})
+			if err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, l := range o.Leases {
+		err := sw.record(recordLease, func(b []byte) []byte {
+			b = appendInt(b, fieldLeaseID, l.ID)
+			return appendInt(b, fieldLeaseTTL, l.TTL)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for id, m := range o.Nodes {
+		err := sw.record(recordNode, func(b []byte) []byte {
+			b = appendString(b, fieldNodeID, id)
+			for k, v := range m {
+				var e []byte
+				e = appendString(e, fieldMetaKey, k)
+				e = appendString(e, fieldMetaValue, v)
+				b = protowire.AppendTag(b, fieldNodeMeta, protowire.BytesType)
+				b = protowire.AppendBytes(b, e)
+			}
+			return b
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, a := range o.Alarms {
+		err := sw.record(recordAlarm, func(b []byte) []byte {
+			b = appendString(b, fieldAlarmNode, a.Node)
+			return appendString(b, fieldAlarmType, a.Type)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if o.Auth != nil {
+		// The users and roles are few, so they are not worth a format of
+		// their own.
+		auth, err := json.Marshal(o.Auth)
+		if err != nil {
+			return err
+		}
+		err = sw.record(recordAuth, func(b []byte) []byte {
+			b = protowire.AppendTag(b, fieldAuthState, protowire.BytesType)
+			return protowire.AppendBytes(b, auth)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return sw.close()
+}
+
+// appendKeyRev appends the fields of a revision of a key, but the key.
+func appendKeyRev(b []byte, r keyRev) []byte {
+	b = appendBytes(b, fieldKVValue, r.value)
+	b = appendInt(b, fieldKVCreateRevision, r.createRev)
+	b = appendInt(b, fieldKVModRevision, r.modRev)
+	b = appendInt(b, fieldKVVersion, r.version)
+	b = appendInt(b, fieldKVLease, r.lease)
+	return appendBool(b, fieldKVTombstone, r.tombstone)
+}
+
+// setField sets a field of the revision, decoded by consumeFields.
+func (r *keyRev) setField(num protowire.Number, v []byte, n uint64) {
+	switch num {
+	case fieldKVValue:
+		r.value = append([]byte(nil), v...)
+	case fieldKVCreateRevision:
+		r.createRev = int64(n)
+	case fieldKVModRevision:
+		r.modRev = int64(n)
+	case fieldKVVersion:
+		r.version = int64(n)
+	case fieldKVLease:
+		r.lease = int64(n)
+	case fieldKVTombstone:
+		r.tombstone = n != 0
+	}
+}
+
+// snapshotReader reads the records of a snapshot.
+type snapshotReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	buf []byte
+}
+
+// ReadByte reads a byte of a record length, and adds it to the checksum.
+func (sr *snapshotReader) ReadByte() (byte, error) {
+	c, err := sr.r.ReadByte()
+	if err == nil {
+		sr.crc.Write([]byte{c})
+	}
+	return c, err
+}
+
+// next reads the next record, and returns its type and fields, along with
+// the checksum of the snapshot before the record. The fields are only valid
+// until the next call.
+func (sr *snapshotReader) next() (byte, []byte, uint32, error) {
+	sum := sr.crc.Sum32()
+	l, err := binary.ReadUvarint(sr)
+	if err != nil {
+		return 0, nil, 0, err
+	}
+	if l == 0 || l > maxSnapshotRecord {
+		return 0, nil, 0, fmt.Errorf("invalid snapshot record length %d", l)
+	}
+	if uint64(cap(sr.buf)) < l {
+		sr.buf = make([]byte, l)
+	}
+	b := sr.buf[:l]
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		return 0, nil, 0, err
+	}
+	sr.crc.Write(b)
+	return b[0], b[1:], sum, nil
+}
+
+// snapshotRestorer rebuilds the state of the FSM from a snapshot.
+type snapshotRestorer struct {
+	kv              kvIndex
+	leases          map[int64]*lease
+	meta            map[string]map[string]string
+	rev, compactRev int64
+	applied         uint64
+	keys            int
+	alarms          []Alarm
+	auth            authState
+	forwardKey      []byte
+
+	// dir is the directory of temporary files, and persistent is whether
+	// keys are restored into a bbolt file there rather than into memory.
+	dir        string
+	persistent bool
+
+	it kvItem // The key whose revisions are being restored.
+}
+
+func newSnapshotRestorer(dir string, persistent bool) *snapshotRestorer {
+	return &snapshotRestorer{
+		leases:     make(map[int64]*lease),
+		meta:       make(map[string]map[string]string),
+		auth:       newAuthState(),
+		dir:        dir,
+		persistent: persistent,
+	}
+}
+
+// restore restores a snapshot in the binary, bbolt or legacy JSON format.
+func (sr *snapshotRestorer) restore(r io.Reader) error {
+	br := bufio.NewReaderSize(r, snapshotChunkSize)
+	header, err := br.Peek(len(snapshotMagic) + 1)
+	isBinary := err == nil && bytes.HasPrefix(header, []byte(snapshotMagic))
+	if isBinary && header[len(snapshotMagic)] == snapshotVersionBolt {
+		br.Discard(len(header))
+		return sr.restoreBolt(br, header)
+	}
+	if err := sr.newIndex(); err != nil {
+		return err
+	}
+	if !isBinary {
+		b, err := io.ReadAll(br)
+		if err != nil {
+			return err
+		}
+		return sr.restoreJSON(b)
+	}
+	if v := header[len(snapshotMagic)]; v != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", v)
+	}
+	br.Discard(len(header))
+
+	rd := &snapshotReader{r: br, crc: crc32.New(castagnoli)}
+	rd.crc.Write(header)
+	for {
+		typ, b, sum, err := rd.next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return errSnapshotTruncated
+		} else if err != nil {
+			return err
+		}
+		if typ == recordEnd {
+			var want uint64
+			if err := consumeFields(b, func(num protowire.Number, _ []byte, n uint64) {
+				if num == fieldChecksum {
+					want = n
+				}
+			}); err != nil {
+				return err
+			}
+			if uint32(want) != sum {
+				return errSnapshotChecksum
+			}
+			sr.finish()
+			return nil
+		}
+		if err := sr.record(typ, b); err != nil {
+			return err
+		}
+	}
+}
+
+// record restores a record of a binary snapshot. Records of unknown types
+// are skipped.
+func (sr *snapshotRestorer) record(typ byte, b []byte) error {
+	var nested error
+	var err error
+	switch typ {
+	case recordState:
+		err = consumeFields(b, func(num protowire.Number, v []byte, n uint64) {
+			switch num {
+			case fieldStateRevision:
+				sr.rev = int64(n)
+			case fieldStateCompactRevision:
+				sr.compactRev = int64(n)
+			case fieldStateAppliedIndex:
+				sr.applied = n
+			case fieldStateForwardKey:
+				sr.forwardKey = append([]byte(nil), v...)
+			}
+		})
+	case recordKV:
+		var key []byte
+		var r keyRev
+		err = consumeFields(b, func(num protowire.Number, v []byte, n uint64) {
+			if num == fieldKVKey {
+				key = append([]byte(nil), v...)
+			} else {
+				r.setField(num, v, n)
+			}
+		})
+		sr.addRev(key, r)
+	case recordLease:
+		var id, ttl int64
+		err = consumeFields(b, func(num protowire.Number, _ []byte, n uint64) {
+			switch num {
+			case fieldLeaseID:
+				id = int64(n)
+			case fieldLeaseTTL:
+				ttl = int64(n)
+			}
+		})
+		sr.leases[id] = newLease(id, ttl)
+	case recordNode:
+		var id string
+		m := make(map[string]string)
+		err = consumeFields(b, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case fieldNodeID:
+				id = string(v)
+			case fieldNodeMeta:
+				var k, val string
+				nested = consumeFields(v, func(num protowire.Number, v []byte, _ uint64) {
+					switch num {
+					case fieldMetaKey:
+						k = string(v)
+					case fieldMetaValue:
+						val = string(v)
+					}
+				})
+				m[k] = val
+			}
+		})
+		sr.meta[id] = m
+	case recordAlarm:
+		var a Alarm
+		err = consumeFields(b, func(num protowire.Number, v []byte, _ uint64) {
+			switch num {
+			case fieldAlarmNode:
+				a.Node = string(v)
+			case fieldAlarmType:
+				a.Type = string(v)
+			}
+		})
+		sr.alarms = append(sr.alarms, a)
+	case recordAuth:
+		err = consumeFields(b, func(num protowire.Number, v []byte, _ uint64) {
+			if num != fieldAuthState {
+				return
+			}
+			o := &snapshotAuth{}
+			if nested = json.Unmarshal(v, o); nested == nil {
+				sr.auth = o.restore()
+			}
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return nested
+}
+
+// restoreJSON restores a snapshot in the legacy JSON format.
+func (sr *snapshotRestorer) restoreJSON(b []byte) error {
+	// Snapshots taken before revisions were tracked are a plain JSON object
+	// of string values. Restore these as if every key was created at
+	// revision 1.
+	legacy := make(map[string]string)
+	if err := json.Unmarshal(b, &legacy); err == nil {
+		for k, v := range legacy {
+			sr.kv.ReplaceOrInsert(kvItem{key: []byte(k), revs: []keyRev{{value: []byte(v), createRev: 1, modRev: 1, version: 1}}})
+			sr.rev = 1
+		}
+		sr.keys = len(legacy)
+		return nil
+	}
+
+	o := &snapshotState{}
+	if err := json.Unmarshal(b, o); err != nil {
+		return err
+	}
+	for _, e := range o.KVs {
+		key, value := e.Key, e.Value
+		if e.Key == nil {
+			key, value = []byte(e.LegacyKey), []byte(e.LegacyValue)
+		}
+		sr.addRev(key, keyRev{
+			value:     value,
+			createRev: e.CreateRevision,
+			modRev:    e.ModRevision,
+			version:   e.Version,
+			lease:     e.Lease,
+			tombstone: e.Tombstone,
+		})
+	}
+	sr.setState(o)
+	sr.finish()
+	return nil
+}
+
+// setState restores the state of the store but the keys.
+func (sr *snapshotRestorer) setState(o *snapshotState) {
+	for _, e := range o.Leases {
+		sr.leases[e.ID] = newLease(e.ID, e.TTL)
+	}
+	for id, m := range o.Nodes {
+		sr.meta[id] = m
+	}
+	sr.alarms = o.Alarms
+	if o.Auth != nil {
+		sr.auth = o.Auth.restore()
+	}
+	sr.rev, sr.compactRev = o.Revision, o.CompactRevision
+	sr.applied = o.AppliedIndex
+	sr.forwardKey = o.ForwardKey
+}
+
+// newIndex creates the index the keys are restored into.
+func (sr *snapshotRestorer) newIndex() error {
+	if !sr.persistent {
+		sr.kv = newIndex()
+		return nil
+	}
+	b, err := createTempBolt(sr.dir)
+	if err != nil {
+		return err
+	}
+	sr.kv = b
+	return nil
+}
+
+// discard removes the keys restored into a bbolt file, if the restore
+// failed.
+func (sr *snapshotRestorer) discard() {
+	if b, ok := sr.kv.(*boltIndex); ok {
+		b.remove()
+	}
+}
+
+// addRev adds a revision of the key. Revisions of the same key are stored
+// consecutively, oldest first.
+func (sr *snapshotRestorer) addRev(key []byte, r keyRev) {
+	if !bytes.Equal(key, sr.it.key) && len(sr.it.revs) > 0 {
+		sr.kv.ReplaceOrInsert(sr.it)
+		sr.it = kvItem{}
+	}
+	sr.it.key = key
+	sr.it.revs = append(sr.it.revs, r)
+}
+
+// finish adds the last key, and attaches the keys to their leases.
+func (sr *snapshotRestorer) finish() {
+	if len(sr.it.revs) > 0 {
+		sr.kv.ReplaceOrInsert(sr.it)
+		sr.it = kvItem{}
+	}
+	sr.kv.Ascend(func(it kvItem) bool {
+		if r, ok := it.latest(); ok {
+			sr.keys++
+			if l := sr.leases[r.lease]; l != nil {
+				l.keys[string(it.key)] = struct{}{}
+			}
+		}
+		return true
+	})
+}
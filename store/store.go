@@ -8,29 +8,60 @@
 package store
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sync"
 	"time"
 
+	"github.com/google/btree"
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
 )
 
 const (
-	retainSnapshotCount = 2
-	raftTimeout         = 10 * time.Second
+	raftTimeout = 10 * time.Second
 )
 
+// ErrNotLeader is returned when a request which must be served by the leader
+// is sent to another node.
+var ErrNotLeader = errors.New("not leader")
+
 type command struct {
-	Op    string `json:"op,omitempty"`
-	Key   string `json:"key,omitempty"`
-	Value string `json:"value,omitempty"`
+	Op          string `json:"op,omitempty"`
+	Key         []byte `json:"-"`
+	Value       []byte `json:"-"`
+	End         []byte `json:"-"`
+	PrevKV      bool   `json:"prev_kv,omitempty"`
+	IgnoreValue bool   `json:"ignore_value,omitempty"`
+	IgnoreLease bool   `json:"ignore_lease,omitempty"`
+	Lease       int64  `json:"lease,omitempty"`
+	TTL         int64  `json:"ttl,omitempty"`
+	Revision    int64  `json:"revision,omitempty"`
+	Txn         []byte `json:"txn,omitempty"` // Protobuf-encoded etcd TxnRequest.
+
+	Meta map[string]string `json:"meta,omitempty"`
+	Auth *authCommand      `json:"auth,omitempty"`
+
+	// Batch holds the encoded commands of a batch, applied in order.
+	Batch [][]byte `json:"-"`
+
+	// LegacyBatch holds the commands of batches in JSON-encoded entries.
+	LegacyBatch []json.RawMessage `json:"batch,omitempty"`
+
+	// LegacyKey, LegacyValue and LegacyEnd hold the key, the value and the
+	// range end in JSON-encoded entries, as strings.
+	LegacyKey   string `json:"key,omitempty"`
+	LegacyValue string `json:"value,omitempty"`
+	LegacyEnd   string `json:"end,omitempty"`
 }
 
 // Store is a simple key-value store, where all changes are made via Raft consensus.
@@ -39,43 +70,194 @@ type Store struct {
 	RaftBind string
 	inmem    bool
 
-	mu sync.Mutex
-	m  map[string]string // The key-value store for the system.
+	// AutoCompactionMode enables automatic compaction of the history of
+	// the store, and is either CompactionModePeriodic or
+	// CompactionModeRevision. Automatic compaction is disabled if empty.
+	AutoCompactionMode string
+
+	// AutoCompactionRetention is how much history automatic compaction
+	// retains: a duration such as "1h" (or a number of hours) in periodic
+	// mode, or a number of revisions in revision mode.
+	AutoCompactionRetention string
+
+	// NodeMeta is the metadata of this node, such as the addresses of its
+	// APIs, recorded by the cluster so that other nodes can find them.
+	NodeMeta map[string]string
+
+	// QuotaBackendBytes is the size the keyspace, including its history,
+	// may grow to. Above it, the NOSPACE alarm is raised and writes are
+	// rejected until the alarm is deactivated. Zero disables the quota.
+	QuotaBackendBytes int64
+
+	// LeaseReads enables leader leases for linearizable reads. While the
+	// leader holds a lease, renewed by heartbeat rounds to a quorum, it
+	// serves linearizable reads from its local state without a round.
+	LeaseReads bool
+
+	// MaxClockDrift is the bound on the clock drift between nodes, by which
+	// leader leases are shortened. DefaultMaxClockDrift is used if zero.
+	MaxClockDrift time.Duration
+
+	// BatchWrites enables group commit: concurrent writes to keys are
+	// coalesced into a single Raft log entry, which the FSM applies in
+	// order.
+	BatchWrites bool
+
+	// MaxBatchBytes bounds the size of the writes coalesced into a single
+	// entry. DefaultMaxBatchBytes is used if zero.
+	MaxBatchBytes int
+
+	// BatchLinger is how long a batch waits for more writes before it is
+	// applied, unless it is full. If zero, a batch holds the writes which
+	// arrived while the previous batch was being applied.
+	BatchLinger time.Duration
 
-	raft *raft.Raft // The consensus mechanism
+	// ForwardWrites enables forwarding writes made on followers to the
+	// leader. If unset, such writes fail with a NotLeaderError naming the
+	// leader instead.
+	ForwardWrites bool
+
+	// FSMBackend is where the keyspace is kept, either FSMBackendMemory or
+	// FSMBackendBolt. FSMBackendMemory is used if empty.
+	FSMBackend string
+
+	localID string
+
+	mu         sync.Mutex
+	kv         kvIndex                      // The key-value store for the system, ordered by key.
+	rev        int64                        // The current revision of the key-value store.
+	compactRev int64                        // History before this revision is unavailable.
+	keys       int                          // The number of keys which currently exist.
+	size       int64                        // The approximate size of the keyspace, in bytes.
+	alarms     []Alarm                      // The active alarms, sorted.
+	watchers   map[*Watcher]struct{}        // The watchers notified of changes.
+	leases     map[int64]*lease             // The granted leases, by ID.
+	meta       map[string]map[string]string // The metadata of the nodes, by ID.
+	auth       authState                    // The users and roles.
+	forwardKey []byte                       // Signs the requests nodes make to the leader.
+	applied    uint64                       // The index of the last entry applied by the FSM.
+	appliedc   chan struct{}                // Closed when the applied index advances.
+	durable    uint64                       // Entries up to this index were applied before a restart.
+
+	bolt *boltIndex // The bbolt file of the keyspace, with FSMBackendBolt.
+
+	lessor *lessor      // Expires leases while this node is the leader.
+	reads  *readIndexer // Confirms leadership for linearizable reads.
+
+	batcher   *batcher   // Coalesces concurrent writes.
+	forwarder *forwarder // Forwards writes to the leader.
+
+	raft     *raft.Raft    // The consensus mechanism
+	logStore raft.LogStore // The Raft log, to find the entries applied by the FSM.
+
+	done chan struct{} // Closed when the store is closed.
 
 	logger *log.Logger
 }
 
 // New returns a new Store.
 func New(inmem bool) *Store {
-	return &Store{
-		m:      make(map[string]string),
-		inmem:  inmem,
-		logger: log.New(os.Stderr, "[store] ", log.LstdFlags),
+	s := &Store{
+		kv:       newIndex(),
+		leases:   make(map[int64]*lease),
+		meta:     make(map[string]map[string]string),
+		auth:     newAuthState(),
+		appliedc: make(chan struct{}),
+		inmem:    inmem,
+		done:     make(chan struct{}),
+		logger:   log.New(os.Stderr, "[store] ", log.LstdFlags),
+	}
+	s.lessor = newLessor(s)
+	s.reads = newReadIndexer(s)
+	s.batcher = newBatcher(s)
+	s.forwarder = newForwarder(s)
+	return s
+}
+
+// Validate returns an error if the options of the store, or cfg, are not
+// valid, without opening the store. A nil cfg is valid.
+func (s *Store) Validate(cfg *Config) error {
+	if _, err := newCompactor(s, s.AutoCompactionMode, s.AutoCompactionRetention); err != nil {
+		return err
 	}
+
+	switch s.FSMBackend {
+	case "", FSMBackendMemory:
+	case FSMBackendBolt:
+		if s.inmem {
+			return fmt.Errorf("FSM backend %s requires an on-disk Raft log", s.FSMBackend)
+		}
+	default:
+		return fmt.Errorf("unrecognized FSM backend: %s", s.FSMBackend)
+	}
+
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	if s.LeaseReads {
+		drift := s.MaxClockDrift
+		if drift == 0 {
+			drift = DefaultMaxClockDrift
+		}
+		if heartbeat := cfg.WithDefaults().HeartbeatTimeout; drift >= heartbeat {
+			return fmt.Errorf("clock drift bound %s must be below the heartbeat timeout %s", drift, heartbeat)
+		}
+	}
+	return nil
 }
 
 // Open opens the store. If enableSingle is set, and there are no existing peers,
 // then this node becomes the first node, and therefore leader, of the cluster.
-// localID should be the server identifier for this node.
-func (s *Store) Open(enableSingle bool, localID string) error {
+// localID should be the server identifier for this node. cfg configures the
+// Raft node, and the defaults for a 3-node cluster are used if it is nil.
+func (s *Store) Open(enableSingle bool, localID string, cfg *Config) error {
+	if err := s.Validate(cfg); err != nil {
+		return err
+	}
+	compactor, err := newCompactor(s, s.AutoCompactionMode, s.AutoCompactionRetention)
+	if err != nil {
+		return err
+	}
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	c := cfg.WithDefaults()
+
+	s.localID = localID
+
 	// Setup Raft configuration.
-	config := raft.DefaultConfig()
-	config.LocalID = raft.ServerID(localID)
+	config := c.raftConfig(localID)
+
+	if s.LeaseReads {
+		drift := s.MaxClockDrift
+		if drift == 0 {
+			drift = DefaultMaxClockDrift
+		}
+		s.reads.leaseDuration = config.HeartbeatTimeout - drift
+	}
+
+	s.batcher.maxBytes = s.MaxBatchBytes
+	if s.batcher.maxBytes <= 0 {
+		s.batcher.maxBytes = DefaultMaxBatchBytes
+	}
+	s.batcher.linger = s.BatchLinger
 
 	// Setup Raft communication.
 	addr, err := net.ResolveTCPAddr("tcp", s.RaftBind)
 	if err != nil {
 		return err
 	}
-	transport, err := raft.NewTCPTransport(s.RaftBind, addr, 3, 10*time.Second, os.Stderr)
+	transport, err := raft.NewTCPTransport(s.RaftBind, addr, c.TransportMaxPool, c.TransportTimeout, os.Stderr)
 	if err != nil {
 		return err
 	}
 
 	// Create the snapshot store. This allows the Raft to truncate the log.
-	snapshots, err := raft.NewFileSnapshotStore(s.RaftDir, retainSnapshotCount, os.Stderr)
+	snapshots, err := raft.NewFileSnapshotStore(s.RaftDir, c.RetainSnapshots, os.Stderr)
 	if err != nil {
 		return fmt.Errorf("file snapshot store: %s", err)
 	}
@@ -97,12 +279,22 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 		stableStore = boltDB
 	}
 
+	// With a persistent FSM, Raft must not restore the latest snapshot over
+	// the state on disk, which is at least as recent.
+	if s.FSMBackend == FSMBackendBolt {
+		if err := (*fsm)(s).loadBolt(filepath.Join(s.RaftDir, boltFile), snapshots); err != nil {
+			return err
+		}
+		config.NoSnapshotRestoreOnStart = true
+	}
+
 	// Instantiate the Raft systems.
 	ra, err := raft.NewRaft(config, (*fsm)(s), logStore, stableStore, snapshots, transport)
 	if err != nil {
 		return fmt.Errorf("new raft: %s", err)
 	}
 	s.raft = ra
+	s.logStore = logStore
 
 	if enableSingle {
 		configuration := raft.Configuration{
@@ -116,37 +308,73 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 		ra.BootstrapCluster(configuration)
 	}
 
+	if compactor != nil {
+		go compactor.run(s.done)
+	}
+	go s.lessor.run(s.done)
+	if s.LeaseReads {
+		go s.reads.renewLeases(s.done)
+	}
+	if s.NodeMeta != nil {
+		go s.register(s.NodeMeta, s.done)
+	}
+	go s.generateForwardKey(s.done)
+
 	return nil
 }
 
+// Close shuts down the store.
+func (s *Store) Close() error {
+	close(s.done)
+	s.forwarder.close()
+	err := s.raft.Shutdown().Error()
+	if c, ok := s.logStore.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.bolt != nil {
+		(*fsm)(s).commitBolt()
+		if cerr := s.bolt.close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
 // Get returns the value for the given key.
 // 如果 decode 为 true，尝试解码 JSON 格式的值
-func (s *Store) Get(key string, decode bool) (string, error) {
+func (s *Store) Get(key []byte, decode bool) ([]byte, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	value, exists := s.m[key]
+	it, _ := s.kv.Get(kvItem{key: key})
+	r, exists := it.latest()
 	if !exists {
-		return "", fmt.Errorf("key not found")
+		return nil, ErrKeyNotFound
 	}
+	value := bytes.Clone(r.value)
 
 	if decode {
 		// 尝试解析 JSON
 		var decodedValue interface{}
-		err := json.Unmarshal([]byte(value), &decodedValue)
+		err := json.Unmarshal(value, &decodedValue)
 		if err == nil {
 			// 如果解析成功，转换为字符串
 			switch v := decodedValue.(type) {
 			case string:
-				return v, nil
+				return []byte(v), nil
 			case float64:
-				return fmt.Sprintf("%f", v), nil
+				return []byte(fmt.Sprintf("%f", v)), nil
 			case bool:
-				return fmt.Sprintf("%v", v), nil
+				return []byte(fmt.Sprintf("%v", v)), nil
 			default:
 				// 对于复杂类型，返回 JSON 字符串
 				jsonStr, _ := json.Marshal(v)
-				return string(jsonStr), nil
+				return jsonStr, nil
 			}
 		}
 	}
@@ -154,48 +382,170 @@ func (s *Store) Get(key string, decode bool) (string, error) {
 	return value, nil
 }
 
-// Set sets the value for the given key.
-func (s *Store) Set(key, value string) error {
-	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+// Range returns the key-value pairs in the range described by start and end,
+// sorted by key. If end is empty only start itself is looked up, if end is
+// "\x00" every key greater than or equal to start is returned, otherwise the
+// range is [start, end). A limit of zero or less means no limit.
+func (s *Store) Range(start, end []byte, limit int) *RangeResult {
+	r, _ := s.RangeAt(start, end, limit, 0)
+	return r
+}
+
+// RangeAt is like Range, but reads the key-value store as it was at the given
+// revision. A revision of zero or less reads the current revision. It
+// returns ErrCompacted if the revision has been compacted, and ErrFutureRev
+// if the revision is ahead of the store.
+func (s *Store) RangeAt(start, end []byte, limit int, rev int64) (*RangeResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rev > s.rev {
+		return nil, ErrFutureRev
+	} else if rev > 0 && rev < s.compactRev {
+		return nil, ErrCompacted
 	}
 
-	c := &command{
-		Op:    "set",
-		Key:   key,
-		Value: value,
+	r := &RangeResult{Revision: s.rev}
+	r.KVs, r.Count = s.rangeLocked(start, end, limit, rev)
+	return r, nil
+}
+
+// rangeLocked returns up to limit key-value pairs in the range, as of the
+// given revision, along with the total number of keys in the range. A
+// revision of zero or less reads the latest version of every key. The caller
+// must hold the lock.
+func (s *Store) rangeLocked(start, end []byte, limit int, rev int64) ([]KeyValue, int) {
+	var kvs []KeyValue
+	count := 0
+	ascendRange(s.kv, start, end, func(it kvItem) bool {
+		var kr keyRev
+		var ok bool
+		if rev > 0 {
+			kr, ok = it.at(rev)
+		} else {
+			kr, ok = it.latest()
+		}
+		if !ok {
+			return true
+		}
+		if limit <= 0 || len(kvs) < limit {
+			kvs = append(kvs, it.keyValue(kr))
+		}
+		count++
+		return true
+	})
+	return kvs, count
+}
+
+// Revision returns the current revision of the store. The revision is
+// cluster-wide: it is advanced only by committed Raft log entries which
+// modify the key-value store, so every node reports the same revision once
+// it has applied the same log index.
+func (s *Store) Revision() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rev
+}
+
+// Set sets the value for the given key.
+func (s *Store) Set(key, value []byte) error {
+	_, err := s.Put(key, value, PutOptions{})
+	return err
+}
+
+// Put sets the value for the given key, and returns the revision at which
+// the change was made. The previous key-value pair is read atomically with
+// the put, when requested by opts.
+func (s *Store) Put(key, value []byte, opts PutOptions) (*PutResult, error) {
+	if err := s.checkQuota(); err != nil {
+		return nil, err
 	}
-	b, err := json.Marshal(c)
+	resp, err := s.apply(&command{
+		Op:          "set",
+		Key:         key,
+		Value:       value,
+		PrevKV:      opts.PrevKV,
+		IgnoreValue: opts.IgnoreValue,
+		IgnoreLease: opts.IgnoreLease,
+		Lease:       opts.Lease,
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+	return resp.(*PutResult), nil
 }
 
 // Delete deletes the given key.
-func (s *Store) Delete(key string) error {
+func (s *Store) Delete(key []byte) error {
+	_, err := s.DeleteRange(key, nil, false)
+	return err
+}
+
+// DeleteRange atomically deletes every key in the range described by start
+// and end, which follows the same rules as Range. It returns the number of
+// keys deleted along with the resulting revision and, if prevKV is set, the
+// deleted key-value pairs.
+func (s *Store) DeleteRange(start, end []byte, prevKV bool) (*DeleteResult, error) {
+	resp, err := s.apply(&command{
+		Op:     "delete",
+		Key:    start,
+		End:    end,
+		PrevKV: prevKV,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*DeleteResult), nil
+}
+
+// apply replicates the command via Raft, and returns the response of the
+// FSM once the command has been applied on this node. On other nodes than
+// the leader, the command is forwarded to the leader.
+func (s *Store) apply(c *command) (interface{}, error) {
 	if s.raft.State() != raft.Leader {
-		return fmt.Errorf("not leader")
+		return s.forwarder.forward(c)
 	}
+	resp, _, err := s.applyLocal(c)
+	return resp, err
+}
 
-	c := &command{
-		Op:  "delete",
-		Key: key,
+// applyLocal replicates the command via Raft, which requires this node to be
+// the leader, and returns the response of the FSM along with the index of
+// the command. Writes to keys are batched with concurrent writes, if
+// BatchWrites is set.
+func (s *Store) applyLocal(c *command) (interface{}, uint64, error) {
+	if s.raft.State() != raft.Leader {
+		return nil, 0, ErrNotLeader
 	}
-	b, err := json.Marshal(c)
+
+	b, err := encodeCommand(c)
 	if err != nil {
-		return err
+		return nil, 0, err
+	}
+
+	if s.BatchWrites && batchable(c.Op) {
+		return s.batcher.apply(b)
 	}
+	return s.applyEntry(b)
+}
 
+// applyEntry appends the encoded command to the Raft log, and returns the
+// response of the FSM along with the index of the entry.
+func (s *Store) applyEntry(b []byte) (interface{}, uint64, error) {
 	f := s.raft.Apply(b, raftTimeout)
-	return f.Error()
+	if err := f.Error(); err != nil {
+		return nil, 0, err
+	}
+	if err, ok := f.Response().(error); ok {
+		return nil, f.Index(), err
+	}
+	return f.Response(), f.Index(), nil
 }
 
 // Join joins a node, identified by nodeID and located at addr, to this store.
 // The node must be ready to respond to Raft communications at that address.
-func (s *Store) Join(nodeID, addr string) error {
+// The metadata of the node, if any, is recorded once it has joined.
+func (s *Store) Join(nodeID, addr string, meta map[string]string) error {
 	s.logger.Printf("received join request for remote node %s at %s", nodeID, addr)
 
 	configFuture := s.raft.GetConfiguration()
@@ -212,7 +562,7 @@ func (s *Store) Join(nodeID, addr string) error {
 			// a join operation -- is needed.
 			if srv.Address == raft.ServerAddress(addr) && srv.ID == raft.ServerID(nodeID) {
 				s.logger.Printf("node %s at %s already member of cluster, ignoring join request", nodeID, addr)
-				return nil
+				return s.joinMeta(nodeID, meta)
 			}
 
 			future := s.raft.RemoveServer(srv.ID, 0, 0)
@@ -222,87 +572,379 @@ func (s *Store) Join(nodeID, addr string) error {
 		}
 	}
 
+	// The joining node learns the forwarding key of the cluster from the
+	// log, and needs it to make requests to the leader.
+	if err := s.initForwardKey(); err != nil {
+		return err
+	}
+
 	f := s.raft.AddVoter(raft.ServerID(nodeID), raft.ServerAddress(addr), 0, 0)
 	if f.Error() != nil {
 		return f.Error()
 	}
 	s.logger.Printf("node %s at %s joined successfully", nodeID, addr)
-	return nil
+	return s.joinMeta(nodeID, meta)
+}
+
+// joinMeta records the metadata sent by a joining node, unless it is already
+// recorded.
+func (s *Store) joinMeta(nodeID string, meta map[string]string) error {
+	if len(meta) == 0 || reflect.DeepEqual(s.Meta(nodeID), meta) {
+		return nil
+	}
+	return s.SetMeta(nodeID, meta)
 }
 
 type fsm Store
 
 // Apply applies a Raft log entry to the key-value store.
 func (f *fsm) Apply(l *raft.Log) interface{} {
+	defer f.setApplied(l.Index)
+
+	// The persistent FSM already holds the effects of the entries it
+	// applied before a restart.
+	if l.Index <= f.durable {
+		return nil
+	}
+
+	// An entry which cannot be applied fails on every node alike, and must
+	// not stop the node: its command returns an error instead.
 	var c command
-	if err := json.Unmarshal(l.Data, &c); err != nil {
-		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
+	if err := decodeCommand(l.Data, &c); err != nil {
+		f.logger.Printf("failed to decode command at index %d: %s", l.Index, err)
+		return fmt.Errorf("failed to decode command: %w", err)
+	}
+	if c.Op == "batch" {
+		return f.applyBatch(c.Batch)
 	}
+	return f.applyCommand(&c)
+}
 
+// applyCommand applies a single command, and returns its response.
+func (f *fsm) applyCommand(c *command) interface{} {
 	switch c.Op {
 	case "set":
-		return f.applySet(c.Key, c.Value)
+		return f.applySet(c.Key, c.Value, PutOptions{
+			PrevKV:      c.PrevKV,
+			IgnoreValue: c.IgnoreValue,
+			IgnoreLease: c.IgnoreLease,
+			Lease:       c.Lease,
+		})
 	case "delete":
-		return f.applyDelete(c.Key)
+		return f.applyDelete(c.Key, c.End, c.PrevKV)
+	case "compact":
+		return f.applyCompact(c.Revision)
+	case "lease_grant":
+		return f.applyLeaseGrant(c.Lease, c.TTL)
+	case "lease_revoke":
+		return f.applyLeaseRevoke(c.Lease)
+	case "meta":
+		return f.applyMeta(string(c.Key), c.Meta)
+	case "forward_key":
+		return f.applyForwardKey(c.Value)
+	case "alarm_activate":
+		return f.applyAlarm(string(c.Key), string(c.Value), true)
+	case "alarm_deactivate":
+		return f.applyAlarm(string(c.Key), string(c.Value), false)
+	case "auth":
+		if c.Auth == nil {
+			return errors.New("auth command without action")
+		}
+		return f.applyAuth(c.Auth)
+	case "txn":
+		var req pb.TxnRequest
+		if err := req.Unmarshal(c.Txn); err != nil {
+			return fmt.Errorf("failed to unmarshal txn: %w", err)
+		}
+		if err := checkTxn(&req); err != nil {
+			return err
+		}
+		return f.applyTxn(&req)
 	default:
-		panic(fmt.Sprintf("unrecognized command op: %s", c.Op))
+		return fmt.Errorf("unrecognized command op: %s", c.Op)
 	}
 }
 
-// Snapshot returns a snapshot of the key-value store.
+// Snapshot returns a snapshot of the key-value store. The index is cloned
+// lazily, in constant time: the clone and the index share their nodes until
+// either is modified, so that writes continue while the snapshot is being
+// persisted. The history of a key is only ever appended to, or replaced by
+// compaction, so the revisions seen by the clone are never modified.
+//
+// With FSMBackendBolt, every applied entry is committed to the bbolt file,
+// and the snapshot is a copy of the file, made from a read transaction.
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	snap, _, err := f.snapshot(true)
+	return snap, err
+}
+
+// snapshot returns a snapshot of the key-value store, and its revision. Raft
+// never applies entries while it takes a snapshot, so the entries applied
+// but not committed to the bbolt file are committed first if commit is set.
+// Otherwise, the snapshot may not reflect them.
+func (f *fsm) snapshot(commit bool) (raft.FSMSnapshot, int64, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
-	// Clone the map.
-	o := make(map[string]string)
-	for k, v := range f.m {
-		o[k] = v
+	if f.bolt != nil {
+		if commit {
+			f.commitBolt()
+		}
+		tx, err := f.bolt.db.Begin(false)
+		if err != nil {
+			return nil, 0, err
+		}
+		o, err := readBoltState(tx)
+		if err != nil {
+			tx.Rollback()
+			return nil, 0, err
+		}
+		var rev int64
+		if o != nil {
+			rev = o.Revision
+		}
+		return &boltSnapshot{tx: tx, rev: rev}, rev, nil
+	}
+
+	o := f.state()
+	return &fsmSnapshot{state: o, kv: f.kv.(*btree.BTreeG[kvItem]).Clone()}, o.Revision, nil
+}
+
+// state returns the state of the store but the keys. The caller must hold
+// the lock.
+func (f *fsm) state() *snapshotState {
+	o := &snapshotState{
+		Revision:        f.rev,
+		CompactRevision: f.compactRev,
+		Nodes:           make(map[string]map[string]string, len(f.meta)),
+		Alarms:          append([]Alarm(nil), f.alarms...),
+		Auth:            f.auth.snapshot(),
+		AppliedIndex:    f.applied,
+		ForwardKey:      f.forwardKey,
+	}
+	for id, m := range f.meta {
+		o.Nodes[id] = m
 	}
-	return &fsmSnapshot{store: o}, nil
+	for _, l := range f.leases {
+		o.Leases = append(o.Leases, snapshotLease{ID: l.id, TTL: l.ttl})
+	}
+	return o
 }
 
-// Restore stores the key-value store to a previous state.
+// Restore stores the key-value store to a previous state. The snapshot is
+// decoded as it is read, rather than read into memory first.
 func (f *fsm) Restore(rc io.ReadCloser) error {
-	o := make(map[string]string)
-	if err := json.NewDecoder(rc).Decode(&o); err != nil {
+	sr := newSnapshotRestorer(f.RaftDir, f.bolt != nil)
+	if err := sr.restore(rc); err != nil {
+		sr.discard()
 		return err
 	}
 
-	// Set the state from the snapshot, no lock required according to
-	// Hashicorp docs.
-	f.m = o
+	// Set the state from the snapshot. No lock is required by Raft, but
+	// watchers must not observe a partially restored store, and must catch
+	// up from the restored history.
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.install(sr)
+	if f.bolt != nil {
+		if err := f.installBolt(sr.kv.(*boltIndex)); err != nil {
+			panic(fmt.Sprintf("failed to install restored bbolt file: %s", err.Error()))
+		}
+	}
+	f.resyncWatchers()
 	return nil
 }
 
-func (f *fsm) applySet(key, value string) interface{} {
+// install sets the state of the store to the restored state. The caller
+// must hold the lock.
+func (f *fsm) install(sr *snapshotRestorer) {
+	f.kv = sr.kv
+	f.rev = sr.rev
+	f.compactRev = sr.compactRev
+	f.keys = sr.keys
+	f.leases = sr.leases
+	f.meta = sr.meta
+	f.alarms = sr.alarms
+	f.auth = sr.auth
+	if sr.forwardKey != nil {
+		// Snapshots taken before the key was generated do not hold it.
+		f.forwardKey = sr.forwardKey
+	}
+	if sr.applied > f.applied {
+		f.applied = sr.applied
+	}
+	f.size = indexSize(sr.kv)
+	f.lessor.restore(sr.leases)
+}
+
+func (f *fsm) applySet(key, value []byte, opts PutOptions) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	f.m[key] = value
-	return nil
+
+	if f.noSpace() {
+		return ErrNoSpace
+	}
+	prev, err := f.checkPut(key, opts)
+	if err != nil {
+		return err
+	}
+	lease := opts.Lease
+	if opts.IgnoreValue {
+		value = prev.Value
+	}
+	if opts.IgnoreLease {
+		lease = prev.Lease
+	}
+
+	f.rev++
+	f.put(key, value, lease, f.rev)
+	r := &PutResult{Revision: f.rev}
+	if opts.PrevKV {
+		r.PrevKV = prev
+	}
+	return r
 }
 
-func (f *fsm) applyDelete(key string) interface{} {
+// checkPut returns the current version of the key, or nil if it does not
+// exist, and checks that the key exists if opts require it to. The caller
+// must hold the lock.
+func (f *fsm) checkPut(key []byte, opts PutOptions) (*KeyValue, error) {
+	var prev *KeyValue
+	it, _ := f.kv.Get(kvItem{key: key})
+	if r, ok := it.latest(); ok {
+		kv := it.keyValue(r)
+		prev = &kv
+	}
+	if prev == nil && (opts.IgnoreValue || opts.IgnoreLease) {
+		return nil, ErrKeyNotFound
+	}
+	if !opts.IgnoreLease && opts.Lease != 0 && f.leases[opts.Lease] == nil {
+		return nil, ErrLeaseNotFound
+	}
+	return prev, nil
+}
+
+func (f *fsm) applyDelete(start, end []byte, prevKV bool) interface{} {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	delete(f.m, key)
-	return nil
+
+	// Like etcd, a delete which removes no key does not advance the
+	// revision.
+	deleted := f.deleteRange(start, end, f.rev+1)
+	if len(deleted) > 0 {
+		f.rev++
+	}
+	r := &DeleteResult{Revision: f.rev, Deleted: int64(len(deleted))}
+	if prevKV {
+		r.PrevKVs = deleted
+	}
+	return r
+}
+
+// put writes a new version of the key at revision rev, attached to the given
+// lease. The caller must hold the lock, and advance the store revision.
+func (f *fsm) put(key, value []byte, lease, rev int64) {
+	r := keyRev{value: value, createRev: rev, modRev: rev, version: 1, lease: lease}
+	it, _ := f.kv.Get(kvItem{key: key})
+	ev := Event{Type: EventPut}
+	if prev, ok := it.latest(); ok {
+		r.createRev = prev.createRev
+		r.version = prev.version + 1
+		prevKV := it.keyValue(prev)
+		ev.PrevKV = &prevKV
+		f.detach(key, prev.lease)
+	} else {
+		f.keys++
+	}
+	f.attach(key, lease)
+	it.key = key
+	it.revs = append(it.revs, r)
+	f.kv.ReplaceOrInsert(it)
+	f.size += revSize(key, r)
+
+	ev.KV = it.keyValue(r)
+	f.notify(ev)
+}
+
+// del deletes the key at revision rev, and returns whether the key existed.
+// The caller must hold the lock, and advance the store revision if the key
+// existed.
+func (f *fsm) del(key []byte, rev int64) bool {
+	it, _ := f.kv.Get(kvItem{key: key})
+	prev, ok := it.latest()
+	if !ok {
+		return false
+	}
+	prevKV := it.keyValue(prev)
+	f.detach(key, prev.lease)
+
+	// Keep the key in the index with a tombstone, so that it can still be
+	// read at older revisions.
+	it.revs = append(it.revs, keyRev{modRev: rev, tombstone: true})
+	f.kv.ReplaceOrInsert(it)
+	f.keys--
+	f.size += revSize(key, keyRev{})
+
+	f.notify(Event{
+		Type:   EventDelete,
+		KV:     KeyValue{Key: bytes.Clone(key), ModRevision: rev},
+		PrevKV: &prevKV,
+	})
+	return true
+}
+
+// snapshotState is the content of a snapshot, JSON-encoded in snapshots
+// taken before the binary format. The keys of binary snapshots are written
+// from the index instead of KVs.
+type snapshotState struct {
+	Revision        int64           `json:"revision"`
+	CompactRevision int64           `json:"compact_revision,omitempty"`
+	KVs             []snapshotKV    `json:"kvs"`
+	Leases          []snapshotLease `json:"leases,omitempty"`
+
+	Nodes  map[string]map[string]string `json:"nodes,omitempty"` // Metadata of the nodes.
+	Alarms []Alarm                      `json:"alarms,omitempty"`
+	Auth   *snapshotAuth                `json:"auth,omitempty"`
+
+	// AppliedIndex is the index of the last entry applied by the FSM.
+	AppliedIndex uint64 `json:"applied_index,omitempty"`
+
+	// ForwardKey is the key signing the requests nodes make to the leader.
+	ForwardKey []byte `json:"forward_key,omitempty"`
+}
+
+// snapshotKV is a single revision of a key in a snapshot. Keys and values
+// are base64-encoded, as JSON strings cannot hold arbitrary bytes.
+type snapshotKV struct {
+	Key            []byte `json:"k"`
+	Value          []byte `json:"v,omitempty"`
+	CreateRevision int64  `json:"create_revision"`
+	ModRevision    int64  `json:"mod_revision"`
+	Version        int64  `json:"version"`
+	Lease          int64  `json:"lease,omitempty"`
+	Tombstone      bool   `json:"tombstone,omitempty"`
+
+	// LegacyKey and LegacyValue hold the key and the value in snapshots
+	// taken before they were base64-encoded.
+	LegacyKey   string `json:"key,omitempty"`
+	LegacyValue string `json:"value,omitempty"`
+}
+
+// snapshotLease is a granted lease in a snapshot.
+type snapshotLease struct {
+	ID  int64 `json:"id"`
+	TTL int64 `json:"ttl"`
 }
 
 type fsmSnapshot struct {
-	store map[string]string
+	state *snapshotState        // The state of the store, but the keys.
+	kv    *btree.BTreeG[kvItem] // A frozen clone of the index.
 }
 
 func (f *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
 	err := func() error {
-		// Encode data.
-		b, err := json.Marshal(f.store)
-		if err != nil {
-			return err
-		}
-
-		// Write data to sink.
-		if _, err := sink.Write(b); err != nil {
+		// Stream the records to the sink.
+		if err := writeSnapshot(sink, f.state, f.kv); err != nil {
 			return err
 		}
 
@@ -323,22 +965,31 @@ func (f *fsmSnapshot) Release() {}
 func (s *Store) Count() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return len(s.m)
+	return s.keys
 }
 
-// ListN 返回前 N 条键值对，支持可选的解码参数
+// ListN 返回按键排序的前 N 条键值对，支持可选的解码参数
 func (s *Store) ListN(n int, decode bool) map[string]string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// 如果 n 大于当前存储的键值对数量，返回所有键值对
-	if n > len(s.m) {
-		n = len(s.m)
+	if n > s.keys {
+		n = s.keys
 	}
 
 	result := make(map[string]string)
+	if n <= 0 {
+		return result
+	}
 	count := 0
-	for k, v := range s.m {
+	s.kv.Ascend(func(it kvItem) bool {
+		// 跳过已删除的键
+		r, ok := it.latest()
+		if !ok {
+			return true
+		}
+		k, v := string(it.key), string(r.value)
 		if decode {
 			// 尝试解码
 			var decodedValue interface{}
@@ -366,10 +1017,8 @@ func (s *Store) ListN(n int, decode bool) map[string]string {
 		}
 
 		count++
-		if count >= n {
-			break
-		}
-	}
+		return count < n
+	})
 
 	return result
 }
@@ -1,10 +1,30 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/hashicorp/raft"
+	bolt "go.etcd.io/bbolt"
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -21,7 +41,7 @@ func Test_StoreOpen(t *testing.T) {
 		t.Fatalf("failed to create store")
 	}
 
-	if err := s.Open(false, "node0"); err != nil {
+	if err := s.Open(false, "node0", nil); err != nil {
 		t.Fatalf("failed to open store: %s", err)
 	}
 }
@@ -38,39 +58,36 @@ func Test_StoreOpenSingleNode(t *testing.T) {
 		t.Fatalf("failed to create store")
 	}
 
-	if err := s.Open(true, "node0"); err != nil {
+	if err := s.Open(true, "node0", nil); err != nil {
 		t.Fatalf("failed to open store: %s", err)
 	}
 
 	// Simple way to ensure there is a leader.
 	time.Sleep(3 * time.Second)
 
-	if err := s.Set("foo", "bar"); err != nil {
+	if err := s.Set([]byte("foo"), []byte("bar")); err != nil {
 		t.Fatalf("failed to set key: %s", err.Error())
 	}
 
 	// Wait for committed log entry to be applied.
 	time.Sleep(500 * time.Millisecond)
-	value, err := s.Get("foo")
+	value, err := s.Get([]byte("foo"), false)
 	if err != nil {
 		t.Fatalf("failed to get key: %s", err.Error())
 	}
-	if value != "bar" {
+	if string(value) != "bar" {
 		t.Fatalf("key has wrong value: %s", value)
 	}
 
-	if err := s.Delete("foo"); err != nil {
+	if err := s.Delete([]byte("foo")); err != nil {
 		t.Fatalf("failed to delete key: %s", err.Error())
 	}
 
 	// Wait for committed log entry to be applied.
 	time.Sleep(500 * time.Millisecond)
-	value, err = s.Get("foo")
-	if err != nil {
-		t.Fatalf("failed to get key: %s", err.Error())
-	}
-	if value != "" {
-		t.Fatalf("key has wrong value: %s", value)
+	value, err = s.Get([]byte("foo"), false)
+	if err == nil {
+		t.Fatalf("expected error getting deleted key, got value: %s", value)
 	}
 }
 
@@ -87,47 +104,2004 @@ func Test_StoreInMemOpenSingleNode(t *testing.T) {
 		t.Fatalf("failed to create store")
 	}
 
-	if err := s.Open(true, "node0"); err != nil {
+	if err := s.Open(true, "node0", nil); err != nil {
 		t.Fatalf("failed to open store: %s", err)
 	}
 
 	// Simple way to ensure there is a leader.
 	time.Sleep(3 * time.Second)
 
-	if err := s.Set("foo", "bar"); err != nil {
+	if err := s.Set([]byte("foo"), []byte("bar")); err != nil {
 		t.Fatalf("failed to set key: %s", err.Error())
 	}
 
 	// Wait for committed log entry to be applied.
 	time.Sleep(500 * time.Millisecond)
-	value, err := s.Get("foo")
+	value, err := s.Get([]byte("foo"), false)
 	if err != nil {
 		t.Fatalf("failed to get key: %s", err.Error())
 	}
-	if value != "bar" {
+	if string(value) != "bar" {
 		t.Fatalf("key has wrong value: %s", value)
 	}
 
-	if err := s.Delete("foo"); err != nil {
+	if err := s.Delete([]byte("foo")); err != nil {
 		t.Fatalf("failed to delete key: %s", err.Error())
 	}
 
 	// Wait for committed log entry to be applied.
 	time.Sleep(500 * time.Millisecond)
-	value, err = s.Get("foo")
+	value, err = s.Get([]byte("foo"), false)
+	if err == nil {
+		t.Fatalf("expected error getting deleted key, got value: %s", value)
+	}
+}
+
+// Test_StoreRange tests that range queries return sorted results for single
+// key, [start, end), prefix and from-key ranges.
+func Test_StoreRange(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	for _, k := range []string{"foo/c", "bar", "foo/a", "foo0", "foo/b", "zoo"} {
+		f.applySet([]byte(k), []byte("v-"+k), PutOptions{})
+	}
+
+	keys := func(r *RangeResult) []string {
+		var ks []string
+		for _, kv := range r.KVs {
+			ks = append(ks, string(kv.Key))
+		}
+		return ks
+	}
+
+	tests := []struct {
+		name       string
+		start, end string
+		limit      int
+		exp        []string
+		count      int
+	}{
+		{"single key", "foo/a", "", 0, []string{"foo/a"}, 1},
+		{"missing key", "foo", "", 0, nil, 0},
+		{"range", "foo/a", "foo/c", 0, []string{"foo/a", "foo/b"}, 2},
+		{"prefix", "foo/", "foo0", 0, []string{"foo/a", "foo/b", "foo/c"}, 3},
+		{"from key", "foo0", "\x00", 0, []string{"foo0", "zoo"}, 2},
+		{"all keys", "\x00", "\x00", 0, []string{"bar", "foo/a", "foo/b", "foo/c", "foo0", "zoo"}, 6},
+		{"limit", "foo/", "foo0", 2, []string{"foo/a", "foo/b"}, 3},
+		{"empty range", "zoo", "foo", 0, nil, 0},
+	}
+	for _, tt := range tests {
+		r := s.Range([]byte(tt.start), []byte(tt.end), tt.limit)
+		if got := keys(r); !reflect.DeepEqual(got, tt.exp) {
+			t.Fatalf("%s: wrong keys, exp %v, got %v", tt.name, tt.exp, got)
+		}
+		if r.Count != tt.count {
+			t.Fatalf("%s: wrong count, exp %d, got %d", tt.name, tt.count, r.Count)
+		}
+	}
+
+	if v := s.Range([]byte("bar"), []byte(""), 0).KVs[0].Value; string(v) != "v-bar" {
+		t.Fatalf("wrong value for bar: %s", v)
+	}
+}
+
+// Test_StoreRevisions tests that puts and deletes maintain the store revision
+// and the per-key create revision, mod revision and version.
+func Test_StoreRevisions(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	f.applySet([]byte("foo"), []byte("bar"), PutOptions{})
+	f.applySet([]byte("baz"), []byte("qux"), PutOptions{})
+	if r := f.applySet([]byte("foo"), []byte("bar2"), PutOptions{}).(*PutResult); r.Revision != 3 {
+		t.Fatalf("wrong revision after put, exp 3, got %d", r.Revision)
+	}
+
+	kv := s.Range([]byte("foo"), []byte(""), 0).KVs[0]
+	if kv.CreateRevision != 1 || kv.ModRevision != 3 || kv.Version != 2 {
+		t.Fatalf("wrong revisions for foo: %+v", kv)
+	}
+
+	if r := f.applyDelete([]byte("nope"), nil, false).(*DeleteResult); r.Revision != 3 || r.Deleted != 0 {
+		t.Fatalf("deleting missing key changed the store: %+v", r)
+	}
+	if r := f.applyDelete([]byte("foo"), nil, false).(*DeleteResult); r.Revision != 4 || r.Deleted != 1 {
+		t.Fatalf("wrong result for delete: %+v", r)
+	}
+
+	f.applySet([]byte("foo"), []byte("bar3"), PutOptions{})
+	kv = s.Range([]byte("foo"), []byte(""), 0).KVs[0]
+	if kv.CreateRevision != 5 || kv.ModRevision != 5 || kv.Version != 1 {
+		t.Fatalf("wrong revisions for recreated foo: %+v", kv)
+	}
+	if rev := s.Revision(); rev != 5 {
+		t.Fatalf("wrong store revision, exp 5, got %d", rev)
+	}
+}
+
+// Test_StorePutOptions tests that puts return the previous key-value pair,
+// and can keep the current value of a key.
+func Test_StorePutOptions(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+
+	r := f.applySet([]byte("foo"), []byte("v1"), PutOptions{PrevKV: true}).(*PutResult)
+	if r.PrevKV != nil {
+		t.Fatalf("previous key-value returned for new key: %+v", r.PrevKV)
+	}
+	r = f.applySet([]byte("foo"), []byte("v2"), PutOptions{PrevKV: true}).(*PutResult)
+	if r.PrevKV == nil || string(r.PrevKV.Value) != "v1" || r.PrevKV.ModRevision != 1 || r.Revision != 2 {
+		t.Fatalf("wrong previous key-value: %+v", r.PrevKV)
+	}
+
+	f.applySet([]byte("foo"), nil, PutOptions{IgnoreValue: true})
+	if v, _ := s.Get([]byte("foo"), false); string(v) != "v2" {
+		t.Fatalf("value not kept with IgnoreValue, got %s", v)
+	}
+	if kv := s.Range([]byte("foo"), []byte(""), 0).KVs[0]; kv.Version != 3 {
+		t.Fatalf("put with IgnoreValue did not update version: %+v", kv)
+	}
+
+	if err := f.applySet([]byte("missing"), nil, PutOptions{IgnoreValue: true}); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	if rev := s.Revision(); rev != 3 {
+		t.Fatalf("failed put changed the revision: %d", rev)
+	}
+
+	resp := f.applyTxn(&pb.TxnRequest{Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestPut{
+		RequestPut: &pb.PutRequest{Key: []byte("foo"), Value: []byte("v3"), PrevKv: true}}}}}).(*pb.TxnResponse)
+	if prev := resp.Responses[0].GetResponsePut().PrevKv; prev == nil || string(prev.Value) != "v2" {
+		t.Fatalf("wrong previous key-value for put in txn: %v", prev)
+	}
+	if err := f.applyTxn(&pb.TxnRequest{Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestPut{
+		RequestPut: &pb.PutRequest{Key: []byte("missing"), IgnoreValue: true}}}}}); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound for put in txn, got %v", err)
+	}
+}
+
+// Test_StoreDeleteRange tests that range deletes remove every key in the
+// range at a single revision, and report what was deleted.
+func Test_StoreDeleteRange(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	for _, k := range []string{"foo/a", "foo/b", "foo/c", "foo0"} {
+		f.applySet([]byte(k), []byte("v-"+k), PutOptions{})
+	}
+
+	r := f.applyDelete([]byte("foo/"), []byte("foo0"), true).(*DeleteResult)
+	if r.Deleted != 3 || r.Revision != 5 || len(r.PrevKVs) != 3 {
+		t.Fatalf("wrong result for prefix delete: %+v", r)
+	}
+	if string(r.PrevKVs[1].Key) != "foo/b" || string(r.PrevKVs[1].Value) != "v-foo/b" || r.PrevKVs[1].ModRevision != 2 {
+		t.Fatalf("wrong previous key-value: %+v", r.PrevKVs[1])
+	}
+	if c := s.Count(); c != 1 {
+		t.Fatalf("wrong count after prefix delete, exp 1, got %d", c)
+	}
+	for _, kv := range s.Range([]byte("foo/"), []byte("foo0"), 0).KVs {
+		t.Fatalf("key %s not deleted", kv.Key)
+	}
+
+	r = f.applyDelete([]byte("foo/"), []byte("foo0"), false).(*DeleteResult)
+	if r.Deleted != 0 || r.Revision != 5 || r.PrevKVs != nil {
+		t.Fatalf("wrong result for empty delete: %+v", r)
+	}
+
+	r = f.applyDelete([]byte("\x00"), []byte("\x00"), false).(*DeleteResult)
+	if r.Deleted != 1 || r.Revision != 6 || s.Count() != 0 {
+		t.Fatalf("wrong result deleting all keys: %+v", r)
+	}
+}
+
+// Test_StoreRangeAt tests that the key-value store can be read as of past
+// revisions.
+func Test_StoreRangeAt(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	f.applySet([]byte("foo"), []byte("v1"), PutOptions{}) // rev 1
+	f.applySet([]byte("bar"), []byte("v1"), PutOptions{}) // rev 2
+	f.applySet([]byte("foo"), []byte("v2"), PutOptions{}) // rev 3
+	f.applyDelete([]byte("bar"), nil, false)              // rev 4
+	f.applySet([]byte("bar"), []byte("v2"), PutOptions{}) // rev 5
+
+	values := func(rev int64) map[string]string {
+		r, err := s.RangeAt([]byte("\x00"), []byte("\x00"), 0, rev)
+		if err != nil {
+			t.Fatalf("failed to range at revision %d: %s", rev, err)
+		}
+		m := make(map[string]string)
+		for _, kv := range r.KVs {
+			m[string(kv.Key)] = string(kv.Value)
+		}
+		return m
+	}
+
+	exp := map[int64]map[string]string{
+		1: {"foo": "v1"},
+		2: {"foo": "v1", "bar": "v1"},
+		3: {"foo": "v2", "bar": "v1"},
+		4: {"foo": "v2"},
+		5: {"foo": "v2", "bar": "v2"},
+	}
+	for rev, m := range exp {
+		if got := values(rev); !reflect.DeepEqual(got, m) {
+			t.Fatalf("wrong values at revision %d, exp %v, got %v", rev, m, got)
+		}
+	}
+
+	r, _ := s.RangeAt([]byte("bar"), []byte(""), 0, 2)
+	if kv := r.KVs[0]; kv.ModRevision != 2 || kv.Version != 1 || r.Revision != 5 {
+		t.Fatalf("wrong revisions reading bar at revision 2: %+v (store revision %d)", kv, r.Revision)
+	}
+	if c := s.Count(); c != 2 {
+		t.Fatalf("wrong count, exp 2, got %d", c)
+	}
+
+	if _, err := s.RangeAt([]byte("foo"), []byte(""), 0, 6); err != ErrFutureRev {
+		t.Fatalf("expected ErrFutureRev, got %v", err)
+	}
+	s.compactRev = 3
+	if _, err := s.RangeAt([]byte("foo"), []byte(""), 0, 2); err != ErrCompacted {
+		t.Fatalf("expected ErrCompacted, got %v", err)
+	}
+}
+
+// Test_StoreCompact tests that compaction discards history before the
+// compaction revision, but keeps the store readable at that revision.
+func Test_StoreCompact(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	f.applySet([]byte("foo"), []byte("v1"), PutOptions{}) // rev 1
+	f.applySet([]byte("bar"), []byte("v1"), PutOptions{}) // rev 2
+	f.applySet([]byte("foo"), []byte("v2"), PutOptions{}) // rev 3
+	f.applyDelete([]byte("bar"), nil, false)              // rev 4
+	f.applySet([]byte("baz"), []byte("v1"), PutOptions{}) // rev 5
+	f.applySet([]byte("foo"), []byte("v3"), PutOptions{}) // rev 6
+
+	if err := f.applyCompact(7); err != ErrFutureRev {
+		t.Fatalf("expected ErrFutureRev compacting future revision, got %v", err)
+	}
+	if r, ok := f.applyCompact(5).(*CompactResult); !ok || r.Revision != 6 {
+		t.Fatalf("wrong result compacting: %v", r)
+	}
+	if err := f.applyCompact(5); err != ErrCompacted {
+		t.Fatalf("expected ErrCompacted compacting twice, got %v", err)
+	}
+
+	if _, err := s.RangeAt([]byte("foo"), []byte(""), 0, 4); err != ErrCompacted {
+		t.Fatalf("expected ErrCompacted reading compacted revision, got %v", err)
+	}
+	r, err := s.RangeAt([]byte("\x00"), []byte("\x00"), 0, 5)
 	if err != nil {
-		t.Fatalf("failed to get key: %s", err.Error())
+		t.Fatalf("failed to read at compaction revision: %s", err)
 	}
-	if value != "" {
-		t.Fatalf("key has wrong value: %s", value)
+	if len(r.KVs) != 2 || string(r.KVs[0].Key) != "baz" || string(r.KVs[1].Value) != "v2" {
+		t.Fatalf("wrong keys at compaction revision: %+v", r.KVs)
+	}
+
+	// The deleted key has no history left, and only the versions of foo
+	// from revision 3 onwards remain.
+	if _, ok := s.kv.Get(kvItem{key: []byte("bar")}); ok {
+		t.Fatalf("deleted key still present after compaction")
+	}
+	it, _ := s.kv.Get(kvItem{key: []byte("foo")})
+	if len(it.revs) != 2 || it.revs[0].modRev != 3 {
+		t.Fatalf("wrong history for foo after compaction: %+v", it.revs)
+	}
+	if c := s.Count(); c != 2 {
+		t.Fatalf("wrong count after compaction, exp 2, got %d", c)
 	}
 }
 
-func Test_TestRaft(t *testing.T) {
-	// Get the type of a Raft object
-	store := raft.NewInmemStore()
-	fmt.Printf("Raft implementation type: %T\n", store)
+// Test_StoreWatch tests that watchers receive live changes, replay past
+// changes from history, and catch up after falling behind.
+func Test_StoreWatch(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	f.applySet([]byte("foo/a"), []byte("v1"), PutOptions{}) // rev 1
+	f.applySet([]byte("bar"), []byte("v1"), PutOptions{})   // rev 2
+	f.applySet([]byte("foo/a"), []byte("v2"), PutOptions{}) // rev 3
 
-	// Check if your fork has any unique methods or structs
-	// that you can use to identify it
+	live, err := s.Watch([]byte("foo/"), []byte("foo0"), 0)
+	if err != nil {
+		t.Fatalf("failed to watch: %s", err)
+	}
+	defer live.Close()
+	past, err := s.Watch([]byte("foo/"), []byte("foo0"), 2)
+	if err != nil {
+		t.Fatalf("failed to watch from revision 2: %s", err)
+	}
+	defer past.Close()
+
+	f.applyDelete([]byte("foo/a"), nil, false)              // rev 4
+	f.applySet([]byte("foo/b"), []byte("v1"), PutOptions{}) // rev 5
+	f.applySet([]byte("bar"), []byte("v2"), PutOptions{})   // rev 6
+
+	<-live.Ready()
+	evs, rev, err := live.Next()
+	if err != nil {
+		t.Fatalf("failed to read events: %s", err)
+	}
+	if rev != 6 || len(evs) != 2 {
+		t.Fatalf("wrong live events at revision %d: %+v", rev, evs)
+	}
+	if evs[0].Type != EventDelete || evs[0].KV.ModRevision != 4 || evs[0].PrevKV == nil || string(evs[0].PrevKV.Value) != "v2" {
+		t.Fatalf("wrong delete event: %+v", evs[0])
+	}
+	if evs[1].Type != EventPut || string(evs[1].KV.Key) != "foo/b" || evs[1].PrevKV != nil {
+		t.Fatalf("wrong put event: %+v", evs[1])
+	}
+
+	<-past.Ready()
+	evs, _, err = past.Next()
+	if err != nil {
+		t.Fatalf("failed to read past events: %s", err)
+	}
+	if len(evs) != 3 || evs[0].KV.ModRevision != 3 || string(evs[0].PrevKV.Value) != "v1" || evs[2].KV.ModRevision != 5 {
+		t.Fatalf("wrong past events: %+v", evs)
+	}
+
+	// A watcher falling too far behind catches up from history.
+	for i := 0; i < watcherMaxPending+10; i++ {
+		f.applySet([]byte("foo/c"), []byte(fmt.Sprintf("v%d", i)), PutOptions{})
+	}
+	evs, rev, err = live.Next()
+	if err != nil {
+		t.Fatalf("failed to read events after falling behind: %s", err)
+	}
+	if len(evs) != watcherMaxPending+10 || evs[len(evs)-1].KV.ModRevision != rev {
+		t.Fatalf("wrong number of events after falling behind: %d", len(evs))
+	}
+
+	// History compacted before it was read is reported.
+	for i := 0; i < watcherMaxPending+10; i++ {
+		f.applySet([]byte("foo/c"), []byte("x"), PutOptions{})
+	}
+	f.applyCompact(s.Revision())
+	if _, _, err := live.Next(); err != ErrCompacted {
+		t.Fatalf("expected ErrCompacted after compaction, got %v", err)
+	}
+	if _, err := s.Watch([]byte("foo/"), []byte("foo0"), 2); err != ErrCompacted {
+		t.Fatalf("expected ErrCompacted watching compacted revision, got %v", err)
+	}
+}
+
+// Test_StoreAutoCompaction tests that the leader automatically compacts the
+// history in revision mode.
+func Test_StoreAutoCompaction(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	s.AutoCompactionMode = CompactionModeRevision
+	s.AutoCompactionRetention = "2"
+	if err := s.Open(true, "node0", nil); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	for i := 0; i < 5; i++ {
+		if err := s.Set([]byte("foo"), []byte(fmt.Sprintf("v%d", i))); err != nil {
+			t.Fatalf("failed to set key: %s", err.Error())
+		}
+	}
+
+	c, err := newCompactor(s, s.AutoCompactionMode, s.AutoCompactionRetention)
+	if err != nil {
+		t.Fatalf("failed to create compactor: %s", err)
+	}
+	c.compact(s.Revision() - c.retention)
+	if rev := s.CompactRevision(); rev != 3 {
+		t.Fatalf("wrong compaction revision, exp 3, got %d", rev)
+	}
+
+	if _, err := newCompactor(s, "bogus", "1"); err == nil {
+		t.Fatalf("expected error for unknown compaction mode")
+	}
+	if c, err := newCompactor(s, CompactionModePeriodic, "2"); err != nil || c.period != 2*time.Hour {
+		t.Fatalf("bare periodic retention not treated as hours: %v", err)
+	}
+}
+
+// Test_StoreTxn tests that transactions evaluate their compares and apply the
+// chosen branch atomically, at a single revision.
+func Test_StoreTxn(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	f.applySet([]byte("foo"), []byte("bar"), PutOptions{}) // rev 1
+
+	put := func(k, v string) *pb.RequestOp {
+		return &pb.RequestOp{Request: &pb.RequestOp_RequestPut{RequestPut: &pb.PutRequest{Key: []byte(k), Value: []byte(v)}}}
+	}
+	get := func(k string) *pb.RequestOp {
+		return &pb.RequestOp{Request: &pb.RequestOp_RequestRange{RequestRange: &pb.RangeRequest{Key: []byte(k)}}}
+	}
+	del := func(k, end string) *pb.RequestOp {
+		return &pb.RequestOp{Request: &pb.RequestOp_RequestDeleteRange{RequestDeleteRange: &pb.DeleteRangeRequest{Key: []byte(k), RangeEnd: []byte(end)}}}
+	}
+	valueIs := func(k, v string) *pb.Compare {
+		return &pb.Compare{Key: []byte(k), Target: pb.Compare_VALUE, Result: pb.Compare_EQUAL, TargetUnion: &pb.Compare_Value{Value: []byte(v)}}
+	}
+
+	// Succeeding compare: the puts share one revision, and reads in the
+	// transaction see its earlier writes.
+	resp := f.applyTxn(&pb.TxnRequest{
+		Compare: []*pb.Compare{valueIs("foo", "bar")},
+		Success: []*pb.RequestOp{put("foo", "baz"), put("qux", "1"), get("foo")},
+		Failure: []*pb.RequestOp{put("failed", "1")},
+	}).(*pb.TxnResponse)
+	if !resp.Succeeded || resp.Header.Revision != 2 {
+		t.Fatalf("wrong txn response: %+v", resp)
+	}
+	if kvs := resp.Responses[2].GetResponseRange().Kvs; len(kvs) != 1 || string(kvs[0].Value) != "baz" || kvs[0].ModRevision != 2 {
+		t.Fatalf("range in txn did not see txn writes: %+v", kvs)
+	}
+	if r := s.Range([]byte("qux"), []byte(""), 0); r.Count != 1 || r.KVs[0].ModRevision != 2 {
+		t.Fatalf("wrong put in txn: %+v", r)
+	}
+
+	// Failing compare on a missing key: version compare treats it as zero.
+	resp = f.applyTxn(&pb.TxnRequest{
+		Compare: []*pb.Compare{{Key: []byte("missing"), Target: pb.Compare_VERSION, Result: pb.Compare_GREATER, TargetUnion: &pb.Compare_Version{Version: 0}}},
+		Success: []*pb.RequestOp{put("missing", "1")},
+		Failure: []*pb.RequestOp{del("foo", "fop")},
+	}).(*pb.TxnResponse)
+	if resp.Succeeded || resp.Responses[0].GetResponseDeleteRange().Deleted != 1 || resp.Header.Revision != 3 {
+		t.Fatalf("wrong txn response for failed compare: %+v", resp)
+	}
+
+	// A read-only transaction does not advance the revision, and nested
+	// transactions are evaluated against the store before any write.
+	resp = f.applyTxn(&pb.TxnRequest{
+		Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestTxn{RequestTxn: &pb.TxnRequest{
+			Compare: []*pb.Compare{valueIs("qux", "1")},
+			Success: []*pb.RequestOp{get("qux")},
+		}}}},
+	}).(*pb.TxnResponse)
+	nested := resp.Responses[0].GetResponseTxn()
+	if !nested.Succeeded || nested.Responses[0].GetResponseRange().Count != 1 || resp.Header.Revision != 3 {
+		t.Fatalf("wrong nested txn response: %+v", resp)
+	}
+
+	if err := f.applyTxn(&pb.TxnRequest{Success: []*pb.RequestOp{get("foo"), {Request: &pb.RequestOp_RequestRange{
+		RequestRange: &pb.RangeRequest{Key: []byte("foo"), Revision: 10}}}}}); err != ErrFutureRev {
+		t.Fatalf("expected ErrFutureRev, got %v", err)
+	}
+
+	for _, req := range []*pb.TxnRequest{
+		{Success: []*pb.RequestOp{put("a", "1"), put("a", "2")}},
+		{Success: []*pb.RequestOp{put("a", "1"), del("a", "b")}},
+		{Success: []*pb.RequestOp{put("a", "1"), {Request: &pb.RequestOp_RequestTxn{RequestTxn: &pb.TxnRequest{
+			Failure: []*pb.RequestOp{put("a", "2")}}}}}},
+	} {
+		if err := checkTxn(req); err != ErrDuplicateKey {
+			t.Fatalf("expected ErrDuplicateKey for %v, got %v", req, err)
+		}
+	}
+	if err := checkTxn(&pb.TxnRequest{Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestTxn{RequestTxn: &pb.TxnRequest{
+		Success: []*pb.RequestOp{put("a", "1")}, Failure: []*pb.RequestOp{put("a", "2")}}}}}}); err != nil {
+		t.Fatalf("branches of nested txn wrongly reported as duplicates: %v", err)
+	}
+}
+
+// Test_StoreLinearizableRead tests that linearizable reads observe every
+// write committed before them.
+func Test_StoreLinearizableRead(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(true, "node0", nil); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	// The last entry of the log is the no-op of the leader, which the FSM
+	// never sees.
+	start := time.Now()
+	if err := s.LinearizableRead(); err != nil {
+		t.Fatalf("failed to read without writes: %s", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("read without writes took %s", d)
+	}
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i)
+			if err := s.Set([]byte(key), []byte("v")); err != nil {
+				errc <- err
+				return
+			}
+			if err := s.LinearizableRead(); err != nil {
+				errc <- err
+				return
+			}
+			if _, err := s.Get([]byte(key), false); err != nil {
+				errc <- fmt.Errorf("write to %s not visible: %s", key, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Fatalf("linearizable read failed: %s", err)
+	}
+}
+
+// Test_StoreWaitAppliedLagging tests that a follower which has not received
+// the entries up to a read index yet waits for them, instead of returning
+// before they are applied.
+func Test_StoreWaitAppliedLagging(t *testing.T) {
+	s := New(true)
+	logs := raft.NewInmemStore()
+	s.logStore = logs
+	f := (*fsm)(s)
+
+	logs.StoreLogs([]*raft.Log{
+		{Index: 1, Type: raft.LogConfiguration},
+		{Index: 2, Type: raft.LogCommand},
+	})
+	f.setApplied(2)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.waitApplied(5, 5*time.Second)
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("wait returned before the entries arrived: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The last entry is a no-op, which the FSM never sees.
+	logs.StoreLogs([]*raft.Log{
+		{Index: 3, Type: raft.LogCommand},
+		{Index: 4, Type: raft.LogCommand},
+		{Index: 5, Type: raft.LogNoop},
+	})
+	f.setApplied(3)
+	select {
+	case err := <-errc:
+		t.Fatalf("wait returned before the entries were applied: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	f.setApplied(4)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("failed to wait for entries: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("wait did not return once the entries were applied")
+	}
+
+	// Entries compacted away are already part of the state of the FSM.
+	compacted := New(true)
+	compacted.logStore = raft.NewInmemStore()
+	compacted.logStore.StoreLog(&raft.Log{Index: 10, Type: raft.LogCommand})
+	if index, known := compacted.lastFSMIndex(5); !known || index != 0 {
+		t.Fatalf("compacted entries not treated as applied: %d, %t", index, known)
+	}
+
+	// Entries which never arrive time out.
+	if err := s.waitApplied(8, 100*time.Millisecond); err != ErrReadTimeout {
+		t.Fatalf("expected ErrReadTimeout, got %v", err)
+	}
+}
+
+// Test_StoreLeaseReads tests that the leader serves linearizable reads under
+// its lease, except during leadership transfers.
+func Test_StoreLeaseReads(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	s.LeaseReads = true
+	if err := s.Open(true, "node0", nil); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	// Simple way to ensure there is a leader, and that it holds a lease.
+	time.Sleep(3 * time.Second)
+
+	if err := s.Set([]byte("foo"), []byte("bar")); err != nil {
+		t.Fatalf("failed to set key: %s", err)
+	}
+	before := s.ReadStats()
+	for i := 0; i < 10; i++ {
+		if err := s.LinearizableRead(); err != nil {
+			t.Fatalf("failed to read: %s", err)
+		}
+	}
+	if st := s.ReadStats(); st.Lease-before.Lease != 10 || st.ReadIndex != before.ReadIndex {
+		t.Fatalf("reads did not use the lease: %+v", st)
+	}
+
+	// Leases are suspended during leadership transfers.
+	s.reads.suspendLease()
+	if err := s.LinearizableRead(); err != nil {
+		t.Fatalf("failed to read: %s", err)
+	}
+	s.reads.resumeLease()
+	if st := s.ReadStats(); st.ReadIndex != before.ReadIndex+1 {
+		t.Fatalf("read during transfer did not confirm leadership: %+v", st)
+	}
+}
+
+// Test_StoreLeaseReadsDrift tests that the clock drift bound must be below
+// the heartbeat timeout.
+func Test_StoreLeaseReadsDrift(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	s.LeaseReads = true
+	s.MaxClockDrift = time.Hour
+	if err := s.Open(true, "node0", nil); err == nil {
+		t.Fatalf("expected error opening store with drift above heartbeat timeout")
+	}
+}
+
+// Test_StoreLeaseExpiry tests that the leader revokes leases which are not
+// kept alive.
+func Test_StoreLeaseExpiry(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	if err := s.Open(true, "node0", nil); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	expiring, err := s.Grant(0, MinLeaseTTL)
+	if err != nil {
+		t.Fatalf("failed to grant lease: %s", err)
+	}
+	kept, err := s.Grant(0, MinLeaseTTL)
+	if err != nil {
+		t.Fatalf("failed to grant lease: %s", err)
+	}
+	if _, err := s.Put([]byte("expiring"), []byte("v"), PutOptions{Lease: expiring.ID}); err != nil {
+		t.Fatalf("failed to put key: %s", err)
+	}
+	if _, err := s.Put([]byte("kept"), []byte("v"), PutOptions{Lease: kept.ID}); err != nil {
+		t.Fatalf("failed to put key: %s", err)
+	}
+
+	deadline := time.Now().Add(2 * MinLeaseTTL * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := s.KeepAlive(kept.ID); err != nil {
+			t.Fatalf("failed to keep lease alive: %s", err)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+
+	if _, err := s.Get([]byte("expiring"), false); err != ErrKeyNotFound {
+		t.Fatalf("key attached to expired lease still exists: %v", err)
+	}
+	if _, err := s.Get([]byte("kept"), false); err != nil {
+		t.Fatalf("key attached to kept lease was deleted: %s", err)
+	}
+	if _, err := s.TimeToLive(expiring.ID, false); err != ErrLeaseNotFound {
+		t.Fatalf("expired lease still exists: %v", err)
+	}
+}
+
+// Test_StoreMembers tests that the members of the cluster are reported with
+// their metadata, and can be added and removed.
+func Test_StoreMembers(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	s.NodeMeta = map[string]string{MetaEtcdAddr: "127.0.0.1:2379"}
+	if err := s.Open(true, "node0", nil); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	// Simple way to ensure there is a leader, which registers itself.
+	time.Sleep(3 * time.Second)
+
+	members, err := s.Members()
+	if err != nil {
+		t.Fatalf("failed to list members: %s", err)
+	}
+	if len(members) != 1 || members[0].ID != "node0" || !members[0].Voter ||
+		members[0].Meta[MetaEtcdAddr] != "127.0.0.1:2379" {
+		t.Fatalf("wrong members: %+v", members)
+	}
+
+	// A non-voter does not count towards the quorum, so it can be added
+	// without the node running.
+	if err := s.AddMember("node1", "127.0.0.1:1", false); err != nil {
+		t.Fatalf("failed to add member: %s", err)
+	}
+	if err := s.AddMember("node2", "127.0.0.1:1", false); err != ErrAddrExists {
+		t.Fatalf("expected ErrAddrExists adding member at same address, got %v", err)
+	}
+	if err := s.Join("node1", "127.0.0.1:1", map[string]string{MetaEtcdAddr: "127.0.0.1:2380"}); err != nil {
+		t.Fatalf("failed to join existing member: %s", err)
+	}
+	if m := s.Meta("node1"); m[MetaEtcdAddr] != "127.0.0.1:2380" {
+		t.Fatalf("wrong metadata for joined member: %v", m)
+	}
+	if err := s.PromoteMember("node0"); err != ErrMemberNotLearner {
+		t.Fatalf("expected ErrMemberNotLearner promoting voter, got %v", err)
+	}
+
+	if err := s.RemoveMember("node1"); err != nil {
+		t.Fatalf("failed to remove member: %s", err)
+	}
+	if err := s.RemoveMember("node1"); err != ErrMemberNotFound {
+		t.Fatalf("expected ErrMemberNotFound removing twice, got %v", err)
+	}
+	if m := s.Meta("node1"); m != nil {
+		t.Fatalf("metadata of removed member still present: %v", m)
+	}
+}
+
+// Test_StoreForwardWrites tests that writes made on a follower are forwarded
+// to the leader, and visible on the follower once they return, or fail with
+// the location of the leader if forwarding is disabled.
+func Test_StoreForwardWrites(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	srv := grpc.NewServer()
+	defer srv.Stop()
+
+	s0 := New(true)
+	tmpDir0, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir0)
+	s0.RaftBind = freeAddr(t)
+	s0.RaftDir = tmpDir0
+	s0.NodeMeta = map[string]string{MetaEtcdAddr: ln.Addr().String()}
+	s0.RegisterForwardServer(srv)
+	go srv.Serve(ln)
+	if err := s0.Open(true, "node0", nil); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s0.Close()
+
+	// Simple way to ensure there is a leader, which registers itself.
+	time.Sleep(3 * time.Second)
+
+	s1 := New(true)
+	tmpDir1, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir1)
+	s1.RaftBind = freeAddr(t)
+	s1.RaftDir = tmpDir1
+	s1.ForwardWrites = true
+	if err := s1.Open(false, "node1", nil); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s1.Close()
+	if err := s0.Join("node1", s1.RaftBind, nil); err != nil {
+		t.Fatalf("failed to join node: %s", err)
+	}
+	time.Sleep(3 * time.Second)
+
+	r, err := s1.Put([]byte("foo"), []byte("bar"), PutOptions{})
+	if err != nil {
+		t.Fatalf("failed to forward put: %s", err)
+	}
+	if r.Revision != s0.Revision() {
+		t.Fatalf("wrong revision of forwarded put, exp %d, got %d", s0.Revision(), r.Revision)
+	}
+	if v, err := s1.Get([]byte("foo"), false); err != nil || string(v) != "bar" {
+		t.Fatalf("forwarded put not visible on follower: %q, %v", v, err)
+	}
+
+	txn, err := s1.Txn(&pb.TxnRequest{
+		Compare: []*pb.Compare{{
+			Key:         []byte("foo"),
+			Target:      pb.Compare_VALUE,
+			Result:      pb.Compare_EQUAL,
+			TargetUnion: &pb.Compare_Value{Value: []byte("bar")},
+		}},
+		Success: []*pb.RequestOp{{Request: &pb.RequestOp_RequestPut{
+			RequestPut: &pb.PutRequest{Key: []byte("foo"), Value: []byte("baz")},
+		}}},
+	})
+	if err != nil {
+		t.Fatalf("failed to forward txn: %s", err)
+	}
+	if !txn.Succeeded {
+		t.Fatalf("forwarded txn did not succeed")
+	}
+	if _, err := s1.Compact(s0.Revision() + 1); !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected compaction not to be forwarded, got %v", err)
+	}
+
+	// Requests to the leader must be signed with the forwarding key of the
+	// cluster, be recent and not be replayed, and carry commands which a
+	// follower forwards and which the FSM can apply.
+	key := s1.forwardingKey()
+	if key == nil || s1.SigningKey() != nil {
+		t.Fatalf("forwarding key not replicated, or token signing key generated while authentication is disabled")
+	}
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial leader: %s", err)
+	}
+	defer conn.Close()
+	nonces := 0
+	sign := func(b []byte, at time.Time) []string {
+		nonces++
+		ts, nonce := strconv.FormatInt(at.UnixNano(), 10), strconv.Itoa(nonces)
+		return []string{
+			forwardTimeKey, ts,
+			forwardNonceKey, nonce,
+			forwardSignatureKey, forwardSignature(key, ForwardMethod, ts, nonce, b),
+		}
+	}
+	invokeWith := func(b []byte, md []string) ([]byte, error) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), md...)
+		out := new(wrapperspb.BytesValue)
+		err := conn.Invoke(ctx, ForwardMethod, wrapperspb.Bytes(b), out)
+		return out.Value, err
+	}
+	invoke := func(c *command, signed bool) ([]byte, error) {
+		b := mustEncode(t, c)
+		var md []string
+		if signed {
+			md = sign(b, time.Now())
+		}
+		return invokeWith(b, md)
+	}
+	if _, err := invoke(&command{Op: "set", Key: []byte("foo"), Value: []byte("evil")}, false); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected unsigned request to be denied, got %v", err)
+	}
+	evil := mustEncode(t, &command{Op: "set", Key: []byte("foo"), Value: []byte("evil")})
+	if _, err := invokeWith(evil, sign(evil, time.Now().Add(-time.Minute))); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected expired request to be denied, got %v", err)
+	}
+	replayed := mustEncode(t, &command{Op: "set", Key: []byte("replayed"), Value: []byte("v")})
+	md := sign(replayed, time.Now())
+	if _, err := invokeWith(replayed, md); err != nil {
+		t.Fatalf("failed to invoke leader: %s", err)
+	}
+	if _, err := invokeWith(replayed, md); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected replayed request to be denied, got %v", err)
+	}
+	if _, err := invoke(&command{Op: "compact", Revision: 1}, true); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected compaction to be rejected, got %v", err)
+	}
+	for _, c := range []*command{
+		{Op: "txn", Txn: []byte{0xff, 0xff, 0xff}},
+		{Op: "txn", Txn: mustMarshal(t, &pb.TxnRequest{Success: []*pb.RequestOp{{}}})},
+		{Op: "set", Value: []byte("bar")},
+	} {
+		out, err := invoke(c, true)
+		if err != nil {
+			t.Fatalf("failed to invoke leader: %s", err)
+		}
+		var resp forwardResponse
+		if err := json.Unmarshal(out, &resp); err != nil || resp.Error == "" || resp.Index != 0 {
+			t.Fatalf("expected invalid %s command to be rejected before being applied, got %+v, %v", c.Op, resp, err)
+		}
+	}
+	if v, err := s0.Get([]byte("foo"), false); err != nil || string(v) != "baz" {
+		t.Fatalf("wrong value on leader after rejected commands: %q, %v", v, err)
+	}
+
+	s1.ForwardWrites = false
+	err = s1.Set([]byte("foo"), []byte("qux"))
+	var nle *NotLeaderError
+	if !errors.As(err, &nle) || !errors.Is(err, ErrNotLeader) {
+		t.Fatalf("expected NotLeaderError, got %v", err)
+	}
+	if nle.Leader != "node0" || nle.Meta[MetaEtcdAddr] != ln.Addr().String() {
+		t.Fatalf("wrong leader in error: %+v", nle)
+	}
+}
+
+// mustMarshal returns the encoded transaction.
+func mustMarshal(tb testing.TB, req *pb.TxnRequest) []byte {
+	b, err := req.Marshal()
+	if err != nil {
+		tb.Fatalf("failed to marshal txn: %s", err)
+	}
+	return b
+}
+
+// Test_FSMApplyInvalid tests that entries which cannot be applied return an
+// error, instead of stopping the node.
+func Test_FSMApplyInvalid(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	s.logger.SetOutput(io.Discard)
+
+	for i, data := range [][]byte{
+		{0xff, 0xff, 0xff},
+		{commandVersion, opCodes["txn"], byte(fieldTxn<<3 | 2), 3, 0xff, 0xff, 0xff},
+		mustEncode(t, &command{Op: "txn", Txn: mustMarshal(t, &pb.TxnRequest{Success: []*pb.RequestOp{{}}})}),
+		mustEncode(t, &command{Op: "auth"}),
+		mustEncode(t, &command{Op: "batch", Batch: [][]byte{{0xff}, mustEncode(t, &command{Op: "compact", Revision: 1})}}),
+	} {
+		index := uint64(i + 1)
+		resp := f.Apply(&raft.Log{Index: index, Data: data})
+		if results, ok := resp.([]interface{}); ok {
+			for _, r := range results {
+				if _, ok := r.(error); !ok {
+					t.Fatalf("expected error applying batched command of entry %d, got %v", index, r)
+				}
+			}
+		} else if _, ok := resp.(error); !ok {
+			t.Fatalf("expected error applying entry %d, got %v", index, resp)
+		}
+		if s.applied != index {
+			t.Fatalf("entry %d not marked applied", index)
+		}
+	}
+}
+
+// mustEncode returns the encoded command.
+func mustEncode(tb testing.TB, c *command) []byte {
+	b, err := encodeCommand(c)
+	if err != nil {
+		tb.Fatalf("failed to encode command: %s", err)
+	}
+	return b
+}
+
+// freeAddr returns a local address with a free port.
+func freeAddr(t testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// Test_StoreBatchWrites tests that concurrent writes are coalesced into
+// fewer log entries, and that each writer gets the result of its own write.
+func Test_StoreBatchWrites(t *testing.T) {
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	s.RaftBind = "127.0.0.1:0"
+	s.RaftDir = tmpDir
+	s.BatchWrites = true
+	s.BatchLinger = 10 * time.Millisecond
+	if err := s.Open(true, "node0", nil); err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	defer s.Close()
+
+	// Simple way to ensure there is a leader.
+	time.Sleep(3 * time.Second)
+
+	if _, err := s.Put([]byte("foo"), []byte("bar"), PutOptions{}); err != nil {
+		t.Fatalf("failed to put key: %s", err)
+	}
+	start := s.raft.LastIndex()
+
+	const n = 50
+	var wg sync.WaitGroup
+	revs := make(chan int64, n)
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 1 {
+				// A failing write does not fail the rest of its batch.
+				_, err := s.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v"), PutOptions{Lease: 1})
+				if err != ErrLeaseNotFound {
+					errc <- fmt.Errorf("expected ErrLeaseNotFound, got %v", err)
+				}
+				return
+			}
+			r, err := s.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v"), PutOptions{PrevKV: true})
+			if err != nil {
+				errc <- err
+				return
+			}
+			revs <- r.Revision
+		}(i)
+	}
+	wg.Wait()
+	close(revs)
+	close(errc)
+	for err := range errc {
+		t.Fatalf("batched write failed: %s", err)
+	}
+
+	seen := make(map[int64]bool)
+	for rev := range revs {
+		if seen[rev] {
+			t.Fatalf("revision %d returned to two writers", rev)
+		}
+		seen[rev] = true
+	}
+	if len(seen) != n/2 || s.Revision() != int64(n/2)+1 {
+		t.Fatalf("wrong revisions, got %d writes at revision %d", len(seen), s.Revision())
+	}
+	if entries := s.raft.LastIndex() - start; entries >= n {
+		t.Fatalf("writes were not batched, %d writes took %d entries", n, entries)
+	}
+	if err := s.Delete([]byte("key0")); err != nil {
+		t.Fatalf("failed to delete key: %s", err)
+	}
+	if _, err := s.Get([]byte("key0"), false); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound after batched delete, got %v", err)
+	}
+}
+
+// Test_CommandEncoding tests that commands survive the binary encoding, and
+// that the FSM applies both binary and legacy JSON-encoded entries.
+func Test_CommandEncoding(t *testing.T) {
+	commands := []*command{
+		{Op: "set", Key: []byte("foo"), Value: []byte("bar\x00\xff"), PrevKV: true, IgnoreLease: true, Lease: -1},
+		{Op: "delete", Key: []byte("a"), End: []byte("z"), PrevKV: true},
+		{Op: "compact", Revision: 42},
+		{Op: "lease_grant", Lease: 7, TTL: 60},
+		{Op: "meta", Key: []byte("node0"), Meta: map[string]string{MetaEtcdAddr: "127.0.0.1:2379", MetaHTTPAddr: ""}},
+		{Op: "meta", Key: []byte("node1"), Meta: map[string]string{}},
+		{Op: "meta", Key: []byte("node2")},
+		{Op: "auth", Auth: &authCommand{Action: "role_grant", Role: "r", Perm: &Permission{Type: PermRead, Key: "k", End: "l"}, SigningKey: []byte{1, 2}}},
+		{Op: "txn", Txn: []byte{0x0a, 0x01, 0x00}},
+		{Op: "batch", Batch: [][]byte{{commandVersion, 1}, {commandVersion, 2}}},
+	}
+	for _, c := range commands {
+		b, err := encodeCommand(c)
+		if err != nil {
+			t.Fatalf("failed to encode %s command: %s", c.Op, err)
+		}
+		var got command
+		if err := decodeCommand(b, &got); err != nil {
+			t.Fatalf("failed to decode %s command: %s", c.Op, err)
+		}
+		if !reflect.DeepEqual(&got, c) {
+			t.Fatalf("wrong decoded command, exp %+v, got %+v", c, &got)
+		}
+	}
+	if _, err := encodeCommand(&command{Op: "bogus"}); err == nil {
+		t.Fatalf("expected error encoding unknown op")
+	}
+	if err := decodeCommand([]byte{99, 1}, &command{}); err == nil {
+		t.Fatalf("expected error decoding unknown version")
+	}
+
+	s := New(true)
+	f := (*fsm)(s)
+	entries := [][]byte{
+		[]byte(`{"op":"set","key":"foo","value":"bar"}`),
+		[]byte(`{"op":"batch","batch":[{"op":"set","key":"baz","value":"1"},{"op":"delete","key":"foo"}]}`),
+	}
+	b, _ := encodeCommand(&command{Op: "set", Key: []byte("qux"), Value: []byte("2")})
+	entries = append(entries, b)
+	for i, e := range entries {
+		f.Apply(&raft.Log{Index: uint64(i + 1), Data: e})
+	}
+	if _, err := s.Get([]byte("foo"), false); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound for deleted key, got %v", err)
+	}
+	for k, exp := range map[string]string{"baz": "1", "qux": "2"} {
+		if v, err := s.Get([]byte(k), false); err != nil || string(v) != exp {
+			t.Fatalf("wrong value for %s, exp %s, got %q (%v)", k, exp, v, err)
+		}
+	}
+	if s.Revision() != 4 {
+		t.Fatalf("wrong revision, exp 4, got %d", s.Revision())
+	}
+}
+
+// Test_StoreHashKV tests that stores which applied the same changes hash to
+// the same value, at every revision.
+func Test_StoreHashKV(t *testing.T) {
+	s1, s2 := New(true), New(true)
+	for _, s := range []*Store{s1, s2} {
+		f := (*fsm)(s)
+		f.applySet([]byte("foo"), []byte("bar"), PutOptions{})
+		f.applySet([]byte("baz"), []byte("qux"), PutOptions{})
+		f.applyDelete([]byte("foo"), nil, false)
+	}
+	(*fsm)(s2).applySet([]byte("foo"), []byte("diverged"), PutOptions{})
+
+	for rev := int64(1); rev <= 3; rev++ {
+		h1, err := s1.HashKV(rev)
+		if err != nil {
+			t.Fatalf("failed to hash at revision %d: %s", rev, err)
+		}
+		h2, _ := s2.HashKV(rev)
+		if h1.Hash != h2.Hash {
+			t.Fatalf("hashes differ at revision %d", rev)
+		}
+	}
+	h1, _ := s1.HashKV(0)
+	h2, _ := s2.HashKV(0)
+	if h1.Revision != 3 || h2.Revision != 4 || h1.Hash == h2.Hash {
+		t.Fatalf("diverged stores hash to the same value: %+v %+v", h1, h2)
+	}
+	if _, err := s1.HashKV(4); err != ErrFutureRev {
+		t.Fatalf("expected ErrFutureRev hashing future revision, got %v", err)
+	}
+}
+
+// Test_StoreNoSpaceAlarm tests that writes are rejected while the NOSPACE
+// alarm is active, and that the size of the keyspace is tracked.
+func Test_StoreNoSpaceAlarm(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	f.applySet([]byte("foo"), []byte("bar"), PutOptions{})
+	f.applySet([]byte("foo"), []byte("baz"), PutOptions{})
+	if exp := 2 * revSize([]byte("foo"), keyRev{value: []byte("bar")}); s.size != exp {
+		t.Fatalf("wrong keyspace size, exp %d, got %d", exp, s.size)
+	}
+	f.applyCompact(2)
+	if exp := revSize([]byte("foo"), keyRev{value: []byte("baz")}); s.size != exp {
+		t.Fatalf("wrong keyspace size after compaction, exp %d, got %d", exp, s.size)
+	}
+
+	f.applyAlarm("node0", AlarmNoSpace, true)
+	f.applyAlarm("node0", AlarmNoSpace, true)
+	if a := s.Alarms(); len(a) != 1 || a[0] != (Alarm{Node: "node0", Type: AlarmNoSpace}) {
+		t.Fatalf("wrong alarms: %v", a)
+	}
+	if err := f.applySet([]byte("foo"), []byte("qux"), PutOptions{}); err != ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace writing with alarm active, got %v", err)
+	}
+	if err := f.applyLeaseGrant(1, 10); err != ErrNoSpace {
+		t.Fatalf("expected ErrNoSpace granting lease with alarm active, got %v", err)
+	}
+	if r, ok := f.applyDelete([]byte("foo"), nil, false).(*DeleteResult); !ok || r.Deleted != 1 {
+		t.Fatalf("failed to delete with alarm active: %v", r)
+	}
+
+	f.applyAlarm("node0", AlarmNoSpace, false)
+	if err, ok := f.applySet([]byte("foo"), []byte("qux"), PutOptions{}).(error); ok {
+		t.Fatalf("failed to write after alarm deactivated: %s", err)
+	}
+}
+
+// Test_StoreAuth tests that authentication is only enabled once the root user
+// and role exist, and that users are authenticated and checked against the
+// permissions of all their roles.
+func Test_StoreAuth(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %s", err)
+	}
+
+	if err := f.applyAuth(&authCommand{Action: "enable"}); err != ErrRootUserNotExist {
+		t.Fatalf("expected ErrRootUserNotExist enabling without root, got %v", err)
+	}
+	f.applyAuth(&authCommand{Action: "user_add", User: RootUser, Password: string(hash)})
+	if err := f.applyAuth(&authCommand{Action: "user_add", User: RootUser}); err != ErrUserAlreadyExist {
+		t.Fatalf("expected ErrUserAlreadyExist, got %v", err)
+	}
+	if err := f.applyAuth(&authCommand{Action: "enable"}); err != ErrRootRoleNotExist {
+		t.Fatalf("expected ErrRootRoleNotExist enabling without root role, got %v", err)
+	}
+	f.applyAuth(&authCommand{Action: "user_grant", User: RootUser, Role: RootRole})
+	if err, ok := f.applyAuth(&authCommand{Action: "enable", SigningKey: []byte("key")}).(error); ok {
+		t.Fatalf("failed to enable authentication: %s", err)
+	}
+	if enabled, _ := s.AuthStatus(); !enabled {
+		t.Fatalf("authentication not enabled")
+	}
+	if err := f.applyAuth(&authCommand{Action: "user_delete", User: RootUser}); err != ErrInvalidAuthMgmt {
+		t.Fatalf("expected ErrInvalidAuthMgmt deleting root, got %v", err)
+	}
+
+	if err := s.Authenticate(RootUser, "secret"); err != nil {
+		t.Fatalf("failed to authenticate: %s", err)
+	}
+	if err := s.Authenticate(RootUser, "wrong"); err != ErrAuthFailed {
+		t.Fatalf("expected ErrAuthFailed, got %v", err)
+	}
+
+	// Permissions of several roles combine.
+	f.applyAuth(&authCommand{Action: "user_add", User: "alice", NoPassword: true})
+	f.applyAuth(&authCommand{Action: "role_add", Role: "a"})
+	f.applyAuth(&authCommand{Action: "role_add", Role: "b"})
+	f.applyAuth(&authCommand{Action: "role_grant", Role: "a", Perm: &Permission{Type: PermReadWrite, Key: "a", End: "c"}})
+	f.applyAuth(&authCommand{Action: "role_grant", Role: "b", Perm: &Permission{Type: PermRead, Key: "c", End: "e"}})
+	f.applyAuth(&authCommand{Action: "user_grant", User: "alice", Role: "a"})
+	f.applyAuth(&authCommand{Action: "user_grant", User: "alice", Role: "b"})
+	if err := s.Authenticate("alice", ""); err != ErrAuthFailed {
+		t.Fatalf("expected ErrAuthFailed for user without password, got %v", err)
+	}
+
+	for _, tt := range []struct {
+		key, end string
+		write    bool
+		exp      bool
+	}{
+		{"a", "", false, true},
+		{"b", "", true, true},
+		{"a", "e", false, true},
+		{"a", "e", true, false},
+		{"a", "f", false, false},
+		{"d", "\x00", false, false},
+		{"e", "", false, false},
+	} {
+		if got := s.IsPermitted("alice", tt.key, tt.end, tt.write); got != tt.exp {
+			t.Fatalf("wrong permission for [%q, %q) write %v, exp %v, got %v", tt.key, tt.end, tt.write, tt.exp, got)
+		}
+	}
+	if !s.IsPermitted(RootUser, "z", "\x00", true) || s.IsPermitted("bob", "a", "", false) {
+		t.Fatalf("wrong permissions of root or unknown user")
+	}
+
+	// Deleting a role revokes it from its users.
+	f.applyAuth(&authCommand{Action: "role_delete", Role: "b"})
+	if u, _ := s.User("alice"); len(u.Roles) != 1 || u.Roles[0] != "a" {
+		t.Fatalf("wrong roles after role deleted: %v", u.Roles)
+	}
+	if err := f.applyAuth(&authCommand{Action: "role_revoke", Role: "a", Perm: &Permission{Key: "x"}}); err != ErrPermissionNotGranted {
+		t.Fatalf("expected ErrPermissionNotGranted, got %v", err)
+	}
+	if _, rev := s.AuthStatus(); rev != 11 {
+		t.Fatalf("wrong auth revision, exp 11, got %d", rev)
+	}
+
+	// The key signing tokens is only replaced when authentication is
+	// enabled after being disabled.
+	f.applyAuth(&authCommand{Action: "enable", SigningKey: []byte("key2")})
+	if k := s.SigningKey(); string(k) != "key" {
+		t.Fatalf("signing key replaced while enabled: %q", k)
+	}
+	f.applyAuth(&authCommand{Action: "disable"})
+	f.applyAuth(&authCommand{Action: "enable", SigningKey: []byte("key3")})
+	if k := s.SigningKey(); string(k) != "key3" {
+		t.Fatalf("signing key not replaced when enabled again: %q", k)
+	}
+}
+
+// Test_StoreSnapshotRestore tests that a snapshot restores the keys along
+// with their revisions, and that legacy snapshots can still be restored.
+func Test_StoreSnapshotRestore(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	f.applySet([]byte("foo"), []byte("bar"), PutOptions{})
+	f.applySet([]byte("foo"), []byte("bar2"), PutOptions{})
+	f.applySet([]byte("baz"), []byte("qux"), PutOptions{})
+	f.applyDelete([]byte("baz"), nil, false)
+	f.applyMeta("node0", map[string]string{MetaEtcdAddr: "127.0.0.1:2379"})
+	f.applyAuth(&authCommand{Action: "role_add", Role: "reader"})
+	f.applyAuth(&authCommand{Action: "role_grant", Role: "reader", Perm: &Permission{Type: PermRead, Key: "foo"}})
+	f.applyAuth(&authCommand{Action: "user_add", User: "alice", NoPassword: true})
+	f.applyAuth(&authCommand{Action: "user_grant", User: "alice", Role: "reader"})
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	sink := &mockSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+
+	s2 := New(true)
+	if err := (*fsm)(s2).Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	for rev := int64(1); rev <= s.Revision(); rev++ {
+		r, _ := s.RangeAt([]byte("\x00"), []byte("\x00"), 0, rev)
+		r2, _ := s2.RangeAt([]byte("\x00"), []byte("\x00"), 0, rev)
+		if !reflect.DeepEqual(r, r2) {
+			t.Fatalf("restored store differs from original at revision %d", rev)
+		}
+	}
+	if s2.Count() != 1 {
+		t.Fatalf("wrong count after restore, exp 1, got %d", s2.Count())
+	}
+	if m := s2.Meta("node0"); m[MetaEtcdAddr] != "127.0.0.1:2379" {
+		t.Fatalf("wrong node metadata after restore: %v", m)
+	}
+	if !s2.IsPermitted("alice", "foo", "", false) || s2.IsPermitted("alice", "foo", "", true) {
+		t.Fatalf("wrong permissions after restore")
+	}
+	if _, rev := s2.AuthStatus(); rev != 4 {
+		t.Fatalf("wrong auth revision after restore, exp 4, got %d", rev)
+	}
+
+	s3 := New(true)
+	legacy := io.NopCloser(strings.NewReader(`{"foo":"bar","baz":"qux"}`))
+	if err := (*fsm)(s3).Restore(legacy); err != nil {
+		t.Fatalf("failed to restore legacy snapshot: %s", err)
+	}
+	if v, err := s3.Get([]byte("baz"), false); err != nil || string(v) != "qux" {
+		t.Fatalf("wrong value restored from legacy snapshot: %s (%v)", v, err)
+	}
+	if rev := s3.Revision(); rev != 1 {
+		t.Fatalf("wrong revision restored from legacy snapshot: %d", rev)
+	}
+}
+
+// Test_StoreLeases tests that keys attached to a lease are deleted when it is
+// revoked, and that leases survive a snapshot.
+func Test_StoreLeases(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	f.applyLeaseGrant(1, 10)
+	f.applyLeaseGrant(2, 10)
+	if err := f.applyLeaseGrant(1, 10); err != ErrLeaseExists {
+		t.Fatalf("expected ErrLeaseExists granting lease twice, got %v", err)
+	}
+	if err := f.applySet([]byte("foo"), []byte("bar"), PutOptions{Lease: 3}); err != ErrLeaseNotFound {
+		t.Fatalf("expected ErrLeaseNotFound attaching to missing lease, got %v", err)
+	}
+
+	f.applySet([]byte("a"), []byte("v1"), PutOptions{Lease: 1}) // rev 1
+	f.applySet([]byte("b"), []byte("v1"), PutOptions{Lease: 1}) // rev 2
+	f.applySet([]byte("c"), []byte("v1"), PutOptions{Lease: 1}) // rev 3
+	f.applySet([]byte("c"), []byte("v2"), PutOptions{Lease: 2}) // rev 4
+	f.applySet([]byte("b"), []byte("v2"), PutOptions{IgnoreLease: true})
+	if kvs, _ := s.rangeLocked([]byte("b"), nil, 0, 0); kvs[0].Lease != 1 {
+		t.Fatalf("lease not kept with IgnoreLease: %+v", kvs[0])
+	}
+
+	info, err := s.leaseInfo(1, true)
+	if err != nil {
+		t.Fatalf("failed to get lease: %s", err)
+	}
+	if !reflect.DeepEqual(info.Keys, [][]byte{[]byte("a"), []byte("b")}) || info.GrantedTTL != 10 {
+		t.Fatalf("wrong lease info: %+v", info)
+	}
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	sink := &mockSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+
+	r, ok := f.applyLeaseRevoke(1).(*LeaseRevokeResult)
+	if !ok || r.Revision != 6 {
+		t.Fatalf("wrong result revoking lease: %v", r)
+	}
+	if c := s.Count(); c != 1 {
+		t.Fatalf("wrong count after revoking lease, exp 1, got %d", c)
+	}
+	if err := f.applyLeaseRevoke(1); err != ErrLeaseNotFound {
+		t.Fatalf("expected ErrLeaseNotFound revoking twice, got %v", err)
+	}
+
+	s2 := New(true)
+	if err := (*fsm)(s2).Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	if ids := s2.Leases(); !reflect.DeepEqual(ids, []int64{1, 2}) {
+		t.Fatalf("wrong leases after restore: %v", ids)
+	}
+	(*fsm)(s2).applyLeaseRevoke(2)
+	if c := s2.Count(); c != 2 {
+		t.Fatalf("wrong count after revoking restored lease, exp 2, got %d", c)
+	}
+}
+
+// Test_StoreSnapshotFormat tests that snapshots are restored from both the
+// binary and the legacy JSON format, and that damaged snapshots are rejected.
+func Test_StoreSnapshotFormat(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	for i := 0; i < 100; i++ {
+		f.applySet([]byte(fmt.Sprintf("key%d", i%10)), []byte(fmt.Sprintf("value%d", i)), PutOptions{})
+	}
+	f.applyLeaseGrant(1, 60)
+	f.applySet([]byte("leased"), []byte("v"), PutOptions{Lease: 1})
+	f.applyMeta("node0", map[string]string{MetaEtcdAddr: "127.0.0.1:2379"})
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	sink := &mockSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	b := sink.Bytes()
+	if !bytes.HasPrefix(b, []byte(snapshotMagic)) {
+		t.Fatalf("snapshot does not start with the magic bytes")
+	}
+	o := *snap.(*fsmSnapshot).state
+	snap.(*fsmSnapshot).kv.Ascend(func(it kvItem) bool {
+		for _, r := range it.revs {
+			o.KVs = append(o.KVs, snapshotKV{LegacyKey: string(it.key), LegacyValue: string(r.value), CreateRevision: r.createRev,
+				ModRevision: r.modRev, Version: r.version, Lease: r.lease, Tombstone: r.tombstone})
+		}
+		return true
+	})
+	legacy, err := json.Marshal(o)
+	if err != nil {
+		t.Fatalf("failed to encode legacy snapshot: %s", err)
+	}
+
+	for name, b := range map[string][]byte{"binary": b, "legacy": legacy} {
+		s2 := New(true)
+		if err := (*fsm)(s2).Restore(io.NopCloser(bytes.NewReader(b))); err != nil {
+			t.Fatalf("failed to restore %s snapshot: %s", name, err)
+		}
+		for rev := int64(1); rev <= s.Revision(); rev++ {
+			r, _ := s.RangeAt([]byte("\x00"), []byte("\x00"), 0, rev)
+			r2, _ := s2.RangeAt([]byte("\x00"), []byte("\x00"), 0, rev)
+			if !reflect.DeepEqual(r, r2) {
+				t.Fatalf("store restored from %s snapshot differs at revision %d", name, rev)
+			}
+		}
+		if s2.Count() != 11 || s2.Meta("node0")[MetaEtcdAddr] != "127.0.0.1:2379" {
+			t.Fatalf("wrong state restored from %s snapshot", name)
+		}
+		if l := s2.leases[1]; l == nil || len(l.keys) != 1 {
+			t.Fatalf("wrong lease restored from %s snapshot", name)
+		}
+	}
+
+	corrupt := append([]byte(nil), b...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	if err := (*fsm)(New(true)).Restore(io.NopCloser(bytes.NewReader(corrupt))); err == nil {
+		t.Fatalf("restored corrupted snapshot")
+	}
+	if err := (*fsm)(New(true)).Restore(io.NopCloser(bytes.NewReader(b[:len(b)-8]))); err != errSnapshotTruncated {
+		t.Fatalf("expected errSnapshotTruncated, got %v", err)
+	}
+}
+
+// Test_StoreSnapshotConcurrentWrites tests that writes and reads are not
+// blocked while a snapshot is being persisted, and are not seen by it.
+func Test_StoreSnapshotConcurrentWrites(t *testing.T) {
+	s := New(true)
+	f := (*fsm)(s)
+	const n = 100000
+	for i := 0; i < n; i++ {
+		f.applySet([]byte(fmt.Sprintf("key%06d", i)), []byte("v1"), PutOptions{})
+	}
+	rev := s.Revision()
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	sink := &blockingSink{unblock: make(chan struct{}), blocked: make(chan struct{})}
+	persisted := make(chan error, 1)
+	go func() {
+		persisted <- snap.Persist(sink)
+	}()
+	<-sink.blocked
+
+	// The snapshot is stalled part way through, yet every key can still be
+	// written and read.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i += 10 {
+			f.applySet([]byte(fmt.Sprintf("key%06d", i)), []byte("v2"), PutOptions{})
+		}
+		f.applyDelete([]byte("key000001"), nil, false)
+		f.applyCompact(s.Revision())
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("writes blocked by snapshot")
+	}
+	if v, _ := s.Get([]byte("key000010"), false); string(v) != "v2" {
+		t.Fatalf("wrong value during snapshot, exp v2, got %s", v)
+	}
+
+	close(sink.unblock)
+	if err := <-persisted; err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	s2 := New(true)
+	if err := (*fsm)(s2).Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	if s2.Revision() != rev || s2.Count() != n {
+		t.Fatalf("wrong restored state, exp revision %d and %d keys, got %d and %d", rev, n, s2.Revision(), s2.Count())
+	}
+	r := s2.Range([]byte("key"), []byte("kez"), 0)
+	for _, kv := range r.KVs {
+		if string(kv.Value) != "v1" || kv.Version != 1 {
+			t.Fatalf("snapshot saw write made after it was taken: %s=%s", kv.Key, kv.Value)
+		}
+	}
+}
+
+// blockingSink is a snapshot sink which blocks the first write until
+// unblocked.
+type blockingSink struct {
+	mockSink
+	once    sync.Once
+	blocked chan struct{}
+	unblock chan struct{}
+}
+
+func (b *blockingSink) Write(p []byte) (int, error) {
+	b.once.Do(func() {
+		close(b.blocked)
+		<-b.unblock
+	})
+	return b.mockSink.Write(p)
+}
+
+// Test_StoreBinaryValues tests that keys and values which are not valid
+// UTF-8 survive the log and snapshots unchanged.
+func Test_StoreBinaryValues(t *testing.T) {
+	key, value := []byte("k\xff\x00"), []byte("\x00\xfe\xff\x80v")
+
+	s := New(true)
+	f := (*fsm)(s)
+	b, err := encodeCommand(&command{Op: "set", Key: key, Value: value})
+	if err != nil {
+		t.Fatalf("failed to encode command: %s", err)
+	}
+	if r := f.Apply(&raft.Log{Index: 1, Data: b}); r != nil {
+		if err, ok := r.(error); ok {
+			t.Fatalf("failed to apply command: %s", err)
+		}
+	}
+	if r := s.Range(key, nil, 0); len(r.KVs) != 1 || !bytes.Equal(r.KVs[0].Key, key) || !bytes.Equal(r.KVs[0].Value, value) {
+		t.Fatalf("wrong key-value after apply: %v", r.KVs)
+	}
+
+	snap, err := f.Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	sink := &mockSink{}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	s2 := New(true)
+	if err := (*fsm)(s2).Restore(io.NopCloser(&sink.Buffer)); err != nil {
+		t.Fatalf("failed to restore snapshot: %s", err)
+	}
+	if r := s2.Range(key, nil, 0); len(r.KVs) != 1 || !bytes.Equal(r.KVs[0].Key, key) || !bytes.Equal(r.KVs[0].Value, value) {
+		t.Fatalf("wrong key-value after restore: %v", r.KVs)
+	}
+
+	// Snapshots taken before keys and values were base64-encoded hold them
+	// as plain strings.
+	s3 := New(true)
+	legacy := io.NopCloser(strings.NewReader(`{"revision":1,"kvs":[{"key":"foo","value":"bar","create_revision":1,"mod_revision":1,"version":1}]}`))
+	if err := (*fsm)(s3).Restore(legacy); err != nil {
+		t.Fatalf("failed to restore legacy snapshot: %s", err)
+	}
+	if v, err := s3.Get([]byte("foo"), false); err != nil || string(v) != "bar" {
+		t.Fatalf("wrong value restored from legacy snapshot: %s (%v)", v, err)
+	}
+}
+
+// Test_StoreBolt tests that the bbolt FSM keeps the keyspace across a
+// restart, and only applies the log entries after the last one it holds.
+func Test_StoreBolt(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	addr := freeAddr(t)
+
+	open := func(bootstrap bool) *Store {
+		s := New(false)
+		s.RaftDir = tmpDir
+		s.RaftBind = addr
+		s.FSMBackend = FSMBackendBolt
+		if err := s.Open(bootstrap, "node0", nil); err != nil {
+			t.Fatalf("failed to open store: %s", err)
+		}
+		return s
+	}
+
+	s := open(true)
+	time.Sleep(3 * time.Second)
+	for i := 0; i < 10; i++ {
+		if _, err := s.Put([]byte(fmt.Sprintf("key%d", i)), []byte("v1"), PutOptions{}); err != nil {
+			t.Fatalf("failed to put key: %s", err)
+		}
+	}
+	if err := s.raft.Snapshot().Error(); err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	if _, err := s.Put([]byte("key0"), []byte("v2"), PutOptions{}); err != nil {
+		t.Fatalf("failed to put key: %s", err)
+	}
+	if err := s.Delete([]byte("key9")); err != nil {
+		t.Fatalf("failed to delete key: %s", err)
+	}
+	rev, applied := s.Revision(), s.applied
+	if err := s.Close(); err != nil {
+		t.Fatalf("failed to close store: %s", err)
+	}
+
+	s = open(false)
+	defer s.Close()
+	if s.durable != applied {
+		t.Fatalf("wrong durable index after restart, exp %d, got %d", applied, s.durable)
+	}
+	if s.Revision() != rev || s.Count() != 9 {
+		t.Fatalf("wrong state after restart, exp revision %d and 9 keys, got %d and %d", rev, s.Revision(), s.Count())
+	}
+	if v, _ := s.Get([]byte("key0"), false); string(v) != "v2" {
+		t.Fatalf("wrong value after restart, exp v2, got %s", v)
+	}
+	time.Sleep(3 * time.Second)
+	if _, err := s.Put([]byte("key1"), []byte("v2"), PutOptions{}); err != nil {
+		t.Fatalf("failed to put key after restart: %s", err)
+	}
+	if r := s.Range([]byte("key1"), nil, 0); len(r.KVs) != 1 || r.KVs[0].Version != 2 || s.Revision() != rev+1 {
+		t.Fatalf("wrong key after restart: %v", r.KVs)
+	}
+}
+
+// Test_StoreBoltSnapshots tests that snapshots of the bbolt FSM are restored
+// by the in-memory FSM, and the other way around, and that snapshots written
+// for clients of either FSM leave out the forwarding key.
+func Test_StoreBoltSnapshots(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+
+	newBolt := func(name string) *Store {
+		s := New(false)
+		s.RaftDir = tmpDir
+		if err := (*fsm)(s).loadBolt(filepath.Join(tmpDir, name), nil); err != nil {
+			t.Fatalf("failed to open bbolt FSM: %s", err)
+		}
+		return s
+	}
+	persist := func(s *Store) *bytes.Buffer {
+		snap, err := (*fsm)(s).Snapshot()
+		if err != nil {
+			t.Fatalf("failed to snapshot: %s", err)
+		}
+		defer snap.Release()
+		sink := &mockSink{}
+		if err := snap.Persist(sink); err != nil {
+			t.Fatalf("failed to persist snapshot: %s", err)
+		}
+		return &sink.Buffer
+	}
+	populate := func(f *fsm) {
+		f.applyLeaseGrant(1, 60)
+		for i := 0; i < 100; i++ {
+			f.applySet([]byte(fmt.Sprintf("key%d", i%10)), []byte(fmt.Sprintf("value%d", i)), PutOptions{})
+		}
+		f.applySet([]byte("leased"), []byte("\x00\xff"), PutOptions{Lease: 1})
+		f.applyDelete([]byte("key5"), nil, false)
+		f.applyCompact(50)
+		f.applyMeta("node0", map[string]string{MetaEtcdAddr: "127.0.0.1:2379"})
+		f.applyForwardKey([]byte("forward"))
+	}
+	check := func(name string, s, s2 *Store, forwardKey []byte) {
+		for rev := int64(50); rev <= s.Revision(); rev++ {
+			r, _ := s.RangeAt([]byte("\x00"), []byte("\x00"), 0, rev)
+			r2, _ := s2.RangeAt([]byte("\x00"), []byte("\x00"), 0, rev)
+			if !reflect.DeepEqual(r, r2) {
+				t.Fatalf("%s: restored store differs at revision %d", name, rev)
+			}
+		}
+		if s2.Count() != s.Count() || s2.Meta("node0")[MetaEtcdAddr] != "127.0.0.1:2379" {
+			t.Fatalf("%s: wrong state restored", name)
+		}
+		if l := s2.leases[1]; l == nil || len(l.keys) != 1 {
+			t.Fatalf("%s: wrong lease restored", name)
+		}
+		if k := s2.forwardingKey(); !bytes.Equal(k, forwardKey) {
+			t.Fatalf("%s: wrong forwarding key restored, exp %q, got %q", name, forwardKey, k)
+		}
+	}
+
+	b := newBolt("a.db")
+	populate((*fsm)(b))
+	m := New(true)
+	if err := (*fsm)(m).Restore(io.NopCloser(persist(b))); err != nil {
+		t.Fatalf("failed to restore bbolt snapshot in memory: %s", err)
+	}
+	check("bbolt to memory", b, m, []byte("forward"))
+
+	m = New(true)
+	populate((*fsm)(m))
+	b2 := newBolt("b.db")
+	if err := (*fsm)(b2).Restore(io.NopCloser(persist(m))); err != nil {
+		t.Fatalf("failed to restore snapshot in bbolt: %s", err)
+	}
+	check("memory to bbolt", m, b2, []byte("forward"))
+
+	b3 := newBolt("c.db")
+	if err := (*fsm)(b3).Restore(io.NopCloser(persist(b))); err != nil {
+		t.Fatalf("failed to restore bbolt snapshot in bbolt: %s", err)
+	}
+	check("bbolt to bbolt", b, b3, []byte("forward"))
+
+	for name, s := range map[string]*Store{"bbolt": b, "memory": m} {
+		var buf bytes.Buffer
+		if _, err := s.WriteSnapshot(&buf); err != nil {
+			t.Fatalf("failed to write %s snapshot: %s", name, err)
+		}
+		c := New(true)
+		if err := (*fsm)(c).Restore(io.NopCloser(&buf)); err != nil {
+			t.Fatalf("failed to restore %s client snapshot: %s", name, err)
+		}
+		check(name+" client snapshot", s, c, nil)
+	}
+
+	for _, s := range []*Store{b, b2, b3} {
+		s.bolt.close()
+	}
+	if m, _ := filepath.Glob(filepath.Join(tmpDir, "*restore*")); len(m) != 0 {
+		t.Fatalf("temporary files left behind: %v", m)
+	}
+}
+
+// Test_StoreBoltVerify tests that a bbolt file failing its checksum on load is
+// replaced by the latest snapshot, or discarded if there is none.
+func Test_StoreBoltVerify(t *testing.T) {
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, boltFile)
+
+	snapshots, err := raft.NewFileSnapshotStore(tmpDir, 1, ioutil.Discard)
+	if err != nil {
+		t.Fatalf("failed to create snapshot store: %s", err)
+	}
+	load := func(snapshots raft.SnapshotStore) *Store {
+		s := New(false)
+		s.RaftDir = tmpDir
+		if err := (*fsm)(s).loadBolt(path, snapshots); err != nil {
+			t.Fatalf("failed to load bbolt FSM: %s", err)
+		}
+		return s
+	}
+	apply := func(s *Store, index uint64, keys int) {
+		f := (*fsm)(s)
+		for i := 0; i < keys; i++ {
+			f.applySet([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", index)), PutOptions{})
+		}
+		f.mu.Lock()
+		f.applied = index
+		f.commitBolt()
+		f.mu.Unlock()
+	}
+
+	// Snapshot the store at index 5, and commit more entries after it.
+	s := load(nil)
+	apply(s, 5, 10)
+	snap, err := (*fsm)(s).Snapshot()
+	if err != nil {
+		t.Fatalf("failed to snapshot: %s", err)
+	}
+	sink, err := snapshots.Create(raft.SnapshotVersionMax, 5, 1, raft.Configuration{}, 1, nil)
+	if err != nil {
+		t.Fatalf("failed to create snapshot: %s", err)
+	}
+	if err := snap.Persist(sink); err != nil {
+		t.Fatalf("failed to persist snapshot: %s", err)
+	}
+	snap.Release()
+	apply(s, 10, 20)
+	s.bolt.close()
+
+	s = load(snapshots)
+	if s.durable != 10 || s.Count() != 20 {
+		t.Fatalf("wrong state loaded, durable index %d, %d keys", s.durable, s.Count())
+	}
+	s.bolt.close()
+
+	// Corrupt the history of a key behind the checksum.
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("failed to open bbolt file: %s", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltKVBucket)
+		return b.Put([]byte("key0"), b.Get([]byte("key1")))
+	})
+	if err != nil {
+		t.Fatalf("failed to corrupt bbolt file: %s", err)
+	}
+	db.Close()
+
+	s = load(snapshots)
+	if s.durable != 5 || s.Count() != 10 {
+		t.Fatalf("snapshot not restored, durable index %d, %d keys", s.durable, s.Count())
+	}
+	r := s.Range([]byte("key0"), nil, 0)
+	if len(r.KVs) != 1 || string(r.KVs[0].Value) != "value5" {
+		t.Fatalf("wrong value restored for key0: %v", r.KVs)
+	}
+	s.bolt.close()
+
+	// Corrupt the state, with no snapshot to fall back to.
+	db, err = bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("failed to open bbolt file: %s", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltMetaBucket).Put(boltStateKey, []byte(`{"applied_index":100}`))
+	})
+	if err != nil {
+		t.Fatalf("failed to corrupt bbolt file: %s", err)
+	}
+	db.Close()
+
+	s = load(nil)
+	if s.durable != 0 || s.Count() != 0 {
+		t.Fatalf("corrupted bbolt FSM not discarded, durable index %d, %d keys", s.durable, s.Count())
+	}
+	s.bolt.close()
+}
+
+// Test_StoreConfig tests the Raft defaults chosen for each cluster size, that
+// settings given explicitly override them, and that invalid settings are
+// rejected, both by Validate and when opening the store.
+func Test_StoreConfig(t *testing.T) {
+	for _, tt := range []struct {
+		size      int
+		heartbeat time.Duration
+		trailing  uint64
+	}{
+		{0, time.Second, 10240},
+		{3, time.Second, 10240},
+		{7, 1500 * time.Millisecond, 20480},
+		{31, 2 * time.Second, 40960},
+	} {
+		c := DefaultConfig(tt.size)
+		if c.HeartbeatTimeout != tt.heartbeat || c.TrailingLogs != tt.trailing {
+			t.Fatalf("wrong defaults for %d nodes: %+v", tt.size, c)
+		}
+		if err := c.Validate(); err != nil {
+			t.Fatalf("defaults for %d nodes are not valid: %s", tt.size, err)
+		}
+	}
+
+	c := (&Config{ClusterSize: 31, TrailingLogs: 5}).WithDefaults()
+	if c.TrailingLogs != 5 || c.HeartbeatTimeout != 2*time.Second || c.RetainSnapshots != 2 {
+		t.Fatalf("wrong defaults applied: %+v", c)
+	}
+
+	for _, c := range []*Config{
+		{ClusterSize: -1},
+		{HeartbeatTimeout: time.Millisecond},
+		{HeartbeatTimeout: 2 * time.Second},
+		{LeaderLeaseTimeout: 2 * time.Second},
+		{MaxAppendEntries: 2048},
+		{RetainSnapshots: -1},
+		{TransportMaxPool: -1},
+		{TransportTimeout: -time.Second},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Fatalf("invalid configuration %+v accepted", c)
+		}
+	}
+
+	s := New(true)
+	tmpDir, _ := ioutil.TempDir("", "store_test")
+	defer os.RemoveAll(tmpDir)
+	s.RaftDir = tmpDir
+	s.RaftBind = "127.0.0.1:0"
+	if err := s.Open(true, "node0", &Config{ElectionTimeout: time.Millisecond}); err == nil {
+		t.Fatalf("store opened with an invalid configuration")
+	}
+}
+
+type mockSink struct {
+	bytes.Buffer
+}
+
+func (m *mockSink) ID() string {
+	return "mock"
+}
+
+func (m *mockSink) Cancel() error {
+	return nil
+}
+
+func (m *mockSink) Close() error {
+	return nil
+}
+
+func Test_TestRaft(t *testing.T) {
+	// Get the type of a Raft object
+	store := raft.NewInmemStore()
+	fmt.Printf("Raft implementation type: %T\n", store)
+
+	// Check if your fork has any unique methods or structs
+	// that you can use to identify it
+}
+
+// BenchmarkStoreWrites measures the throughput of concurrent writes to the
+// leader, with and without batching, for the cluster sizes of the
+// performance tests.
+func BenchmarkStoreWrites(b *testing.B) {
+	for _, n := range []int{3, 5, 7, 9, 11, 15, 21, 31} {
+		for _, batch := range []bool{false, true} {
+			b.Run(fmt.Sprintf("nodes=%d/batch=%t", n, batch), func(b *testing.B) {
+				stores := newTestCluster(b, n, batch)
+				leader := stores[0]
+
+				var i int64
+				var mu sync.Mutex
+				b.SetParallelism(32)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						mu.Lock()
+						i++
+						key := fmt.Sprintf("key%d", i)
+						mu.Unlock()
+						if _, err := leader.Put([]byte(key), []byte("value"), PutOptions{}); err != nil {
+							b.Errorf("failed to put key: %s", err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// newTestCluster opens a cluster of n in-memory stores, the first of which
+// is the leader. The stores are closed when the test ends.
+func newTestCluster(tb testing.TB, n int, batch bool) []*Store {
+	stores := make([]*Store, n)
+	for i := range stores {
+		s := New(true)
+		tmpDir, _ := ioutil.TempDir("", "store_test")
+		s.RaftBind = freeAddr(tb)
+		s.RaftDir = tmpDir
+		s.BatchWrites = batch
+		s.logger.SetOutput(io.Discard)
+		if err := s.Open(i == 0, fmt.Sprintf("node%d", i), DefaultConfig(n)); err != nil {
+			tb.Fatalf("failed to open store: %s", err)
+		}
+		tb.Cleanup(func() {
+			s.Close()
+			os.RemoveAll(tmpDir)
+		})
+		stores[i] = s
+
+		if i == 0 {
+			deadline := time.Now().Add(10 * time.Second)
+			for s.raft.State() != raft.Leader {
+				if time.Now().After(deadline) {
+					tb.Fatalf("no leader elected")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			continue
+		}
+		if err := stores[0].Join(s.localID, s.RaftBind, nil); err != nil {
+			tb.Fatalf("failed to join node: %s", err)
+		}
+	}
+	return stores
 }
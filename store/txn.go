@@ -0,0 +1,403 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+
+	pb "go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// maxTxnOps is the maximum number of operations in each branch of a
+// transaction, as in etcd.
+const maxTxnOps = 128
+
+var (
+	// ErrEmptyKey is returned when an operation does not provide a key.
+	ErrEmptyKey = errors.New("key is not provided")
+
+	// ErrTooManyOps is returned when a branch of a transaction has more
+	// than maxTxnOps operations.
+	ErrTooManyOps = errors.New("too many operations in txn request")
+
+	// ErrDuplicateKey is returned when a transaction writes the same key
+	// more than once.
+	ErrDuplicateKey = errors.New("duplicate key given in txn request")
+
+	// errEmptyOp is returned when an operation of a transaction has no
+	// request.
+	errEmptyOp = errors.New("operation is not provided in txn request")
+)
+
+// Txn evaluates the compares of an etcd transaction and atomically applies
+// either its success or its failure operations, via distributed consensus.
+// All writes of the transaction share a single revision. The headers of the
+// response and of every nested response carry only the store revision.
+func (s *Store) Txn(req *pb.TxnRequest) (*pb.TxnResponse, error) {
+	if err := checkTxn(req); err != nil {
+		return nil, err
+	}
+	if txnHasPut(req) {
+		if err := s.checkQuota(); err != nil {
+			return nil, err
+		}
+	}
+
+	b, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.apply(&command{
+		Op:  "txn",
+		Txn: b,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*pb.TxnResponse), nil
+}
+
+func (f *fsm) applyTxn(req *pb.TxnRequest) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Like etcd, decide the branch of every transaction up front, against
+	// the store as it was before the transaction, and make sure every read
+	// on those branches can be served before writing anything.
+	path := f.txnPath(req, nil)
+	if err := f.checkTxnReads(req, path); err != nil {
+		return err
+	}
+
+	rev := f.rev + 1
+	resp, _, wrote := f.execTxn(req, path, rev)
+	if wrote {
+		f.rev = rev
+	}
+	setTxnRevision(resp, f.rev)
+	return resp
+}
+
+// txnPath evaluates the compares of the transaction and of the nested
+// transactions on the branches it takes, and returns whether each succeeded,
+// in depth-first order.
+func (f *fsm) txnPath(req *pb.TxnRequest, path []bool) []bool {
+	ok := true
+	for _, c := range req.Compare {
+		if !f.compare(c) {
+			ok = false
+			break
+		}
+	}
+	path = append(path, ok)
+	for _, op := range txnBranch(req, ok) {
+		if t := op.GetRequestTxn(); t != nil {
+			path = f.txnPath(t, path)
+		}
+	}
+	return path
+}
+
+// checkTxnReads returns an error if a range on the branches of path cannot
+// be served, or a put on them requires a key which does not exist.
+func (f *fsm) checkTxnReads(req *pb.TxnRequest, path []bool) error {
+	var check func(req *pb.TxnRequest) error
+	check = func(req *pb.TxnRequest) error {
+		ok := path[0]
+		path = path[1:]
+		for _, op := range txnBranch(req, ok) {
+			switch {
+			case op.GetRequestRange() != nil:
+				rev := op.GetRequestRange().Revision
+				if rev > f.rev {
+					return ErrFutureRev
+				} else if rev > 0 && rev < f.compactRev {
+					return ErrCompacted
+				}
+			case op.GetRequestPut() != nil:
+				if f.noSpace() {
+					return ErrNoSpace
+				}
+				p := op.GetRequestPut()
+				if _, err := f.checkPut(p.Key, putOptions(p)); err != nil {
+					return err
+				}
+			case op.GetRequestTxn() != nil:
+				if err := check(op.GetRequestTxn()); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return check(req)
+}
+
+// execTxn applies the operations of the branches in path at revision rev,
+// and returns the response, the remainder of path, and whether anything was
+// written.
+func (f *fsm) execTxn(req *pb.TxnRequest, path []bool, rev int64) (*pb.TxnResponse, []bool, bool) {
+	ok := path[0]
+	path = path[1:]
+	wrote := false
+
+	ops := txnBranch(req, ok)
+	resp := &pb.TxnResponse{
+		Succeeded: ok,
+		Responses: make([]*pb.ResponseOp, 0, len(ops)),
+	}
+	for _, op := range ops {
+		var r *pb.ResponseOp
+		switch {
+		case op.GetRequestRange() != nil:
+			rr, _ := (*Store)(f).rangeKVLocked(op.GetRequestRange())
+			r = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseRange{ResponseRange: rr}}
+		case op.GetRequestPut() != nil:
+			p := op.GetRequestPut()
+			prev, _ := f.checkPut(p.Key, putOptions(p))
+			value, lease := p.Value, p.Lease
+			if p.IgnoreValue {
+				value = prev.Value
+			}
+			if p.IgnoreLease {
+				lease = prev.Lease
+			}
+			f.put(p.Key, value, lease, rev)
+			wrote = true
+			pr := &pb.PutResponse{}
+			if p.PrevKv && prev != nil {
+				pr.PrevKv = prev.ToProto()
+			}
+			r = &pb.ResponseOp{Response: &pb.ResponseOp_ResponsePut{ResponsePut: pr}}
+		case op.GetRequestDeleteRange() != nil:
+			d := op.GetRequestDeleteRange()
+			deleted := f.deleteRange(d.Key, d.RangeEnd, rev)
+			wrote = wrote || len(deleted) > 0
+			dr := &pb.DeleteRangeResponse{Deleted: int64(len(deleted))}
+			if d.PrevKv {
+				for _, kv := range deleted {
+					dr.PrevKvs = append(dr.PrevKvs, kv.ToProto())
+				}
+			}
+			r = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseDeleteRange{ResponseDeleteRange: dr}}
+		case op.GetRequestTxn() != nil:
+			var tr *pb.TxnResponse
+			var w bool
+			tr, path, w = f.execTxn(op.GetRequestTxn(), path, rev)
+			wrote = wrote || w
+			r = &pb.ResponseOp{Response: &pb.ResponseOp_ResponseTxn{ResponseTxn: tr}}
+		default:
+			continue
+		}
+		resp.Responses = append(resp.Responses, r)
+	}
+	return resp, path, wrote
+}
+
+// deleteRange deletes every key in the range at revision rev, and returns the
+// deleted key-value pairs. The caller must hold the lock, and advance the
+// store revision if any key was deleted.
+func (f *fsm) deleteRange(start, end []byte, rev int64) []KeyValue {
+	deleted, _ := (*Store)(f).rangeLocked(start, end, 0, 0)
+	for _, kv := range deleted {
+		f.del(kv.Key, rev)
+	}
+	return deleted
+}
+
+// compare evaluates an etcd compare against the latest version of the keys.
+// When the compare covers a range, every key in the range must match.
+func (f *fsm) compare(c *pb.Compare) bool {
+	kvs, _ := (*Store)(f).rangeLocked(c.Key, c.RangeEnd, 0, 0)
+	if len(kvs) == 0 {
+		// A missing key has version, revisions and lease of zero, but no
+		// value to compare against.
+		if c.Target == pb.Compare_VALUE {
+			return false
+		}
+		return compareKV(c, KeyValue{})
+	}
+	for _, kv := range kvs {
+		if !compareKV(c, kv) {
+			return false
+		}
+	}
+	return true
+}
+
+func compareKV(c *pb.Compare, kv KeyValue) bool {
+	var r int
+	switch c.Target {
+	case pb.Compare_VALUE:
+		r = bytes.Compare(kv.Value, c.GetValue())
+	case pb.Compare_VERSION:
+		r = compareInt64(kv.Version, c.GetVersion())
+	case pb.Compare_CREATE:
+		r = compareInt64(kv.CreateRevision, c.GetCreateRevision())
+	case pb.Compare_MOD:
+		r = compareInt64(kv.ModRevision, c.GetModRevision())
+	case pb.Compare_LEASE:
+		r = compareInt64(kv.Lease, c.GetLease())
+	}
+
+	switch c.Result {
+	case pb.Compare_EQUAL:
+		return r == 0
+	case pb.Compare_NOT_EQUAL:
+		return r != 0
+	case pb.Compare_GREATER:
+		return r > 0
+	case pb.Compare_LESS:
+		return r < 0
+	}
+	return false
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// putOptions returns the options of an etcd put request.
+func putOptions(p *pb.PutRequest) PutOptions {
+	return PutOptions{
+		PrevKV:      p.PrevKv,
+		IgnoreValue: p.IgnoreValue,
+		IgnoreLease: p.IgnoreLease,
+		Lease:       p.Lease,
+	}
+}
+
+// txnBranch returns the operations of the branch of the transaction taken
+// when the compares succeeded or failed.
+func txnBranch(req *pb.TxnRequest, succeeded bool) []*pb.RequestOp {
+	if succeeded {
+		return req.Success
+	}
+	return req.Failure
+}
+
+// setTxnRevision sets the revision of the header of the response, and of
+// every nested response.
+func setTxnRevision(resp *pb.TxnResponse, rev int64) {
+	resp.Header = &pb.ResponseHeader{Revision: rev}
+	for _, r := range resp.Responses {
+		switch v := r.Response.(type) {
+		case *pb.ResponseOp_ResponseRange:
+			v.ResponseRange.Header = &pb.ResponseHeader{Revision: rev}
+		case *pb.ResponseOp_ResponsePut:
+			v.ResponsePut.Header = &pb.ResponseHeader{Revision: rev}
+		case *pb.ResponseOp_ResponseDeleteRange:
+			v.ResponseDeleteRange.Header = &pb.ResponseHeader{Revision: rev}
+		case *pb.ResponseOp_ResponseTxn:
+			setTxnRevision(v.ResponseTxn, rev)
+		}
+	}
+}
+
+// checkTxn validates a transaction before it is proposed. Like etcd, a
+// transaction may not write the same key twice on the same branch, nor
+// delete a key it also puts.
+func checkTxn(req *pb.TxnRequest) error {
+	if len(req.Success) > maxTxnOps || len(req.Failure) > maxTxnOps {
+		return ErrTooManyOps
+	}
+	for _, c := range req.Compare {
+		if len(c.Key) == 0 {
+			return ErrEmptyKey
+		}
+	}
+	for _, ops := range [][]*pb.RequestOp{req.Success, req.Failure} {
+		if _, _, err := checkTxnOps(ops); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keyRange is a range of keys, with etcd range semantics.
+type keyRange struct {
+	start, end string
+}
+
+// contains returns whether the key is in the range.
+func (r keyRange) contains(key string) bool {
+	switch r.end {
+	case "":
+		return key == r.start
+	case "\x00":
+		return key >= r.start
+	}
+	return key >= r.start && key < r.end
+}
+
+// checkTxnOps validates the operations of a branch of a transaction, and
+// returns the ranges it deletes and the keys it puts.
+func checkTxnOps(ops []*pb.RequestOp) ([]keyRange, map[string]struct{}, error) {
+	var dels []keyRange
+	puts := make(map[string]struct{})
+	for _, op := range ops {
+		switch {
+		case op.GetRequestRange() != nil:
+			if len(op.GetRequestRange().Key) == 0 {
+				return nil, nil, ErrEmptyKey
+			}
+		case op.GetRequestPut() != nil:
+			k := string(op.GetRequestPut().Key)
+			if k == "" {
+				return nil, nil, ErrEmptyKey
+			}
+			if _, ok := puts[k]; ok {
+				return nil, nil, ErrDuplicateKey
+			}
+			puts[k] = struct{}{}
+		case op.GetRequestDeleteRange() != nil:
+			d := op.GetRequestDeleteRange()
+			if len(d.Key) == 0 {
+				return nil, nil, ErrEmptyKey
+			}
+			dels = append(dels, keyRange{start: string(d.Key), end: string(d.RangeEnd)})
+		case op.GetRequestTxn() != nil:
+			t := op.GetRequestTxn()
+			if err := checkTxn(t); err != nil {
+				return nil, nil, err
+			}
+			// Only one branch of the nested transaction is taken, so its
+			// branches may write the same keys, but neither may write a key
+			// written by this branch.
+			var nestedPuts []map[string]struct{}
+			for _, nested := range [][]*pb.RequestOp{t.Success, t.Failure} {
+				ndels, nputs, err := checkTxnOps(nested)
+				if err != nil {
+					return nil, nil, err
+				}
+				for k := range nputs {
+					if _, ok := puts[k]; ok {
+						return nil, nil, ErrDuplicateKey
+					}
+				}
+				nestedPuts = append(nestedPuts, nputs)
+				dels = append(dels, ndels...)
+			}
+			for _, nputs := range nestedPuts {
+				for k := range nputs {
+					puts[k] = struct{}{}
+				}
+			}
+		default:
+			return nil, nil, errEmptyOp
+		}
+	}
+	for _, d := range dels {
+		for k := range puts {
+			if d.contains(k) {
+				return nil, nil, ErrDuplicateKey
+			}
+		}
+	}
+	return dels, puts, nil
+}
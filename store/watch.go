@@ -0,0 +1,185 @@
+package store
+
+import (
+	"bytes"
+	"sort"
+)
+
+// watcherMaxPending is the number of undelivered events a watcher may
+// buffer. A watcher falling further behind stops buffering, and catches up
+// from the history of the store instead.
+const watcherMaxPending = 1024
+
+// EventType is the type of change to a key.
+type EventType int
+
+// Event types.
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+// Event is a change to a key.
+type Event struct {
+	Type EventType
+
+	// KV is the key-value pair after the change. For a delete, only the key
+	// and the modification revision of the delete are set.
+	KV KeyValue
+
+	// PrevKV is the key-value pair before the change, or nil if the key did
+	// not exist.
+	PrevKV *KeyValue
+}
+
+// Watcher receives the changes made to a range of keys. A Watcher is not
+// safe for concurrent use.
+type Watcher struct {
+	s        *Store
+	key, end []byte
+
+	// The following fields are protected by the store lock.
+	nextRev  int64   // Revision of the next event to return.
+	pending  []Event // Events at or after nextRev, not returned yet.
+	unsynced bool    // Whether pending is incomplete, and must be rebuilt from history.
+
+	ready chan struct{}
+}
+
+// Watch returns a watcher for the changes to the keys in the range described
+// by key and end, using etcd range semantics. The watcher returns every change
+// made at or after startRev, replaying past changes from the history of the
+// store. If startRev is zero, only changes made after the call are returned.
+// ErrCompacted is returned if startRev has been compacted.
+func (s *Store) Watch(key, end []byte, startRev int64) (*Watcher, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if startRev > 0 && startRev < s.compactRev {
+		return nil, ErrCompacted
+	}
+
+	w := &Watcher{
+		s:       s,
+		key:     bytes.Clone(key),
+		end:     bytes.Clone(end),
+		nextRev: s.rev + 1,
+		ready:   make(chan struct{}, 1),
+	}
+	if startRev > 0 {
+		if startRev <= s.rev {
+			w.unsynced = true
+			w.signal()
+		}
+		w.nextRev = startRev
+	}
+	if s.watchers == nil {
+		s.watchers = make(map[*Watcher]struct{})
+	}
+	s.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// Ready returns a channel which receives a value when the watcher may have
+// events to return.
+func (w *Watcher) Ready() <-chan struct{} {
+	return w.ready
+}
+
+// Next returns the events not returned yet, ordered by revision, and the store
+// revision up to which every event has now been returned. It returns
+// ErrCompacted if events were compacted before they could be returned, in
+// which case the watcher must be closed.
+func (w *Watcher) Next() ([]Event, int64, error) {
+	s := w.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w.unsynced {
+		if w.nextRev < s.compactRev {
+			return nil, 0, ErrCompacted
+		}
+		w.pending = (*fsm)(s).eventsSince(w.key, w.end, w.nextRev)
+		w.unsynced = false
+	}
+
+	evs := w.pending
+	w.pending = nil
+	if n := len(evs); n > 0 {
+		w.nextRev = evs[n-1].KV.ModRevision + 1
+	}
+	if w.nextRev <= s.rev {
+		w.nextRev = s.rev + 1
+	}
+	return evs, s.rev, nil
+}
+
+// Close stops the watcher.
+func (w *Watcher) Close() {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	delete(w.s.watchers, w)
+	w.pending = nil
+}
+
+// signal wakes up the reader of the watcher, if it is not already awake.
+func (w *Watcher) signal() {
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// notify delivers the event to every watcher of the key. The caller must hold
+// the lock.
+func (f *fsm) notify(ev Event) {
+	for w := range f.watchers {
+		if w.unsynced || ev.KV.ModRevision < w.nextRev || !(keyRange{string(w.key), string(w.end)}).contains(string(ev.KV.Key)) {
+			continue
+		}
+		if len(w.pending) >= watcherMaxPending {
+			w.pending = nil
+			w.unsynced = true
+		} else {
+			w.pending = append(w.pending, ev)
+		}
+		w.signal()
+	}
+}
+
+// resyncWatchers makes every watcher rebuild its events from history, after
+// the state of the store was replaced. The caller must hold the lock.
+func (f *fsm) resyncWatchers() {
+	for w := range f.watchers {
+		w.pending = nil
+		w.unsynced = true
+		w.signal()
+	}
+}
+
+// eventsSince rebuilds, from the history of the store, the events made at or
+// after revision rev to the keys in the range. The caller must hold the lock.
+func (f *fsm) eventsSince(key, end []byte, rev int64) []Event {
+	var evs []Event
+	ascendRange(f.kv, key, end, func(it kvItem) bool {
+		for i, r := range it.revs {
+			if r.modRev < rev {
+				continue
+			}
+			ev := Event{Type: EventPut, KV: it.keyValue(r)}
+			if r.tombstone {
+				ev = Event{Type: EventDelete, KV: KeyValue{Key: bytes.Clone(it.key), ModRevision: r.modRev}}
+			}
+			if i > 0 && !it.revs[i-1].tombstone {
+				prev := it.keyValue(it.revs[i-1])
+				ev.PrevKV = &prev
+			}
+			evs = append(evs, ev)
+		}
+		return true
+	})
+	sort.SliceStable(evs, func(i, j int) bool {
+		return evs[i].KV.ModRevision < evs[j].KV.ModRevision
+	})
+	return evs
+}